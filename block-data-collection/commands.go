@@ -0,0 +1,660 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/IshiniKiridena/block_data/datacollector"
+)
+
+// runDaily collects every finished UTC day at the configured time, catching up on the days
+// missed while it was not running, and removes the files past the retention period.
+func runDaily(ctx context.Context, args []string) int {
+	flags := newConfigFlags("daily")
+	positional, errWhenParsing := flags.parse(args)
+	if errWhenParsing != nil || len(positional) > 0 {
+		return usageError(flags, errWhenParsing, "daily takes no arguments")
+	}
+	c, code := flags.setup()
+	if c == nil {
+		return code
+	}
+	defer c.close()
+
+	//validated with the rest of the configuration
+	at, _ := c.config.Schedule.TimeOfDay()
+	scheduler := &datacollector.DailyScheduler{
+		At:          at,
+		CatchUpDays: c.config.Schedule.CatchUpDays,
+		Checkpoints: c.checkpoints,
+		Job:         c.runGasJob,
+		LockPath:    c.lockPath(),
+	}
+	scheduler.AfterRun = func() {
+		if c.config.Reorg.ReconcileDays > 0 && ctx.Err() == nil {
+			c.reconcileDays(ctx, scheduler.RecentDays(time.Now(), c.config.Reorg.ReconcileDays))
+		}
+		if c.config.Gaps.ScanDays > 0 && ctx.Err() == nil {
+			c.fillGaps(ctx, c.completedRanges(scheduler.RecentDays(time.Now(), c.config.Gaps.ScanDays)))
+		}
+		removeOldFiles(c.config.RetentionDir(), c.config.FullTransactionDir(), c.config.Retention.Days)
+	}
+
+	errWhenScheduling := scheduler.Run(ctx)
+	return exitCode(ctx, "Daily collection", errWhenScheduling)
+}
+
+// runBackfill collects the gas samples of a time range given by --from and --to.
+func runBackfill(ctx context.Context, args []string) int {
+	flags := newConfigFlags("backfill")
+	from, to := rangeFlags(flags)
+	positional, errWhenParsing := flags.parse(args)
+	if errWhenParsing != nil || len(positional) > 0 {
+		return usageError(flags, errWhenParsing, "backfill takes no arguments")
+	}
+	startTime, endTime, errWhenParsingRange := parseRange(*from, *to)
+	if errWhenParsingRange != nil {
+		return usageError(flags, errWhenParsingRange, "")
+	}
+
+	c, code := flags.setup()
+	if c == nil {
+		return code
+	}
+	defer c.close()
+	lock, code := c.lock()
+	if lock == nil {
+		return code
+	}
+	defer lock.Unlock()
+	return c.collectGas(ctx, startTime, endTime)
+}
+
+// runResume continues a job from its checkpoint, see checkpoints.json for the job names.
+func runResume(ctx context.Context, args []string) int {
+	flags := newConfigFlags("resume")
+	positional, errWhenParsing := flags.parse(args)
+	if errWhenParsing != nil || len(positional) != 1 {
+		return usageError(flags, errWhenParsing, "usage: resume [flags] <job>")
+	}
+	job := positional[0]
+	startTime, endTime, errWhenParsingJob := datacollector.ParseGasJobName(job)
+	if errWhenParsingJob != nil {
+		return usageError(flags, errWhenParsingJob, "")
+	}
+
+	c, code := flags.setup()
+	if c == nil {
+		return code
+	}
+	defer c.close()
+	lock, code := c.lock()
+	if lock == nil {
+		return code
+	}
+	defer lock.Unlock()
+
+	checkpoint, errWhenLoadingCheckpoint := c.checkpoints.Load(job)
+	if errWhenLoadingCheckpoint != nil {
+		fmt.Println("Error when loading the checkpoint : ", errWhenLoadingCheckpoint)
+		return exitFailure
+	}
+	if checkpoint == nil {
+		fmt.Println("No checkpoint for job ", job, " in ", c.checkpointLocation())
+		return exitUsage
+	}
+	return c.collectGas(ctx, startTime, endTime)
+}
+
+// runGaps scans the output of a time range for missing or empty block files and queues
+// them for recollection, which --recollect runs right away.
+func runGaps(ctx context.Context, args []string) int {
+	flags := newConfigFlags("gaps")
+	from, to := rangeFlags(flags)
+	recollect := flags.set.Bool("recollect", false, "collect the queued blocks again after the scan")
+	positional, errWhenParsing := flags.parse(args)
+	if errWhenParsing != nil || len(positional) > 0 {
+		return usageError(flags, errWhenParsing, "gaps takes no arguments")
+	}
+	startTime, endTime, errWhenParsingRange := parseRange(*from, *to)
+	if errWhenParsingRange != nil {
+		return usageError(flags, errWhenParsingRange, "")
+	}
+
+	c, code := flags.setup()
+	if c == nil {
+		return code
+	}
+	defer c.close()
+	lock, code := c.lock()
+	if lock == nil {
+		return code
+	}
+	defer lock.Unlock()
+
+	blockRange, errWhenResolvingRange := datacollector.ResolveBlockRange(ctx, c.source, startTime, endTime)
+	if errWhenResolvingRange != nil {
+		return exitCode(ctx, "Resolving the block range", errWhenResolvingRange)
+	}
+
+	if !*recollect {
+		queued, errWhenScanning := c.scanGaps([]datacollector.BlockRange{blockRange})
+		if errWhenScanning != nil {
+			return exitCode(ctx, "Gap scan", errWhenScanning)
+		}
+		if queued > 0 {
+			fmt.Println("Run again with --recollect, or let the daily run fill them")
+			return exitFailure
+		}
+		return exitOK
+	}
+	return exitCode(ctx, "Gap recollection", c.fillGaps(ctx, []datacollector.BlockRange{blockRange}))
+}
+
+// runVerify checks the block files of a folder and fails when any of them is broken.
+func runVerify(ctx context.Context, args []string) int {
+	flags := newConfigFlags("verify")
+	positional, errWhenParsing := flags.parse(args)
+	if errWhenParsing != nil || len(positional) != 1 {
+		return usageError(flags, errWhenParsing, "usage: verify <dir>")
+	}
+
+	report, errWhenVerifying := datacollector.VerifyGasOutput(positional[0])
+	if errWhenVerifying != nil {
+		fmt.Println("Error when reading the folder : ", errWhenVerifying)
+		return exitFailure
+	}
+
+	for _, problem := range report.Problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("%d files, %d rows, %d files without samples, %d problems\n", report.Files, report.Rows, report.EmptyFiles, len(report.Problems))
+	if !report.OK() {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// runFullTx writes every transaction of the block mined before each minute of the range.
+func runFullTx(ctx context.Context, args []string) int {
+	flags := newConfigFlags("full-tx")
+	from, to := rangeFlags(flags)
+	positional, errWhenParsing := flags.parse(args)
+	if errWhenParsing != nil || len(positional) > 0 {
+		return usageError(flags, errWhenParsing, "full-tx takes no arguments")
+	}
+	startTime, endTime, errWhenParsingRange := parseRange(*from, *to)
+	if errWhenParsingRange != nil {
+		return usageError(flags, errWhenParsingRange, "")
+	}
+
+	c, code := flags.setup()
+	if c == nil {
+		return code
+	}
+	defer c.close()
+	if c.config.Output.Format.IsDatabase() {
+		fmt.Fprintln(os.Stderr, "full-tx writes files, set output.format to csv, jsonl or parquet")
+		return exitUsage
+	}
+
+	options := datacollector.FullTransactionOptions{
+		Source:          c.source,
+		EtherscanKeys:   c.etherscanKeys,
+		EtherscanApiUrl: c.config.Endpoints.EtherscanApiUrl,
+		Retry:           c.config.RetryPolicy(),
+		OutputDir:       c.config.FullTransactionDir(),
+		OutputFormat:    c.config.Output.Format,
+	}
+	errWhenCollecting := datacollector.CollectData(ctx, options, startTime, endTime)
+	return exitCode(ctx, "Transaction data collection", errWhenCollecting)
+}
+
+// runRollup summarises the block aggregates of a time range in time buckets, one file per
+// interval.
+func runRollup(ctx context.Context, args []string) int {
+	flags := newConfigFlags("rollup")
+	from, to := rangeFlags(flags)
+	intervals := flags.set.String("interval", "", "comma separated bucket sizes, minute, hour, day or a duration like 15m (default rollup.intervals)")
+	positional, errWhenParsing := flags.parse(args)
+	if errWhenParsing != nil || len(positional) > 0 {
+		return usageError(flags, errWhenParsing, "rollup takes no arguments")
+	}
+	startTime, endTime, errWhenParsingRange := parseRange(*from, *to)
+	if errWhenParsingRange != nil {
+		return usageError(flags, errWhenParsingRange, "")
+	}
+	//both were checked by parseRange
+	start, _ := time.Parse(time.RFC3339, startTime)
+	end, _ := time.Parse(time.RFC3339, endTime)
+
+	c, code := flags.setup()
+	if c == nil {
+		return code
+	}
+	defer c.close()
+
+	names := c.config.Rollup.Intervals
+	if *intervals != "" {
+		names = datacollector.SplitList(*intervals)
+	}
+	durations := make([]time.Duration, len(names))
+	for i, name := range names {
+		duration, errWhenParsingInterval := datacollector.ParseRollupInterval(name)
+		if errWhenParsingInterval != nil {
+			return usageError(flags, errWhenParsingInterval, "")
+		}
+		durations[i] = duration
+	}
+
+	aggregates, errWhenReading := c.readAggregates(start, end)
+	if errWhenReading != nil {
+		return exitCode(ctx, "Reading the block aggregates", errWhenReading)
+	}
+	if len(aggregates) == 0 {
+		fmt.Println("No block aggregates between ", startTime, " and ", endTime, ", collect with aggregates.enabled to write them")
+		return exitFailure
+	}
+
+	//the database formats write csv rollups
+	format := c.config.Output.Format
+	if format.IsDatabase() {
+		format = datacollector.FormatCSV
+	}
+	errWhenCreatingDir := os.MkdirAll(c.config.RollupDir(), 0755)
+	if errWhenCreatingDir != nil {
+		return exitCode(ctx, "Creating the rollup folder", errWhenCreatingDir)
+	}
+
+	for i, name := range names {
+		rollups := datacollector.RollupAggregates(aggregates, durations[i])
+		path := filepath.Join(c.config.RollupDir(), "rollup_"+name+"_"+startTime+"_"+endTime+format.Extension())
+		errWhenWriting := datacollector.WriteRollupFile(path, rollups)
+		if errWhenWriting != nil {
+			return exitCode(ctx, "Writing "+path, errWhenWriting)
+		}
+		fmt.Printf("Wrote %d %s buckets of %d blocks to %s\n", len(rollups), name, len(aggregates), path)
+	}
+	return exitOK
+}
+
+// runReconcile compares the block hashes stored for a time range with the chain and queues
+// the blocks replaced by a reorg for recollection, like gaps.
+func runReconcile(ctx context.Context, args []string) int {
+	flags := newConfigFlags("reconcile")
+	from, to := rangeFlags(flags)
+	recollect := flags.set.Bool("recollect", false, "collect the queued blocks again after the check")
+	positional, errWhenParsing := flags.parse(args)
+	if errWhenParsing != nil || len(positional) > 0 {
+		return usageError(flags, errWhenParsing, "reconcile takes no arguments")
+	}
+	startTime, endTime, errWhenParsingRange := parseRange(*from, *to)
+	if errWhenParsingRange != nil {
+		return usageError(flags, errWhenParsingRange, "")
+	}
+	//both were checked by parseRange
+	start, _ := time.Parse(time.RFC3339, startTime)
+	end, _ := time.Parse(time.RFC3339, endTime)
+
+	c, code := flags.setup()
+	if c == nil {
+		return code
+	}
+	defer c.close()
+	lock, code := c.lock()
+	if lock == nil {
+		return code
+	}
+	defer lock.Unlock()
+
+	queued, errWhenReconciling := c.reconcile(ctx, start, end)
+	if errWhenReconciling != nil {
+		return exitCode(ctx, "Reconciliation", errWhenReconciling)
+	}
+	if queued == 0 {
+		return exitOK
+	}
+	if !*recollect {
+		fmt.Println("Run again with --recollect, or let the daily run collect them")
+		return exitFailure
+	}
+	return exitCode(ctx, "Reorg recollection", c.recollectQueued(ctx, queued))
+}
+
+// runLive follows the chain head and collects every block once it has the configured
+// confirmations, until it is stopped. New heads come from a subscription on endpoints.ws_url,
+// or from polling the block source when there is none or it drops.
+func runLive(ctx context.Context, args []string) int {
+	flags := newConfigFlags("live")
+	wsUrl := flags.set.String("ws-url", "", "WebSocket endpoint new heads are subscribed to (default endpoints.ws_url)")
+	positional, errWhenParsing := flags.parse(args)
+	if errWhenParsing != nil || len(positional) > 0 {
+		return usageError(flags, errWhenParsing, "live takes no arguments")
+	}
+
+	c, code := flags.setup()
+	if c == nil {
+		return code
+	}
+	defer c.close()
+	lock, code := c.lock()
+	if lock == nil {
+		return code
+	}
+	defer lock.Unlock()
+
+	options := datacollector.LiveCollectorOptions{
+		GasCollectorOptions: c.gasOptions(),
+		PollInterval:        c.config.Live.PollInterval,
+		ResubscribeInterval: c.config.Live.ResubscribeInterval,
+	}
+	url := c.config.WsUrl()
+	if *wsUrl != "" {
+		url = *wsUrl
+	}
+	if url != "" {
+		client, errWhenDialing := datacollector.DialHeadSubscriber(ctx, url)
+		if errWhenDialing != nil {
+			fmt.Println("Error when connecting to ", url, ", polling for new heads instead : ", errWhenDialing)
+		} else {
+			defer client.Close()
+			options.Heads = client
+		}
+	} else {
+		fmt.Println("No endpoints.ws_url, polling for new heads every ", options.PollInterval)
+	}
+
+	result, errWhenFollowing := datacollector.FollowChainHead(ctx, options)
+	printResult(result)
+	printKeyUsage("Infura", c.infuraKeys)
+	printKeyUsage("Etherscan", c.etherscanKeys)
+	//stopping is the only way the live collection ends, the checkpoint continues it
+	if ctx.Err() != nil {
+		fmt.Println("Live collection stopped, run it again to continue")
+		return exitOK
+	}
+	return exitCode(ctx, "Live collection", errWhenFollowing)
+}
+
+// runMempool records the distribution of the fees offered in the mempool every
+// mempool.interval until it is stopped, from a pending transactions subscription on
+// endpoints.ws_url or the transaction pool of endpoints.rpc_url.
+func runMempool(ctx context.Context, args []string) int {
+	flags := newConfigFlags("mempool")
+	wsUrl := flags.set.String("ws-url", "", "WebSocket endpoint pending transactions are subscribed to (default endpoints.ws_url)")
+	interval := flags.set.Duration("interval", 0, "time between two snapshots (default mempool.interval)")
+	positional, errWhenParsing := flags.parse(args)
+	if errWhenParsing != nil || len(positional) > 0 {
+		return usageError(flags, errWhenParsing, "mempool takes no arguments")
+	}
+	if *interval != 0 && *interval < time.Second {
+		return usageError(flags, nil, "--interval must be at least a second")
+	}
+
+	c, code := flags.setup()
+	if c == nil {
+		return code
+	}
+	defer c.close()
+
+	//the database formats write csv files, like rollup
+	format := c.config.Output.Format
+	if format.IsDatabase() {
+		format = datacollector.FormatCSV
+	}
+	options := datacollector.MempoolOptions{
+		Source:   c.source,
+		Interval: c.config.Mempool.Interval,
+		Retry:    c.config.RetryPolicy(),
+		Dir:      c.config.MempoolDir(),
+		Format:   format,
+	}
+	if *interval > 0 {
+		options.Interval = *interval
+	}
+
+	url := c.config.WsUrl()
+	if *wsUrl != "" {
+		url = *wsUrl
+	}
+	if url != "" {
+		subscriber, errWhenDialing := datacollector.DialMempoolSource(ctx, url)
+		if errWhenDialing != nil {
+			fmt.Println("Error when connecting to ", url, " : ", errWhenDialing)
+		} else {
+			defer subscriber.Close()
+			options.Subscriber = subscriber
+		}
+	}
+	//providers do not expose txpool_content, only an own node can be read
+	if c.config.Endpoints.RpcUrl != "" {
+		pool, errWhenDialing := datacollector.DialMempoolSource(ctx, c.config.Endpoints.RpcUrl)
+		if errWhenDialing != nil {
+			fmt.Println("Error when connecting to ", c.config.Endpoints.RpcUrl, " : ", errWhenDialing)
+		} else {
+			defer pool.Close()
+			options.Pool = pool
+		}
+	}
+	if options.Subscriber == nil && options.Pool == nil {
+		fmt.Println("The mempool is read from endpoints.ws_url or the transaction pool of endpoints.rpc_url, neither is available")
+		return exitUsage
+	}
+
+	result, errWhenSampling := datacollector.SampleMempool(ctx, options)
+	fmt.Printf("Recorded %d mempool snapshots (%d from the transaction pool, %d partial intervals skipped) of %d transactions in %s to %s\n",
+		result.Snapshots, result.FromTxPool, result.Skipped, result.Transactions, result.Duration.Round(time.Second), options.Dir)
+	//stopping is the only way the sampling ends
+	if ctx.Err() != nil {
+		fmt.Println("Mempool sampling stopped, run it again to continue")
+		return exitOK
+	}
+	return exitCode(ctx, "Mempool sampling", errWhenSampling)
+}
+
+// readAggregates reads the block aggregates of a time range from the database, or from the
+// aggregate files for the file formats.
+func (c *collector) readAggregates(start time.Time, end time.Time) ([]*datacollector.BlockAggregate, error) {
+	if reader, ok := c.store.(datacollector.AggregateReader); ok {
+		return reader.ReadAggregates(start, end)
+	}
+	return datacollector.ReadAggregateFiles(c.config.AggregatesDir(), start, end)
+}
+
+// reconcile checks the stored block hashes of a time range against the chain, queues the
+// blocks replaced by a reorg and returns how many blocks are waiting to be collected again.
+func (c *collector) reconcile(ctx context.Context, start time.Time, end time.Time) (int, error) {
+	if c.store == nil && !c.config.Aggregates.Enabled {
+		return 0, errors.New("the file formats keep the block hashes in the aggregate files, collect with aggregates.enabled")
+	}
+	aggregates, errWhenReading := c.readAggregates(start, end)
+	if errWhenReading != nil && !(c.store == nil && errors.Is(errWhenReading, os.ErrNotExist)) {
+		return 0, fmt.Errorf("reading the block hashes: %w", errWhenReading)
+	}
+
+	report, errWhenReconciling := datacollector.ReconcileBlocks(ctx, c.source, aggregates)
+	if errWhenReconciling != nil {
+		return 0, errWhenReconciling
+	}
+	queue := datacollector.NewRecollectQueue(c.config.Gaps.QueueFile)
+	added, errWhenQueueing := queue.Enqueue(report.Reorged)
+	if errWhenQueueing != nil {
+		return 0, errWhenQueueing
+	}
+	fmt.Printf("%s to %s : %d blocks checked, %d without a hash, %d replaced by a reorg, %d newly queued\n",
+		start.Format(time.RFC3339), end.Format(time.RFC3339), report.Checked, report.Unhashed, len(report.Reorged), added)
+	if len(report.Unlinked) > 0 {
+		fmt.Println("Blocks not linked to the block before : ", report.Unlinked)
+	}
+
+	pending, errWhenReadingQueue := queue.Pending()
+	return len(pending), errWhenReadingQueue
+}
+
+// reconcileDays reconciles the given days and collects the blocks replaced by a reorg. The
+// file formats without aggregate files have no hashes to check.
+func (c *collector) reconcileDays(ctx context.Context, days []time.Time) {
+	if len(days) == 0 || (c.store == nil && !c.config.Aggregates.Enabled) {
+		return
+	}
+	queued, errWhenReconciling := c.reconcile(ctx, days[0], days[len(days)-1].AddDate(0, 0, 1))
+	if errWhenReconciling != nil {
+		fmt.Println("Error when reconciling the block hashes : ", errWhenReconciling)
+		return
+	}
+	if queued > 0 {
+		c.recollectQueued(ctx, queued)
+	}
+}
+
+// completedRanges returns the blocks already written by the jobs of the given days.
+func (c *collector) completedRanges(days []time.Time) []datacollector.BlockRange {
+	var ranges []datacollector.BlockRange
+	for _, day := range days {
+		checkpoint, errWhenLoadingCheckpoint := c.checkpoints.Load(datacollector.GasJobName(datacollector.DayRange(day)))
+		if errWhenLoadingCheckpoint != nil {
+			fmt.Println("Error when loading the checkpoint : ", errWhenLoadingCheckpoint)
+			continue
+		}
+		if checkpoint != nil {
+			ranges = append(ranges, datacollector.BlockRange{From: checkpoint.StartBlock, To: checkpoint.NextBlock})
+		}
+	}
+	return ranges
+}
+
+// scanGaps queues the missing and empty blocks of the ranges and returns how many blocks
+// are waiting to be collected again.
+func (c *collector) scanGaps(ranges []datacollector.BlockRange) (int, error) {
+	queue := datacollector.NewRecollectQueue(c.config.Gaps.QueueFile)
+	for _, blockRange := range ranges {
+		report, errWhenScanning := c.scanRange(blockRange)
+		if errWhenScanning != nil {
+			return 0, errWhenScanning
+		}
+		added, errWhenQueueing := queue.Enqueue(report.Blocks())
+		if errWhenQueueing != nil {
+			return 0, errWhenQueueing
+		}
+		fmt.Printf("Blocks %d to %d : %d missing, %d empty, %d newly queued\n",
+			blockRange.From, blockRange.To, len(report.Missing), len(report.Empty), added)
+	}
+
+	pending, errWhenReadingQueue := queue.Pending()
+	return len(pending), errWhenReadingQueue
+}
+
+// scanRange reports the gaps of one range, in the database or in the output folder.
+func (c *collector) scanRange(blockRange datacollector.BlockRange) (*datacollector.GapReport, error) {
+	if c.store != nil {
+		return c.store.ScanGaps(blockRange)
+	}
+	return datacollector.ScanGaps(c.config.Output.Dir, blockRange)
+}
+
+// fillGaps scans the ranges and collects every queued block again.
+func (c *collector) fillGaps(ctx context.Context, ranges []datacollector.BlockRange) error {
+	queued, errWhenScanning := c.scanGaps(ranges)
+	if errWhenScanning != nil {
+		fmt.Println("Error when scanning for gaps : ", errWhenScanning)
+		return errWhenScanning
+	}
+	if queued == 0 {
+		return nil
+	}
+	return c.recollectQueued(ctx, queued)
+}
+
+// recollectQueued collects every block of the recollect queue again.
+func (c *collector) recollectQueued(ctx context.Context, queued int) error {
+	fmt.Println("Collecting ", queued, " blocks again")
+	result, errWhenRecollecting := datacollector.NewRecollectQueue(c.config.Gaps.QueueFile).RecollectPending(ctx, c.gasOptions())
+	printResult(result)
+	if errWhenRecollecting != nil {
+		fmt.Println("Error when collecting the queued blocks : ", errWhenRecollecting)
+	}
+	return errWhenRecollecting
+}
+
+func rangeFlags(flags *configFlags) (*string, *string) {
+	from := flags.set.String("from", "", "start of the range, inclusive")
+	to := flags.set.String("to", "", "end of the range, exclusive")
+	return from, to
+}
+
+func parseRange(from string, to string) (string, string, error) {
+	if from == "" || to == "" {
+		return "", "", fmt.Errorf("--from and --to are required")
+	}
+	startTime, err := parseTime(from)
+	if err != nil {
+		return "", "", err
+	}
+	endTime, err := parseTime(to)
+	if err != nil {
+		return "", "", err
+	}
+	if endTime <= startTime {
+		return "", "", fmt.Errorf("--to must be after --from")
+	}
+	return startTime, endTime, nil
+}
+
+// usageError prints err, or message when there is no error, and the flags of the command.
+func usageError(flags *configFlags, err error, message string) int {
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Println("Flags of", flags.set.Name()+":")
+		flags.set.SetOutput(os.Stdout)
+		flags.set.PrintDefaults()
+		return exitOK
+	}
+	if err != nil {
+		message = err.Error()
+	}
+	fmt.Fprintln(os.Stderr, message)
+	flags.set.SetOutput(os.Stderr)
+	flags.set.PrintDefaults()
+	return exitUsage
+}
+
+// removeOldFiles removes the sample files in dataFolder older than retentionDays, with their
+// manifests. The full-tx files are kept, their folder is not searched.
+func removeOldFiles(dataFolder string, fullTransactionFolder string, retentionDays int) {
+	if retentionDays == 0 {
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -retentionDays)
+
+	err := filepath.Walk(dataFolder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && filepath.Clean(path) == filepath.Clean(fullTransactionFolder) {
+			return filepath.SkipDir
+		}
+
+		// Check if the filepath is a sample file and older than the retention period, the
+		// aggregate, rollup and mempool files are kept.
+		if !info.IsDir() && datacollector.IsSampleFile(path) && info.ModTime().Before(cutoff) {
+			// Remove file with its manifest
+			err := datacollector.RemoveSampleFile(path)
+			if err != nil {
+				return err
+			}
+			fmt.Println("Removed File: ", path)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		fmt.Println("Error: ", err)
+	} else {
+		fmt.Println("File removal completed successfully.")
+	}
+}
@@ -0,0 +1,469 @@
+package datacollector
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// aggregateColumn is a csv column of the aggregate files.
+type aggregateColumn struct {
+	name   string
+	format func(a *BlockAggregate) string
+	parse  func(a *BlockAggregate, text string) error
+}
+
+// aggregateColumns are the columns of the aggregate csv files, amounts in Gwei like the
+// sample files.
+var aggregateColumns = buildAggregateColumns()
+
+func buildAggregateColumns() []aggregateColumn {
+	columns := []aggregateColumn{
+		uintAggregateColumn("Block", func(a *BlockAggregate) *uint64 { return &a.Number }),
+		{name: "Timestamp",
+			format: func(a *BlockAggregate) string { return a.Timestamp.UTC().Format(gasTimestampFormat) },
+			parse: func(a *BlockAggregate, text string) (err error) {
+				a.Timestamp, err = time.Parse(gasTimestampFormat, text)
+				return err
+			}},
+		hashAggregateColumn("Block Hash", func(a *BlockAggregate) *common.Hash { return &a.Hash }),
+		hashAggregateColumn("Parent Hash", func(a *BlockAggregate) *common.Hash { return &a.ParentHash }),
+		{name: "Transactions",
+			format: func(a *BlockAggregate) string { return strconv.Itoa(a.Transactions) },
+			parse: func(a *BlockAggregate, text string) (err error) {
+				a.Transactions, err = strconv.Atoi(text)
+				return err
+			}},
+		{name: "Transactions Sampled",
+			format: func(a *BlockAggregate) string { return strconv.Itoa(a.TransactionsSampled) },
+			parse: func(a *BlockAggregate, text string) (err error) {
+				a.TransactionsSampled, err = strconv.Atoi(text)
+				return err
+			}},
+		uintAggregateColumn("Transactions Skipped", func(a *BlockAggregate) *uint64 { return &a.TransactionsSkipped }),
+		gweiAggregateColumn("Base Fee(Gwei)", func(a *BlockAggregate) **big.Int { return &a.BaseFee }),
+		uintAggregateColumn("Gas Used", func(a *BlockAggregate) *uint64 { return &a.GasUsed }),
+		uintAggregateColumn("Gas Limit", func(a *BlockAggregate) *uint64 { return &a.GasLimit }),
+		{name: "Sampler",
+			format: func(a *BlockAggregate) string { return string(a.Sampler) },
+			parse: func(a *BlockAggregate, text string) error {
+				a.Sampler = SamplingStrategy(text)
+				return nil
+			}},
+		{name: "Sample Seed",
+			format: func(a *BlockAggregate) string { return strconv.FormatInt(a.SampleSeed, 10) },
+			parse: func(a *BlockAggregate, text string) (err error) {
+				a.SampleSeed, err = strconv.ParseInt(text, 10, 64)
+				return err
+			}},
+	}
+	for _, amount := range []struct {
+		name  string
+		stats func(a *BlockAggregate) *PriceStats
+	}{
+		{"Effective Gas Price", func(a *BlockAggregate) *PriceStats { return &a.EffectiveGasPrice }},
+		{"Effective Tip", func(a *BlockAggregate) *PriceStats { return &a.EffectiveTip }},
+	} {
+		stats := amount.stats
+		for _, stat := range []struct {
+			name  string
+			field func(s *PriceStats) **big.Int
+		}{
+			{"Min", func(s *PriceStats) **big.Int { return &s.Min }},
+			{"P10", func(s *PriceStats) **big.Int { return &s.P10 }},
+			{"P25", func(s *PriceStats) **big.Int { return &s.P25 }},
+			{"Median", func(s *PriceStats) **big.Int { return &s.Median }},
+			{"Mean", func(s *PriceStats) **big.Int { return &s.Mean }},
+			{"P75", func(s *PriceStats) **big.Int { return &s.P75 }},
+			{"P90", func(s *PriceStats) **big.Int { return &s.P90 }},
+			{"P99", func(s *PriceStats) **big.Int { return &s.P99 }},
+			{"Max", func(s *PriceStats) **big.Int { return &s.Max }},
+		} {
+			field := stat.field
+			columns = append(columns, gweiAggregateColumn(stat.name+" "+amount.name+"(Gwei)", func(a *BlockAggregate) **big.Int { return field(stats(a)) }))
+		}
+	}
+	return columns
+}
+
+func aggregateColumnNames() []string {
+	names := make([]string, len(aggregateColumns))
+	for i, column := range aggregateColumns {
+		names[i] = column.name
+	}
+	return names
+}
+
+func uintAggregateColumn(name string, field func(a *BlockAggregate) *uint64) aggregateColumn {
+	return aggregateColumn{name: name,
+		format: func(a *BlockAggregate) string { return strconv.FormatUint(*field(a), 10) },
+		parse: func(a *BlockAggregate, text string) (err error) {
+			*field(a), err = strconv.ParseUint(text, 10, 64)
+			return err
+		}}
+}
+
+// hashAggregateColumn is a hash in hex, empty for aggregates written without one.
+func hashAggregateColumn(name string, field func(a *BlockAggregate) *common.Hash) aggregateColumn {
+	return aggregateColumn{name: name,
+		format: func(a *BlockAggregate) string { return formatHash(*field(a)) },
+		parse: func(a *BlockAggregate, text string) (err error) {
+			*field(a), err = parseHash(name, text)
+			return err
+		}}
+}
+
+func gweiAggregateColumn(name string, field func(a *BlockAggregate) **big.Int) aggregateColumn {
+	return aggregateColumn{name: name,
+		format: func(a *BlockAggregate) string { return bigToGwei(*field(a)) },
+		parse: func(a *BlockAggregate, text string) (err error) {
+			*field(a), err = parseGwei(name, text)
+			return err
+		}}
+}
+
+// parquetAggregate is the Parquet schema of BlockAggregate, with the statistics flattened
+// into one column each. Amounts are wei as DECIMAL(38,0), like parquetRecord.
+type parquetAggregate struct {
+	Block                   int64   `parquet:"name=block, type=INT64"`
+	Timestamp               int64   `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Hash                    *string `parquet:"name=hash, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	ParentHash              *string `parquet:"name=parent_hash, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Transactions            int32   `parquet:"name=transactions, type=INT32"`
+	TransactionsSampled     int32   `parquet:"name=transactions_sampled, type=INT32"`
+	TransactionsSkipped     int64   `parquet:"name=transactions_skipped, type=INT64"`
+	BaseFee                 *string `parquet:"name=base_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	GasUsed                 int64   `parquet:"name=gas_used, type=INT64"`
+	GasLimit                int64   `parquet:"name=gas_limit, type=INT64"`
+	Sampler                 *string `parquet:"name=sampler, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	SampleSeed              int64   `parquet:"name=sample_seed, type=INT64"`
+	MinEffectiveGasPrice    *string `parquet:"name=min_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P10EffectiveGasPrice    *string `parquet:"name=p10_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P25EffectiveGasPrice    *string `parquet:"name=p25_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MedianEffectiveGasPrice *string `parquet:"name=median_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MeanEffectiveGasPrice   *string `parquet:"name=mean_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P75EffectiveGasPrice    *string `parquet:"name=p75_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P90EffectiveGasPrice    *string `parquet:"name=p90_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P99EffectiveGasPrice    *string `parquet:"name=p99_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MaxEffectiveGasPrice    *string `parquet:"name=max_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MinEffectiveTip         *string `parquet:"name=min_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P10EffectiveTip         *string `parquet:"name=p10_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P25EffectiveTip         *string `parquet:"name=p25_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MedianEffectiveTip      *string `parquet:"name=median_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MeanEffectiveTip        *string `parquet:"name=mean_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P75EffectiveTip         *string `parquet:"name=p75_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P90EffectiveTip         *string `parquet:"name=p90_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P99EffectiveTip         *string `parquet:"name=p99_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MaxEffectiveTip         *string `parquet:"name=max_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+}
+
+// parquetStats points at the statistics columns of an amount, in priceStatsValues order.
+func (p *parquetAggregate) parquetStats() [][]**string {
+	return [][]**string{
+		{&p.MinEffectiveGasPrice, &p.P10EffectiveGasPrice, &p.P25EffectiveGasPrice, &p.MedianEffectiveGasPrice,
+			&p.MeanEffectiveGasPrice, &p.P75EffectiveGasPrice, &p.P90EffectiveGasPrice, &p.P99EffectiveGasPrice, &p.MaxEffectiveGasPrice},
+		{&p.MinEffectiveTip, &p.P10EffectiveTip, &p.P25EffectiveTip, &p.MedianEffectiveTip,
+			&p.MeanEffectiveTip, &p.P75EffectiveTip, &p.P90EffectiveTip, &p.P99EffectiveTip, &p.MaxEffectiveTip},
+	}
+}
+
+func toParquetAggregate(a *BlockAggregate) *parquetAggregate {
+	aggregate := &parquetAggregate{
+		Block:               int64(a.Number),
+		Timestamp:           a.Timestamp.UnixMilli(),
+		Hash:                toParquetHash(a.Hash),
+		ParentHash:          toParquetHash(a.ParentHash),
+		Transactions:        int32(a.Transactions),
+		TransactionsSampled: int32(a.TransactionsSampled),
+		TransactionsSkipped: int64(a.TransactionsSkipped),
+		BaseFee:             toParquetDecimal(a.BaseFee),
+		GasUsed:             int64(a.GasUsed),
+		GasLimit:            int64(a.GasLimit),
+		SampleSeed:          a.SampleSeed,
+	}
+	if a.Sampler != "" {
+		sampler := string(a.Sampler)
+		aggregate.Sampler = &sampler
+	}
+	columns := aggregate.parquetStats()
+	for i, stats := range []PriceStats{a.EffectiveGasPrice, a.EffectiveTip} {
+		for j, value := range priceStatsValues(stats) {
+			*columns[i][j] = toParquetDecimal(value)
+		}
+	}
+	return aggregate
+}
+
+func fromParquetAggregate(p *parquetAggregate) *BlockAggregate {
+	columns := p.parquetStats()
+	stats := make([]PriceStats, 2)
+	for i := range stats {
+		values := make([]*big.Int, len(columns[i]))
+		for j, column := range columns[i] {
+			values[j] = fromParquetDecimal(*column)
+		}
+		stats[i] = priceStatsFromValues(values)
+	}
+
+	var sampler SamplingStrategy
+	if p.Sampler != nil {
+		sampler = SamplingStrategy(*p.Sampler)
+	}
+	return &BlockAggregate{
+		Number:              uint64(p.Block),
+		Timestamp:           time.UnixMilli(p.Timestamp).UTC(),
+		Hash:                fromParquetHash(p.Hash),
+		ParentHash:          fromParquetHash(p.ParentHash),
+		Transactions:        int(p.Transactions),
+		TransactionsSampled: int(p.TransactionsSampled),
+		TransactionsSkipped: uint64(p.TransactionsSkipped),
+		BaseFee:             fromParquetDecimal(p.BaseFee),
+		GasUsed:             uint64(p.GasUsed),
+		GasLimit:            uint64(p.GasLimit),
+		Sampler:             sampler,
+		SampleSeed:          p.SampleSeed,
+		EffectiveGasPrice:   stats[0],
+		EffectiveTip:        stats[1],
+	}
+}
+
+// toParquetHash returns nil for the zero hash of aggregates written without one.
+func toParquetHash(hash common.Hash) *string {
+	if hash == (common.Hash{}) {
+		return nil
+	}
+	hex := hash.Hex()
+	return &hex
+}
+
+func fromParquetHash(hex *string) common.Hash {
+	if hex == nil {
+		return common.Hash{}
+	}
+	return common.HexToHash(*hex)
+}
+
+// formatHash is the csv text of a hash, empty for the zero hash.
+func formatHash(hash common.Hash) string {
+	if hash == (common.Hash{}) {
+		return ""
+	}
+	return hash.Hex()
+}
+
+// parseHash reads a hash written by formatHash.
+func parseHash(name string, text string) (common.Hash, error) {
+	if text == "" {
+		return common.Hash{}, nil
+	}
+	if len(text) != 2+2*common.HashLength || !strings.HasPrefix(text, "0x") {
+		return common.Hash{}, fmt.Errorf("%s %q is not a hash", name, text)
+	}
+	return common.HexToHash(text), nil
+}
+
+// writeAggregates writes aggregates to w in format.
+func writeAggregates(w io.Writer, format OutputFormat, aggregates []*BlockAggregate) error {
+	switch format {
+	case FormatCSV, "":
+		csvWriter := csv.NewWriter(w)
+		errWhenWriting := csvWriter.Write(aggregateColumnNames())
+		for _, aggregate := range aggregates {
+			if errWhenWriting != nil {
+				return errWhenWriting
+			}
+			row := make([]string, len(aggregateColumns))
+			for i, column := range aggregateColumns {
+				row[i] = column.format(aggregate)
+			}
+			errWhenWriting = csvWriter.Write(row)
+		}
+		csvWriter.Flush()
+		if errWhenWriting != nil {
+			return errWhenWriting
+		}
+		return csvWriter.Error()
+	case FormatJSONL:
+		buffered := bufio.NewWriter(w)
+		encoder := json.NewEncoder(buffered)
+		for _, aggregate := range aggregates {
+			errWhenWriting := encoder.Encode(aggregate)
+			if errWhenWriting != nil {
+				return errWhenWriting
+			}
+		}
+		return buffered.Flush()
+	case FormatParquet:
+		parquetWriter, err := writer.NewParquetWriterFromWriter(w, new(parquetAggregate), 1)
+		if err != nil {
+			return err
+		}
+		for _, aggregate := range aggregates {
+			err = parquetWriter.Write(toParquetAggregate(aggregate))
+			if err != nil {
+				return err
+			}
+		}
+		return parquetWriter.WriteStop()
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// readAggregateFile reads an aggregate file of any format; partial files are JSON lines.
+func readAggregateFile(path string) ([]*BlockAggregate, error) {
+	format := formatOf(path)
+	if strings.HasSuffix(path, partialSuffix) {
+		format = FormatJSONL
+	}
+
+	switch format {
+	case FormatJSONL:
+		return readJSONLines[BlockAggregate](path)
+	case FormatParquet:
+		file, err := openParquetFile(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		parquetReader, err := reader.NewParquetReader(file, new(parquetAggregate), 1)
+		if err != nil {
+			return nil, err
+		}
+		defer parquetReader.ReadStop()
+
+		rows := make([]parquetAggregate, parquetReader.GetNumRows())
+		if len(rows) > 0 {
+			err = parquetReader.Read(&rows)
+			if err != nil {
+				return nil, err
+			}
+		}
+		aggregates := make([]*BlockAggregate, len(rows))
+		for i := range rows {
+			aggregates[i] = fromParquetAggregate(&rows[i])
+		}
+		return aggregates, nil
+	case FormatCSV:
+		rows, err := readCsvRecords(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			return nil, fmt.Errorf("unexpected header")
+		}
+		//columns are matched by name, files written before a column was added leave it empty
+		byName := make(map[string]aggregateColumn)
+		for _, column := range aggregateColumns {
+			byName[column.name] = column
+		}
+		columns := make([]aggregateColumn, len(rows[0]))
+		for i, name := range rows[0] {
+			column, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("unexpected header column %q", name)
+			}
+			columns[i] = column
+		}
+
+		aggregates := make([]*BlockAggregate, 0, len(rows)-1)
+		for i, row := range rows[1:] {
+			if len(row) != len(columns) {
+				return nil, fmt.Errorf("line %d: %d columns, expected %d", i+2, len(row), len(columns))
+			}
+			aggregate := &BlockAggregate{}
+			for j, column := range columns {
+				err = column.parse(aggregate, row[j])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", i+2, err)
+				}
+			}
+			aggregates = append(aggregates, aggregate)
+		}
+		return aggregates, nil
+	default:
+		return nil, fmt.Errorf("unknown output format of %s", filepath.Base(path))
+	}
+}
+
+// aggregateGasOutput writes the block aggregates of a run to one file per UTC day, or per
+// block range with the blocks layout, next to the samples written by the output it wraps.
+// Files are staged like the consolidated sample files.
+type aggregateGasOutput struct {
+	gasOutput
+
+	dir           string
+	format        OutputFormat
+	blocksPerFile uint64
+	//aggregates of these blocks found in an existing file are dropped, they are written again
+	replaces func(number uint64) bool
+
+	name string
+	file *stagedFile[BlockAggregate]
+}
+
+func (o *aggregateGasOutput) fileName(data *blockGasData) string {
+	if o.blocksPerFile == 0 {
+		return "aggregates_" + data.timestamp.UTC().Format("2006-01-02") + o.format.Extension()
+	}
+	first := data.number / o.blocksPerFile * o.blocksPerFile
+	return "aggregates_" + strconv.FormatUint(first, 10) + "-" + strconv.FormatUint(first+o.blocksPerFile-1, 10) + o.format.Extension()
+}
+
+func (o *aggregateGasOutput) WriteBlock(data *blockGasData) error {
+	errWhenWriting := o.gasOutput.WriteBlock(data)
+	if errWhenWriting != nil || data.aggregate == nil {
+		return errWhenWriting
+	}
+
+	name := o.fileName(data)
+	if name != o.name {
+		errWhenClosing := o.closeFile()
+		if errWhenClosing != nil {
+			return errWhenClosing
+		}
+		file, errWhenOpening := openStagedFile(filepath.Join(o.dir, name), readAggregateFile, o.keeps)
+		if errWhenOpening != nil {
+			return errWhenOpening
+		}
+		o.name, o.file = name, file
+	}
+	return o.file.Append(data.aggregate)
+}
+
+// keeps drops the aggregates of the blocks about to be written again.
+func (o *aggregateGasOutput) keeps(aggregate *BlockAggregate) bool {
+	return o.replaces == nil || !o.replaces(aggregate.Number)
+}
+
+// closeFile writes the current file in its format and removes its partial file.
+func (o *aggregateGasOutput) closeFile() error {
+	if o.file == nil {
+		return nil
+	}
+	file := o.file
+	o.file, o.name = nil, ""
+	return file.Finish(func(w io.Writer, aggregates []*BlockAggregate) error {
+		return writeAggregates(w, o.format, aggregates)
+	})
+}
+
+func (o *aggregateGasOutput) Close() error {
+	errWhenClosing := o.gasOutput.Close()
+	if errWhenClosing != nil {
+		return errWhenClosing
+	}
+	return o.closeFile()
+}
@@ -0,0 +1,198 @@
+package datacollector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// AggregateScope chooses the transactions the block aggregates are computed over.
+type AggregateScope string
+
+const (
+	//the sampled transactions, no extra requests
+	AggregateSamples AggregateScope = "samples"
+	//every successful transaction of the block, one receipt request per transaction
+	AggregateAll AggregateScope = "all"
+)
+
+// BlockAggregate summarises the gas prices paid in one block. Amounts are in wei.
+type BlockAggregate struct {
+	Number    uint64    `json:"block"`
+	Timestamp time.Time `json:"timestamp"`
+	//hashes of the block and its parent when it was collected, to detect reorgs
+	Hash       common.Hash `json:"hash"`
+	ParentHash common.Hash `json:"parentHash"`
+	//transactions the statistics are computed over
+	Transactions        int    `json:"transactions"`
+	TransactionsSampled int    `json:"transactionsSampled"`
+	TransactionsSkipped uint64 `json:"transactionsSkipped"`
+	//sampler and seed of the samples, see BlockSampleSeed
+	Sampler    SamplingStrategy `json:"sampler"`
+	SampleSeed int64            `json:"sampleSeed"`
+	//nil before London
+	BaseFee  *big.Int `json:"baseFee"`
+	GasUsed  uint64   `json:"gasUsed"`
+	GasLimit uint64   `json:"gasLimit"`
+
+	EffectiveGasPrice PriceStats `json:"effectiveGasPrice"`
+	EffectiveTip      PriceStats `json:"effectiveTip"`
+}
+
+// PriceStats are statistics of a wei amount over the transactions of a block, all nil when
+// there are none. Percentiles use the nearest rank; Mean and Median are rounded down to
+// whole wei, the median of an even count being the mean of the two middle values.
+type PriceStats struct {
+	Min    *big.Int `json:"min"`
+	P10    *big.Int `json:"p10"`
+	P25    *big.Int `json:"p25"`
+	Median *big.Int `json:"median"`
+	Mean   *big.Int `json:"mean"`
+	P75    *big.Int `json:"p75"`
+	P90    *big.Int `json:"p90"`
+	P99    *big.Int `json:"p99"`
+	Max    *big.Int `json:"max"`
+}
+
+// priceStatsValues returns the statistics from the lowest to the highest percentile, the
+// mean after the median.
+func priceStatsValues(stats PriceStats) []*big.Int {
+	return []*big.Int{stats.Min, stats.P10, stats.P25, stats.Median, stats.Mean, stats.P75, stats.P90, stats.P99, stats.Max}
+}
+
+// priceStatsFromValues is the reverse of priceStatsValues.
+func priceStatsFromValues(values []*big.Int) PriceStats {
+	return PriceStats{Min: values[0], P10: values[1], P25: values[2], Median: values[3], Mean: values[4],
+		P75: values[5], P90: values[6], P99: values[7], Max: values[8]}
+}
+
+// newBlockAggregate starts the aggregate of block with the fields of its header.
+func newBlockAggregate(block *types.Block) *BlockAggregate {
+	return &BlockAggregate{
+		Number:     block.NumberU64(),
+		Timestamp:  time.Unix(int64(block.Time()), 0).UTC(),
+		Hash:       block.Hash(),
+		ParentHash: block.ParentHash(),
+		BaseFee:    block.BaseFee(),
+		GasUsed:    block.GasUsed(),
+		GasLimit:   block.GasLimit(),
+	}
+}
+
+// setSamples counts the samples of the block, a transaction sampled twice once.
+func (a *BlockAggregate) setSamples(records []*TransactionRecord, skipped uint64) {
+	seen := make(map[common.Hash]bool)
+	for _, record := range records {
+		seen[record.Hash] = true
+	}
+	a.TransactionsSampled = len(seen)
+	a.TransactionsSkipped = skipped
+}
+
+// setPrices computes the statistics of the effective gas prices and tips of the aggregated
+// transactions.
+func (a *BlockAggregate) setPrices(prices []*big.Int, tips []*big.Int) {
+	a.Transactions = len(prices)
+	a.EffectiveGasPrice = priceStats(prices)
+	a.EffectiveTip = priceStats(tips)
+}
+
+// samplePrices returns the effective gas prices and tips of the samples. A transaction
+// sampled twice is counted once.
+func samplePrices(records []*TransactionRecord) (prices []*big.Int, tips []*big.Int) {
+	seen := make(map[common.Hash]bool)
+	for _, record := range records {
+		if seen[record.Hash] || record.EffectiveGasPrice == nil {
+			continue
+		}
+		seen[record.Hash] = true
+		prices = append(prices, record.EffectiveGasPrice)
+		if record.EffectiveTip != nil {
+			tips = append(tips, record.EffectiveTip)
+		}
+	}
+	return prices, tips
+}
+
+// blockPrices returns the effective gas prices and tips of every successful transaction of
+// block. receipts holds the receipts already fetched for the samples, the others are
+// fetched; a receipt the node does not have leaves its transaction out.
+func blockPrices(ctx context.Context, source BlockSource, block *types.Block, receipts map[common.Hash]*types.Receipt) (prices []*big.Int, tips []*big.Int, err error) {
+	baseFee := block.BaseFee()
+	for _, tx := range block.Transactions() {
+		receipt, ok := receipts[tx.Hash()]
+		if !ok {
+			receipt, err = source.TransactionReceipt(ctx, tx.Hash())
+			if err != nil {
+				if ClassifyError(err) == ErrorClassNotFound {
+					continue
+				}
+				return nil, nil, fmt.Errorf("receipt of %s: %w", tx.Hash().Hex(), err)
+			}
+		}
+		if receipt == nil || receipt.Status != 1 {
+			continue
+		}
+
+		price := receipt.EffectiveGasPrice
+		if price == nil {
+			//older nodes do not return effectiveGasPrice in receipts
+			price = paidGasPrice(tx, baseFee)
+		}
+		tip := price
+		if baseFee != nil {
+			tip = new(big.Int).Sub(price, baseFee)
+		}
+		prices = append(prices, price)
+		tips = append(tips, tip)
+	}
+	return prices, tips, nil
+}
+
+func priceStats(values []*big.Int) PriceStats {
+	if len(values) == 0 {
+		return PriceStats{}
+	}
+	sorted := append([]*big.Int{}, values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Cmp(sorted[j]) < 0 })
+
+	sum := new(big.Int)
+	for _, value := range sorted {
+		sum.Add(sum, value)
+	}
+	count := big.NewInt(int64(len(sorted)))
+
+	middle := len(sorted) / 2
+	median := new(big.Int).Set(sorted[middle])
+	if len(sorted)%2 == 0 {
+		median.Add(median, sorted[middle-1])
+		median.Quo(median, big.NewInt(2))
+	}
+
+	return PriceStats{
+		Min:    sorted[0],
+		P10:    percentile(sorted, 10),
+		P25:    percentile(sorted, 25),
+		Median: median,
+		Mean:   sum.Quo(sum, count),
+		P75:    percentile(sorted, 75),
+		P90:    percentile(sorted, 90),
+		P99:    percentile(sorted, 99),
+		Max:    sorted[len(sorted)-1],
+	}
+}
+
+// percentile returns the nearest rank percentile of sorted values: the smallest value that
+// at least p percent of the values are less than or equal to.
+func percentile(sorted []*big.Int, p int) *big.Int {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
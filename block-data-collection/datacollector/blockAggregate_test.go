@@ -0,0 +1,85 @@
+package datacollector
+
+import (
+	"math/big"
+	"testing"
+)
+
+func bigInts(values ...int64) []*big.Int {
+	ints := make([]*big.Int, len(values))
+	for i, value := range values {
+		ints[i] = big.NewInt(value)
+	}
+	return ints
+}
+
+func TestPercentile(t *testing.T) {
+	oneToHundred := make([]int64, 100)
+	for i := range oneToHundred {
+		oneToHundred[i] = int64(i + 1)
+	}
+
+	tests := []struct {
+		name   string
+		sorted []int64
+		p      int
+		want   int64
+	}{
+		{"p0 is the minimum", []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 0, 1},
+		{"p10 of ten", []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 10, 1},
+		{"p25 of ten rounds the rank up", []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 25, 3},
+		{"p75 of ten", []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 75, 8},
+		{"p90 of ten", []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 90, 9},
+		{"p99 of ten is the maximum", []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 99, 10},
+		{"p100 is the maximum", []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 100, 10},
+		{"p25 of four", []int64{10, 20, 30, 40}, 25, 10},
+		{"p75 of four", []int64{10, 20, 30, 40}, 75, 30},
+		{"p90 of four", []int64{10, 20, 30, 40}, 90, 40},
+		{"p10 of a hundred", oneToHundred, 10, 10},
+		{"p99 of a hundred", oneToHundred, 99, 99},
+		{"single value", []int64{7}, 50, 7},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := percentile(bigInts(test.sorted...), test.p); got.Int64() != test.want {
+				t.Errorf("percentile(p%d) = %d, want %d", test.p, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPriceStats(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []int64
+		//min, p10, p25, median, mean, p75, p90, p99 and max
+		want []int64
+	}{
+		{"even count", []int64{30, 10, 20, 40}, []int64{10, 10, 10, 25, 25, 30, 40, 40, 40}},
+		{"odd count", []int64{5, 1, 3}, []int64{1, 1, 1, 3, 3, 5, 5, 5, 5}},
+		{"median and mean round down", []int64{2, 1}, []int64{1, 1, 1, 1, 1, 2, 2, 2, 2}},
+		{"single value", []int64{7}, []int64{7, 7, 7, 7, 7, 7, 7, 7, 7}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values := bigInts(test.values...)
+			got := priceStatsValues(priceStats(values))
+			for i := range got {
+				if got[i].Int64() != test.want[i] {
+					t.Fatalf("statistics %v, want %v", got, test.want)
+				}
+			}
+			for i := range values {
+				if values[i].Int64() != test.values[i] {
+					t.Fatalf("priceStats reordered its input")
+				}
+			}
+		})
+	}
+
+	for _, value := range priceStatsValues(priceStats(nil)) {
+		if value != nil {
+			t.Fatalf("statistics of no values are %v, want nil", value)
+		}
+	}
+}
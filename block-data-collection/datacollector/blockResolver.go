@@ -0,0 +1,144 @@
+package datacollector
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// BlockResolver turns unix timestamps into block numbers by binary searching
+// block headers over a BlockSource.
+type BlockResolver struct {
+	source BlockSource
+	cache  *HeaderCache
+}
+
+// NewBlockResolver creates a resolver. The cache is optional and may be nil.
+func NewBlockResolver(source BlockSource, cache *HeaderCache) *BlockResolver {
+	return &BlockResolver{source: source, cache: cache}
+}
+
+// BlockBefore returns the number of the last block mined at or before the given
+// timestamp, the same "closest before" semantics as Etherscan's getblocknobytime.
+func (r *BlockResolver) BlockBefore(ctx context.Context, timestamp int64) (uint64, error) {
+	if timestamp < 0 {
+		return 0, fmt.Errorf("invalid timestamp %d", timestamp)
+	}
+	target := uint64(timestamp)
+
+	head, err := r.source.BlockNumber(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	headHeader, err := r.header(ctx, head)
+	if err != nil {
+		return 0, err
+	}
+	if headHeader.Time <= target {
+		return head, nil
+	}
+
+	genesis, err := r.header(ctx, 0)
+	if err != nil {
+		return 0, err
+	}
+	if genesis.Time > target {
+		return 0, fmt.Errorf("timestamp %d is before the genesis block", timestamp)
+	}
+
+	//invariant: time(low) <= target < time(high)
+	low, high := uint64(0), head
+	for high-low > 1 {
+		mid := low + (high-low)/2
+		header, err := r.header(ctx, mid)
+		if err != nil {
+			return 0, err
+		}
+		if header.Time <= target {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	return low, nil
+}
+
+func (r *BlockResolver) header(ctx context.Context, number uint64) (*types.Header, error) {
+	if r.cache != nil {
+		if header, ok := r.cache.Get(number); ok {
+			return header, nil
+		}
+	}
+
+	header, err := r.source.HeaderByNumber(ctx, new(big.Int).SetUint64(number))
+	if err != nil {
+		return nil, err
+	}
+
+	if r.cache != nil {
+		r.cache.Add(number, header)
+	}
+	return header, nil
+}
+
+// HeaderCache is a small LRU cache of block headers keyed by block number.
+type HeaderCache struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[uint64]*list.Element
+}
+
+type headerCacheEntry struct {
+	number uint64
+	header *types.Header
+}
+
+func NewHeaderCache(size int) *HeaderCache {
+	if size < 1 {
+		size = 1
+	}
+	return &HeaderCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[uint64]*list.Element),
+	}
+}
+
+func (c *HeaderCache) Get(number uint64) (*types.Header, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[number]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*headerCacheEntry).header, true
+}
+
+func (c *HeaderCache) Add(number uint64, header *types.Header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[number]; ok {
+		element.Value.(*headerCacheEntry).header = header
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[number] = c.order.PushFront(&headerCacheEntry{number: number, header: header})
+
+	//evict the least recently used header
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*headerCacheEntry).number)
+	}
+}
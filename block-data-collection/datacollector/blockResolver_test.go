@@ -0,0 +1,99 @@
+package datacollector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// headerChain is a BlockSource of headers with the given timestamps, block i at times[i].
+type headerChain struct {
+	BlockSource
+	times []uint64
+}
+
+func (c headerChain) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if !number.IsUint64() || number.Uint64() >= uint64(len(c.times)) {
+		return nil, fmt.Errorf("block %s not found", number)
+	}
+	return &types.Header{Number: number, Time: c.times[number.Uint64()]}, nil
+}
+
+func (c headerChain) BlockNumber(ctx context.Context) (uint64, error) {
+	return uint64(len(c.times) - 1), nil
+}
+
+func TestBlockBefore(t *testing.T) {
+	chain := []uint64{1000, 1012, 1024, 1036, 1100, 1112}
+
+	tests := []struct {
+		name      string
+		times     []uint64
+		timestamp int64
+		want      uint64
+		wantErr   bool
+	}{
+		{"before genesis", chain, 999, 0, true},
+		{"negative timestamp", chain, -1, 0, true},
+		{"at genesis", chain, 1000, 0, false},
+		{"after genesis", chain, 1011, 0, false},
+		{"at a block", chain, 1012, 1, false},
+		{"in a gap", chain, 1050, 3, false},
+		{"end of a gap", chain, 1099, 3, false},
+		{"before head", chain, 1111, 4, false},
+		{"at head", chain, 1112, 5, false},
+		{"after head", chain, 5000, 5, false},
+		{"single block", []uint64{1000}, 1000, 0, false},
+		{"single block, after it", []uint64{1000}, 2000, 0, false},
+		{"single block, before it", []uint64{1000}, 999, 0, true},
+		{"two blocks, between them", []uint64{1000, 1012}, 1011, 0, false},
+		{"two blocks, at head", []uint64{1000, 1012}, 1012, 1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			//a second lookup is answered from the cache, and must not differ
+			resolver := NewBlockResolver(headerChain{times: test.times}, NewHeaderCache(4))
+			for i := 0; i < 2; i++ {
+				got, err := resolver.BlockBefore(context.Background(), test.timestamp)
+				if test.wantErr {
+					if err == nil {
+						t.Fatalf("BlockBefore(%d) = %d, want an error", test.timestamp, got)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != test.want {
+					t.Fatalf("BlockBefore(%d) = %d, want %d", test.timestamp, got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBlockBeforeEveryTimestamp(t *testing.T) {
+	times := []uint64{1000}
+	for i := 1; i < 300; i++ {
+		//uneven block times of 1 to 30 seconds
+		times = append(times, times[i-1]+1+uint64(i*i%30))
+	}
+	resolver := NewBlockResolver(headerChain{times: times}, nil)
+
+	want := uint64(0)
+	for timestamp := times[0]; timestamp <= times[len(times)-1]+20; timestamp++ {
+		for want+1 < uint64(len(times)) && times[want+1] <= timestamp {
+			want++
+		}
+		got, err := resolver.BlockBefore(context.Background(), int64(timestamp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("BlockBefore(%d) = %d, want %d", timestamp, got, want)
+		}
+	}
+}
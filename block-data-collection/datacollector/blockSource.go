@@ -0,0 +1,238 @@
+package datacollector
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// BlockSource is the part of an Ethereum node the collectors read from.
+// Any JSON-RPC endpoint (Infura, a local geth/anvil node, ...) or a fake can back it.
+type BlockSource interface {
+	BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error)
+	BlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	BlockNumber(ctx context.Context) (uint64, error)
+}
+
+// RPCBlockSource is a BlockSource backed by an ethclient connection.
+type RPCBlockSource struct {
+	client *ethclient.Client
+}
+
+func NewRPCBlockSource(rawUrl string) (*RPCBlockSource, error) {
+	client, err := ethclient.Dial(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	return &RPCBlockSource{client: client}, nil
+}
+
+func (s *RPCBlockSource) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	return s.client.BlockByNumber(ctx, number)
+}
+
+func (s *RPCBlockSource) BlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error) {
+	return s.client.BlockByHash(ctx, hash)
+}
+
+func (s *RPCBlockSource) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return s.client.HeaderByNumber(ctx, number)
+}
+
+func (s *RPCBlockSource) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	return s.client.TransactionReceipt(ctx, txHash)
+}
+
+func (s *RPCBlockSource) BlockNumber(ctx context.Context) (uint64, error) {
+	return s.client.BlockNumber(ctx)
+}
+
+func (s *RPCBlockSource) Close() {
+	s.client.Close()
+}
+
+// PooledBlockSource sends every call through one of several endpoints of the same
+// provider, one per API key, taking the key from a KeyPool so the load is spread evenly.
+type PooledBlockSource struct {
+	pool      *KeyPool
+	urlForKey func(apiKey string) string
+
+	mu      sync.Mutex
+	clients map[string]*RPCBlockSource
+}
+
+func NewPooledBlockSource(pool *KeyPool, urlForKey func(apiKey string) string) (*PooledBlockSource, error) {
+	if pool.Len() == 0 {
+		return nil, ErrNoKeys
+	}
+	return &PooledBlockSource{pool: pool, urlForKey: urlForKey, clients: make(map[string]*RPCBlockSource)}, nil
+}
+
+func (s *PooledBlockSource) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	var block *types.Block
+	err := s.do(ctx, func(src *RPCBlockSource) error {
+		var err error
+		block, err = src.BlockByNumber(ctx, number)
+		return err
+	})
+	return block, err
+}
+
+func (s *PooledBlockSource) BlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error) {
+	var block *types.Block
+	err := s.do(ctx, func(src *RPCBlockSource) error {
+		var err error
+		block, err = src.BlockByHash(ctx, hash)
+		return err
+	})
+	return block, err
+}
+
+func (s *PooledBlockSource) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	var header *types.Header
+	err := s.do(ctx, func(src *RPCBlockSource) error {
+		var err error
+		header, err = src.HeaderByNumber(ctx, number)
+		return err
+	})
+	return header, err
+}
+
+func (s *PooledBlockSource) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	var receipt *types.Receipt
+	err := s.do(ctx, func(src *RPCBlockSource) error {
+		var err error
+		receipt, err = src.TransactionReceipt(ctx, txHash)
+		return err
+	})
+	return receipt, err
+}
+
+func (s *PooledBlockSource) BlockNumber(ctx context.Context) (uint64, error) {
+	var number uint64
+	err := s.do(ctx, func(src *RPCBlockSource) error {
+		var err error
+		number, err = src.BlockNumber(ctx)
+		return err
+	})
+	return number, err
+}
+
+func (s *PooledBlockSource) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, client := range s.clients {
+		client.Close()
+		delete(s.clients, key)
+	}
+}
+
+// do runs call with the endpoint of the next key from the pool, moving on to another key
+// when one is rate limited or rejected, see KeyPool.Do. Retrying is left to the caller.
+func (s *PooledBlockSource) do(ctx context.Context, call func(src *RPCBlockSource) error) error {
+	return s.pool.Do(ctx, func(key string) error {
+		client, err := s.client(key)
+		if err != nil {
+			return err
+		}
+		return call(client)
+	})
+}
+
+func (s *PooledBlockSource) client(key string) (*RPCBlockSource, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client, ok := s.clients[key]
+	if ok {
+		return client, nil
+	}
+	client, err := NewRPCBlockSource(s.urlForKey(key))
+	if err != nil {
+		return nil, err
+	}
+	s.clients[key] = client
+	return client, nil
+}
+
+func InfuraUrl(apiKey string) string {
+	return strings.ReplaceAll(DefaultInfuraUrl, "{key}", apiKey)
+}
+
+func CreateInfuraClient(apiKey string) (*RPCBlockSource, error) {
+	return NewRPCBlockSource(InfuraUrl(apiKey))
+}
+
+// LimitedBlockSource caps the number of requests in flight to one provider, so a
+// large worker pool does not exceed what the provider allows.
+type LimitedBlockSource struct {
+	source BlockSource
+	slots  chan struct{}
+}
+
+func NewLimitedBlockSource(source BlockSource, maxConcurrentRequests int) *LimitedBlockSource {
+	if maxConcurrentRequests < 1 {
+		maxConcurrentRequests = 1
+	}
+	return &LimitedBlockSource{source: source, slots: make(chan struct{}, maxConcurrentRequests)}
+}
+
+func (s *LimitedBlockSource) acquire(ctx context.Context) error {
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *LimitedBlockSource) release() {
+	<-s.slots
+}
+
+func (s *LimitedBlockSource) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	if err := s.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	return s.source.BlockByNumber(ctx, number)
+}
+
+func (s *LimitedBlockSource) BlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error) {
+	if err := s.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	return s.source.BlockByHash(ctx, hash)
+}
+
+func (s *LimitedBlockSource) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if err := s.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	return s.source.HeaderByNumber(ctx, number)
+}
+
+func (s *LimitedBlockSource) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	if err := s.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	return s.source.TransactionReceipt(ctx, txHash)
+}
+
+func (s *LimitedBlockSource) BlockNumber(ctx context.Context) (uint64, error) {
+	if err := s.acquire(ctx); err != nil {
+		return 0, err
+	}
+	defer s.release()
+	return s.source.BlockNumber(ctx)
+}
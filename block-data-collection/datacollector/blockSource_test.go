@@ -0,0 +1,115 @@
+package datacollector
+
+import (
+	"context"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// testChain is a BlockSource of signed blocks and their receipts. Block i is mined at
+// 1000 + 12*i, its transactions alternate between dynamic fee and legacy ones.
+type testChain struct {
+	mu       sync.Mutex
+	blocks   []*types.Block
+	receipts map[common.Hash]*types.Receipt
+	//number of blocks BlockNumber reports, all of them when zero
+	visible int
+}
+
+// newTestChain returns a chain with one block per entry of transactions, holding that many
+// transactions.
+func newTestChain(transactions ...int) *testChain {
+	key, _ := crypto.ToECDSA(common.LeftPadBytes([]byte{1}, 32))
+	chainID := big.NewInt(1)
+	signer := types.LatestSignerForChainID(chainID)
+	to := common.HexToAddress("0x1")
+
+	chain := &testChain{receipts: make(map[common.Hash]*types.Receipt)}
+	nonce := uint64(0)
+	parent := common.Hash{}
+	for number, count := range transactions {
+		var txs []*types.Transaction
+		for j := 0; j < count; j++ {
+			var tx *types.Transaction
+			if j%2 == 0 {
+				tx = types.MustSignNewTx(key, signer, &types.DynamicFeeTx{ChainID: chainID, Nonce: nonce, GasTipCap: big.NewInt(int64(1+j) * 1e9),
+					GasFeeCap: big.NewInt(100e9), Gas: 21000, To: &to, Value: big.NewInt(5)})
+			} else {
+				tx = types.MustSignNewTx(key, signer, &types.LegacyTx{Nonce: nonce, GasPrice: big.NewInt(int64(40+j) * 1e9), Gas: 21000, To: &to})
+			}
+			nonce++
+			txs = append(txs, tx)
+		}
+		header := &types.Header{Number: big.NewInt(int64(number)), Time: uint64(1000 + 12*number), BaseFee: big.NewInt(30e9),
+			ParentHash: parent, GasLimit: 30000000, GasUsed: uint64(21000 * count)}
+		block := types.NewBlockWithHeader(header).WithBody(txs, nil)
+		parent = block.Hash()
+		for _, tx := range txs {
+			tip, _ := tx.EffectiveGasTip(header.BaseFee)
+			chain.receipts[tx.Hash()] = &types.Receipt{Status: 1, GasUsed: 21000, BlockHash: block.Hash(), BlockNumber: header.Number,
+				TxHash: tx.Hash(), EffectiveGasPrice: new(big.Int).Add(tip, header.BaseFee), Type: tx.Type()}
+		}
+		chain.blocks = append(chain.blocks, block)
+	}
+	return chain
+}
+
+// reveal makes the first count blocks visible.
+func (c *testChain) reveal(count int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.visible = count
+}
+
+func (c *testChain) head() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.visible > 0 {
+		return uint64(c.visible - 1)
+	}
+	return uint64(len(c.blocks) - 1)
+}
+
+func (c *testChain) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	if number == nil {
+		number = new(big.Int).SetUint64(c.head())
+	}
+	if !number.IsUint64() || number.Uint64() > c.head() {
+		return nil, ethereum.NotFound
+	}
+	return c.blocks[number.Uint64()], nil
+}
+
+func (c *testChain) BlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error) {
+	for _, block := range c.blocks {
+		if block.Hash() == hash {
+			return block, nil
+		}
+	}
+	return nil, ethereum.NotFound
+}
+
+func (c *testChain) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	block, err := c.BlockByNumber(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	return block.Header(), nil
+}
+
+func (c *testChain) TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	receipt, ok := c.receipts[hash]
+	if !ok {
+		return nil, ethereum.NotFound
+	}
+	return receipt, nil
+}
+
+func (c *testChain) BlockNumber(ctx context.Context) (uint64, error) {
+	return c.head(), nil
+}
@@ -0,0 +1,134 @@
+package datacollector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Checkpoint records how far a collection job got. Every block from StartBlock up to,
+// but not including, NextBlock has been fully written; EndBlock is exclusive.
+type Checkpoint struct {
+	Job        string `json:"job"`
+	StartBlock uint64 `json:"startBlock"`
+	EndBlock   uint64 `json:"endBlock"`
+	NextBlock  uint64 `json:"nextBlock"`
+	//sampler, job seed, see BlockSampleSeed, sample size and price strata of the blocks
+	Sampler     SamplingStrategy `json:"sampler,omitempty"`
+	SampleSeed  int64            `json:"sampleSeed,omitempty"`
+	SampleSize  int              `json:"sampleSize,omitempty"`
+	PriceStrata int              `json:"priceStrata,omitempty"`
+	UpdatedAt   time.Time        `json:"updatedAt"`
+}
+
+func (c *Checkpoint) Completed() bool {
+	return c.NextBlock >= c.EndBlock
+}
+
+// CheckpointStore persists checkpoints between runs. Load returns nil and no error
+// when the job has no checkpoint yet; List returns the checkpoints of every job, ordered
+// by job.
+type CheckpointStore interface {
+	Load(job string) (*Checkpoint, error)
+	Save(checkpoint Checkpoint) error
+	List() ([]Checkpoint, error)
+}
+
+// FileCheckpointStore keeps the checkpoints of all jobs in one small JSON file.
+type FileCheckpointStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileCheckpointStore(path string) *FileCheckpointStore {
+	return &FileCheckpointStore{path: path}
+}
+
+func (s *FileCheckpointStore) Load(job string) (*Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	checkpoints, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	checkpoint, ok := checkpoints[job]
+	if !ok {
+		return nil, nil
+	}
+	return &checkpoint, nil
+}
+
+func (s *FileCheckpointStore) Save(checkpoint Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	checkpoints, err := s.read()
+	if err != nil {
+		return err
+	}
+	checkpoint.UpdatedAt = time.Now().UTC()
+	checkpoints[checkpoint.Job] = checkpoint
+
+	content, err := json.MarshalIndent(checkpoints, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, content)
+}
+
+func (s *FileCheckpointStore) List() ([]Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	checkpoints, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Checkpoint, 0, len(checkpoints))
+	for _, checkpoint := range checkpoints {
+		list = append(list, checkpoint)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Job < list[j].Job })
+	return list, nil
+}
+
+func (s *FileCheckpointStore) read() (map[string]Checkpoint, error) {
+	checkpoints := make(map[string]Checkpoint)
+
+	content, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return checkpoints, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(content) == 0 {
+		return checkpoints, nil
+	}
+
+	err = json.Unmarshal(content, &checkpoints)
+	if err != nil {
+		return nil, err
+	}
+	return checkpoints, nil
+}
+
+// GasJobName identifies a GasDataCollector run over a time range.
+func GasJobName(startTime string, endTime string) string {
+	return "gas_" + startTime + "_" + endTime
+}
+
+// ParseGasJobName returns the time range of a job named by GasJobName.
+func ParseGasJobName(job string) (string, string, error) {
+	parts := strings.Split(job, "_")
+	if len(parts) != 3 || parts[0] != "gas" {
+		return "", "", fmt.Errorf("%q is not a gas collection job", job)
+	}
+	return parts[1], parts[2], nil
+}
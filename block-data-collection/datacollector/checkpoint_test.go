@@ -0,0 +1,154 @@
+package datacollector
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestFileCheckpointStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+	store := NewFileCheckpointStore(path)
+	checkpoint, err := store.Load("gas_a_b")
+	if err != nil || checkpoint != nil {
+		t.Fatalf("got %v and %v without a file, want no checkpoint", checkpoint, err)
+	}
+
+	for _, saved := range []Checkpoint{
+		{Job: "gas_c_d", StartBlock: 20, EndBlock: 30, NextBlock: 20},
+		{Job: "gas_a_b", StartBlock: 0, EndBlock: 10, NextBlock: 4, Sampler: SampleReservoir, SampleSeed: 7},
+		{Job: "gas_c_d", StartBlock: 20, EndBlock: 30, NextBlock: 25},
+	} {
+		if err = store.Save(saved); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//a new store, as in the next run, reads what the last one saved
+	store = NewFileCheckpointStore(path)
+	checkpoint, err = store.Load("gas_a_b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.NextBlock != 4 || checkpoint.Sampler != SampleReservoir || checkpoint.SampleSeed != 7 || checkpoint.UpdatedAt.IsZero() {
+		t.Fatalf("loaded %+v", checkpoint)
+	}
+	list, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Job != "gas_a_b" || list[1].Job != "gas_c_d" || list[1].NextBlock != 25 {
+		t.Fatalf("listed %+v, want both jobs in order with the last save", list)
+	}
+}
+
+func TestFileCheckpointStoreAtomicRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+	store := NewFileCheckpointStore(path)
+	if err := store.Save(Checkpoint{Job: "gas_a_b", EndBlock: 10, NextBlock: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left after the save: %v", err)
+	}
+
+	//a write that fails before the rename leaves the previous file whole
+	if err := os.Mkdir(path+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(Checkpoint{Job: "gas_a_b", EndBlock: 10, NextBlock: 8}); err == nil {
+		t.Fatal("saved without a writable temporary file")
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var checkpoints map[string]Checkpoint
+	if err = json.Unmarshal(content, &checkpoints); err != nil {
+		t.Fatalf("checkpoint file broken by the failed save: %v", err)
+	}
+	if checkpoints["gas_a_b"].NextBlock != 4 {
+		t.Fatalf("checkpoint %+v, want the one saved before", checkpoints["gas_a_b"])
+	}
+}
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	chain := newTestChain(2, 2, 2, 2, 2, 2, 2, 2, 2, 2)
+	dir := t.TempDir()
+	checkpoints := NewFileCheckpointStore(filepath.Join(dir, "checkpoints.json"))
+	options := GasCollectorOptions{Source: chain, Checkpoints: checkpoints, Resume: true, Workers: 2, SampleSize: 1,
+		OutputDir: dir, OutputLayout: OutputPerBlock, OutputFormat: FormatCSV}
+	startTime, endTime := testChainTime(0), testChainTime(8)
+	job := GasJobName(startTime, endTime)
+
+	result, err := GasDataCollector(context.Background(), options, startTime, endTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Resumed || result.BlocksProcessed != 8 {
+		t.Fatalf("first run %+v, want 8 new blocks", result)
+	}
+
+	//as if the run had stopped after block 4
+	checkpoint, err := checkpoints.Load(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint.NextBlock = 5
+	if err = checkpoints.Save(*checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	for number := 5; number < 8; number++ {
+		if err = os.Remove(filepath.Join(dir, strconv.Itoa(number)+".csv")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err = GasDataCollector(context.Background(), options, startTime, endTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Resumed || result.StartBlock != 0 || result.EndBlock != 8 || result.BlocksProcessed != 3 {
+		t.Fatalf("resumed run %+v, want blocks 5 to 7 of the range 0 to 8", result)
+	}
+	for number := 0; number < 8; number++ {
+		if _, err = os.Stat(filepath.Join(dir, strconv.Itoa(number)+".csv")); err != nil {
+			t.Fatalf("block %d not written: %v", number, err)
+		}
+	}
+
+	//a completed job is not collected again
+	result, err = GasDataCollector(context.Background(), options, startTime, endTime)
+	if err != nil || result.BlocksProcessed != 0 {
+		t.Fatalf("run of the completed job %+v, %v", result, err)
+	}
+}
+
+func TestParseGasJobName(t *testing.T) {
+	tests := []struct {
+		job       string
+		wantStart string
+		wantEnd   string
+		wantErr   bool
+	}{
+		{GasJobName("2024-03-01T00:00:00Z", "2024-03-02T00:00:00Z"), "2024-03-01T00:00:00Z", "2024-03-02T00:00:00Z", false},
+		{LiveJob, "", "", true},
+		{"gas_2024-03-01T00:00:00Z", "", "", true},
+		{"aggregates_2024-03-01T00:00:00Z_2024-03-02T00:00:00Z", "", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.job, func(t *testing.T) {
+			startTime, endTime, err := ParseGasJobName(test.job)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if startTime != test.wantStart || endTime != test.wantEnd {
+				t.Fatalf("got %s to %s, want %s to %s", startTime, endTime, test.wantStart, test.wantEnd)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package datacollector
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig is the default configuration with the one setting it lacks.
+func validConfig() Config {
+	config := DefaultConfig()
+	config.Endpoints.RpcUrl = "http://localhost:8545"
+	return config
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := validConfig()
+	if err := config.Validate(); err != nil {
+		t.Fatalf("default config with an rpc url: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   string
+	}{
+		{"no endpoint", func(c *Config) { c.Endpoints.RpcUrl = "" }, "either endpoints.rpc_url or keys.infura is required"},
+		{"infura url without key", func(c *Config) {
+			c.Endpoints.RpcUrl, c.Keys.Infura, c.Endpoints.InfuraUrl = "", []string{"k"}, "https://mainnet.infura.io/v3/"
+		}, "{key} placeholder"},
+		{"unknown sampler", func(c *Config) { c.Sampling.Strategy = "random" }, `sampling.strategy "random"`},
+		{"no sample", func(c *Config) { c.Sampling.SampleSize = 0 }, "sampling.sample_size"},
+		{"no price strata", func(c *Config) { c.Sampling.PriceStrata = 0 }, "sampling.price_strata"},
+		{"unknown layout", func(c *Config) { c.Output.Layout = "month" }, `output.layout "month"`},
+		{"unknown format", func(c *Config) { c.Output.Format = "xml" }, `output.format "xml"`},
+		{"postgres without url", func(c *Config) { c.Output.Format = FormatPostgres }, "postgres.url is required"},
+		{"postgres table name", func(c *Config) {
+			c.Output.Format, c.Postgres.Url, c.Postgres.BlocksTable = FormatPostgres, "postgres://localhost/gas", "gas blocks"
+		}, "postgres.blocks_table"},
+		{"unknown rollup interval", func(c *Config) { c.Rollup.Intervals = []string{"week"} }, "rollup.intervals"},
+		{"daily time", func(c *Config) { c.Schedule.DailyAt = "25:00" }, "schedule.daily_at"},
+		{"ws key without keys", func(c *Config) { c.Endpoints.WsUrl = "wss://mainnet.infura.io/ws/v3/{key}" }, "endpoints.ws_url"},
+		{"mempool interval", func(c *Config) { c.Mempool.Interval = time.Millisecond }, "mempool.interval"},
+		{"retry delays", func(c *Config) { c.Retry.MaxDelay = c.Retry.BaseDelay - 1 }, "retry delays"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := validConfig()
+			test.change(&config)
+			err := config.Validate()
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("got %v, want an error about %s", err, test.want)
+			}
+		})
+	}
+
+	//every problem is reported at once
+	config = validConfig()
+	config.Concurrency.Workers, config.Retry.MaxAttempts = 0, 0
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "concurrency.workers") || !strings.Contains(err.Error(), "retry.max_attempts") {
+		t.Fatalf("got %v, want both problems", err)
+	}
+}
+
+func TestConfigSampler(t *testing.T) {
+	for _, strategy := range []SamplingStrategy{SampleUniform, SampleReservoir, SampleStratifiedType, SampleStratifiedPrice, SampleAll} {
+		t.Run(string(strategy), func(t *testing.T) {
+			config := validConfig()
+			config.Sampling.Strategy, config.Sampling.PriceStrata = strategy, 3
+			sampler, err := config.Sampler()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sampler.Name() != strategy {
+				t.Fatalf("got the %s sampler", sampler.Name())
+			}
+			if strategy == SampleStratifiedPrice && priceStrata(sampler) != 3 {
+				t.Fatalf("%d price strata, want the configured 3", priceStrata(sampler))
+			}
+		})
+	}
+
+	//an unknown strategy is an error, not a uniform sample
+	config := validConfig()
+	config.Sampling.Strategy = "random"
+	if sampler, err := config.Sampler(); err == nil {
+		t.Fatalf("got the %s sampler for an unknown strategy", sampler.Name())
+	}
+}
@@ -0,0 +1,268 @@
+package datacollector
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// BlockRange is a range of block numbers, To is exclusive.
+type BlockRange struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// GapReport lists the blocks of a range whose output is missing or has no data rows.
+type GapReport struct {
+	Range   BlockRange
+	Missing []uint64
+	Empty   []uint64
+}
+
+// Blocks returns the missing and empty blocks in block order.
+func (r *GapReport) Blocks() []uint64 {
+	blocks := append(append([]uint64{}, r.Missing...), r.Empty...)
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	return blocks
+}
+
+// ScanGaps checks the output of every block in blockRange in dir and reports the blocks
+// without a file and the ones without records, in any output format. Blocks of day and block
+// range files are looked up in the manifests of the files, which also list the blocks without
+// records; in files written without a manifest such blocks are reported as missing.
+func ScanGaps(dir string, blockRange BlockRange) (*GapReport, error) {
+	consolidated, err := consolidatedBlocks(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &GapReport{Range: blockRange}
+	for number := blockRange.From; number < blockRange.To; number++ {
+		if records, ok := consolidated[number]; ok {
+			if records == 0 {
+				report.Empty = append(report.Empty, number)
+			}
+			continue
+		}
+
+		found, hasRecords := false, false
+		for _, format := range OutputFormats {
+			path := filepath.Join(dir, strconv.FormatUint(number, 10)+format.Extension())
+			has, err := hasGasRecords(path, format)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("reading %s: %w", path, err)
+			}
+			found, hasRecords = true, hasRecords || has
+		}
+		if !found {
+			report.Missing = append(report.Missing, number)
+			continue
+		}
+		if !hasRecords {
+			report.Empty = append(report.Empty, number)
+		}
+	}
+	return report, nil
+}
+
+// hasGasRecords reports whether a block file has at least one record.
+func hasGasRecords(path string, format OutputFormat) (bool, error) {
+	if format == FormatCSV {
+		return hasDataRows(path)
+	}
+	records, err := readGasRecords(path)
+	return len(records) > 0, err
+}
+
+// hasDataRows reports whether the csv file has a row after its header.
+func hasDataRows(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	for line := 0; line < 2; line++ {
+		_, err = reader.Read()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// blockRuns groups sorted block numbers into ranges of consecutive blocks.
+func blockRuns(blocks []uint64) []BlockRange {
+	var runs []BlockRange
+	for _, number := range blocks {
+		if len(runs) > 0 && runs[len(runs)-1].To == number {
+			runs[len(runs)-1].To++
+			continue
+		}
+		runs = append(runs, BlockRange{From: number, To: number + 1})
+	}
+	return runs
+}
+
+// RecollectQueue keeps the blocks waiting to be collected again in a small JSON file, so
+// gaps found by one run are still filled after a restart. Blocks that were recollected and
+// still had nothing to sample (empty blocks, only contract creations) are remembered and
+// not queued again.
+type RecollectQueue struct {
+	path string
+	mu   sync.Mutex
+}
+
+type recollectState struct {
+	Pending        []uint64 `json:"pending"`
+	ConfirmedEmpty []uint64 `json:"confirmedEmpty"`
+}
+
+func NewRecollectQueue(path string) *RecollectQueue {
+	return &RecollectQueue{path: path}
+}
+
+// Enqueue adds the blocks that are not queued or known to be empty yet, and returns how
+// many were added.
+func (q *RecollectQueue) Enqueue(blocks []uint64) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	state, err := q.read()
+	if err != nil {
+		return 0, err
+	}
+
+	known := make(map[uint64]bool)
+	for _, number := range state.Pending {
+		known[number] = true
+	}
+	for _, number := range state.ConfirmedEmpty {
+		known[number] = true
+	}
+
+	added := 0
+	for _, number := range blocks {
+		if !known[number] {
+			known[number] = true
+			state.Pending = append(state.Pending, number)
+			added++
+		}
+	}
+	if added == 0 {
+		return 0, nil
+	}
+	return added, q.write(state)
+}
+
+// Pending returns the queued blocks in block order.
+func (q *RecollectQueue) Pending() ([]uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	state, err := q.read()
+	if err != nil {
+		return nil, err
+	}
+	return state.Pending, nil
+}
+
+// Complete removes recollected blocks from the queue. The ones listed in empty are
+// remembered so later scans do not queue them again.
+func (q *RecollectQueue) Complete(done []uint64, empty []uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	state, err := q.read()
+	if err != nil {
+		return err
+	}
+
+	finished := make(map[uint64]bool)
+	for _, number := range done {
+		finished[number] = true
+	}
+	pending := state.Pending[:0]
+	for _, number := range state.Pending {
+		if !finished[number] {
+			pending = append(pending, number)
+		}
+	}
+	state.Pending = pending
+	state.ConfirmedEmpty = append(state.ConfirmedEmpty, empty...)
+	return q.write(state)
+}
+
+func (q *RecollectQueue) read() (*recollectState, error) {
+	state := &recollectState{}
+
+	content, err := ioutil.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(content) == 0 {
+		return state, nil
+	}
+
+	err = json.Unmarshal(content, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (q *RecollectQueue) write(state *recollectState) error {
+	sort.Slice(state.Pending, func(i, j int) bool { return state.Pending[i] < state.Pending[j] })
+	sort.Slice(state.ConfirmedEmpty, func(i, j int) bool { return state.ConfirmedEmpty[i] < state.ConfirmedEmpty[j] })
+
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(q.path, content)
+}
+
+// RecollectPending collects the queued blocks again and removes them from the queue once
+// their files are written. The blocks written before an error are still removed.
+func (q *RecollectQueue) RecollectPending(ctx context.Context, options GasCollectorOptions) (*GasCollectionResult, error) {
+	blocks, err := q.Pending()
+	if err != nil {
+		return &GasCollectionResult{Job: "recollect"}, err
+	}
+
+	var done, empty []uint64
+	written := func(number uint64, rows int) {
+		done = append(done, number)
+		if rows == 0 {
+			empty = append(empty, number)
+		}
+	}
+
+	result, errWhenRecollecting := recollectGasBlocks(ctx, options, blocks, written)
+	if len(done) > 0 {
+		errWhenCompleting := q.Complete(done, empty)
+		if errWhenRecollecting == nil {
+			errWhenRecollecting = errWhenCompleting
+		}
+	}
+	return result, errWhenRecollecting
+}
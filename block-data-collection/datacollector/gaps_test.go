@@ -0,0 +1,149 @@
+package datacollector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testChainTime is the RFC3339 time block number of a testChain is mined at.
+func testChainTime(number int) string {
+	return time.Unix(int64(1000+12*number), 0).UTC().Format(time.RFC3339)
+}
+
+func TestScanGaps(t *testing.T) {
+	//blocks 3 and 4 have nothing to sample, blocks 0 to 7 are collected
+	chain := newTestChain(2, 2, 2, 0, 0, 2, 2, 2, 2, 2, 2)
+	for _, layout := range []OutputLayout{OutputPerBlock, OutputPerDay, OutputPerBlocks} {
+		for _, format := range OutputFormats {
+			t.Run(string(layout)+" "+string(format), func(t *testing.T) {
+				dir := t.TempDir()
+				options := GasCollectorOptions{Source: chain, Workers: 2, SampleSize: 1, OutputDir: dir, OutputLayout: layout,
+					BlocksPerFile: 4, OutputFormat: format}
+				_, err := GasDataCollector(context.Background(), options, testChainTime(0), testChainTime(8))
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := []uint64{8, 9}
+				if layout == OutputPerBlock {
+					if err = os.Remove(filepath.Join(dir, strconv.Itoa(6)+format.Extension())); err != nil {
+						t.Fatal(err)
+					}
+					want = []uint64{6, 8, 9}
+				}
+
+				report, err := ScanGaps(dir, BlockRange{From: 0, To: 10})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !equalBlocks(report.Missing, want) || !equalBlocks(report.Empty, []uint64{3, 4}) {
+					t.Fatalf("missing %v and empty %v, want missing %v and empty [3 4]", report.Missing, report.Empty, want)
+				}
+				if blocks := report.Blocks(); !equalBlocks(blocks, append([]uint64{3, 4}, want...)) {
+					t.Fatalf("blocks %v are not in order", blocks)
+				}
+			})
+		}
+	}
+}
+
+func TestRecollectQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recollect.json")
+	queue := NewRecollectQueue(path)
+
+	type step struct {
+		enqueue   []uint64
+		wantAdded int
+		//recollected blocks and the ones of them still empty
+		done, empty []uint64
+		wantPending []uint64
+	}
+	steps := []step{
+		{enqueue: []uint64{7, 3, 5}, wantAdded: 3, wantPending: []uint64{3, 5, 7}},
+		{enqueue: []uint64{5, 8, 8}, wantAdded: 1, wantPending: []uint64{3, 5, 7, 8}},
+		{done: []uint64{3, 7}, empty: []uint64{3}, wantPending: []uint64{5, 8}},
+		//a confirmed empty block is not queued again, a recollected one with samples is
+		{enqueue: []uint64{3, 7}, wantAdded: 1, wantPending: []uint64{5, 7, 8}},
+		{enqueue: nil, wantAdded: 0, wantPending: []uint64{5, 7, 8}},
+	}
+	for i, s := range steps {
+		if s.done != nil {
+			if err := queue.Complete(s.done, s.empty); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			added, err := queue.Enqueue(s.enqueue)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if added != s.wantAdded {
+				t.Fatalf("step %d: added %d blocks, want %d", i, added, s.wantAdded)
+			}
+		}
+
+		//a new queue on the same file sees the same blocks, as after a restart
+		pending, err := NewRecollectQueue(path).Pending()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalBlocks(pending, s.wantPending) {
+			t.Fatalf("step %d: pending %v, want %v", i, pending, s.wantPending)
+		}
+	}
+}
+
+func TestRecollectPending(t *testing.T) {
+	chain := newTestChain(2, 2, 2, 0, 0, 2, 2, 2, 2, 2, 2)
+	dir := t.TempDir()
+	options := GasCollectorOptions{Source: chain, Workers: 2, SampleSize: 1, OutputDir: dir, OutputLayout: OutputPerBlock, OutputFormat: FormatCSV}
+	_, err := GasDataCollector(context.Background(), options, testChainTime(0), testChainTime(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(dir, "6.csv")); err != nil {
+		t.Fatal(err)
+	}
+
+	queue := NewRecollectQueue(filepath.Join(dir, "recollect.json"))
+	report, err := ScanGaps(dir, BlockRange{From: 0, To: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = queue.Enqueue(report.Blocks()); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := queue.RecollectPending(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.BlocksProcessed != 3 {
+		t.Fatalf("recollected %d blocks, want 3", result.BlocksProcessed)
+	}
+	pending, err := queue.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("blocks %v are still queued", pending)
+	}
+
+	//the missing block is back, the empty ones are known and not queued again
+	report, err = ScanGaps(dir, BlockRange{From: 0, To: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Missing) != 0 || !equalBlocks(report.Empty, []uint64{3, 4}) {
+		t.Fatalf("missing %v and empty %v after recollection", report.Missing, report.Empty)
+	}
+	added, err := queue.Enqueue(report.Blocks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 0 {
+		t.Fatalf("queued %d confirmed empty blocks again", added)
+	}
+}
@@ -1,371 +1,691 @@
 package datacollector
 
 import (
-	"bufio"
 	"context"
-	"encoding/csv"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"math/big"
 	"math/rand"
-	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 
-	"strings"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/joho/godotenv"
 )
 
-func loadEnv() {
+func LoadEnv() {
 	if err := godotenv.Load(".env"); err != nil {
 		fmt.Println("Error loading .env file:", err)
 	}
 }
 
-const numTransactions = 15
+// headerCacheSize is the number of headers kept while resolving timestamps to blocks
+const headerCacheSize = 256
+
+// GasCollectorOptions configures a GasDataCollector run.
+type GasCollectorOptions struct {
+	Source BlockSource
+
+	//optional, when set the last written block is checkpointed after every block
+	Checkpoints CheckpointStore
+	//continue from the checkpoint of the same time range instead of starting over
+	Resume bool
+
+	//number of blocks fetched in parallel, output is still written in block order
+	Workers int
+	//optional, keys for the Etherscan fallback; without them the fallback is disabled
+	EtherscanKeys *KeyPool
+	//maximum number of Etherscan fallback requests in flight
+	MaxEtherscanRequests int
+
+	//optional, Etherscan API endpoint, DefaultEtherscanApiUrl when empty
+	EtherscanApiUrl string
+
+	//backoff applied to failed node and Etherscan calls, DefaultRetryPolicy when zero
+	Retry RetryPolicy
+	//confirmations a block needs before it is collected, the head block having one; blocks
+	//closer to the head are waited for. Zero collects up to the head.
+	Confirmations uint64
+
+	//transactions sampled per block, defaultSampleSize when zero
+	SampleSize int
+	//picks the sampled transactions, UniformSampler when nil
+	Sampler Sampler
+	//job seed the seed of every block sample is derived from, see BlockSampleSeed; a random
+	//one when zero. A resumed job keeps the seed in its checkpoint.
+	SampleSeed int64
+	//folder the block files are written to, the working directory when empty
+	OutputDir string
+	//one file per block (default), per day or per BlocksPerFile blocks
+	OutputLayout  OutputLayout
+	BlocksPerFile int
+	//csv when empty
+	OutputFormat OutputFormat
+	//optional, blocks are written to the store instead of output files
+	Store GasStore
+	//optional, every run is recorded here
+	Runs JobRunRecorder
+
+	//transactions the per-block aggregates are computed over, the samples when empty
+	AggregateScope AggregateScope
+	//write the per-block aggregates to files in AggregatesDir too; ignored with a Store,
+	//which always keeps them
+	Aggregates    bool
+	AggregatesDir string
+}
 
-func GasDataCollector(startTime string, endTime string, done chan bool) {
-	// Lead environment variables from .env file
-	loadEnv()
+// GasCollectionResult summarises a GasDataCollector run. It is also returned, filled in up
+// to the failing block, when the run stops with an error.
+type GasCollectionResult struct {
+	Job        string
+	StartBlock uint64
+	//exclusive
+	EndBlock uint64
+	//the run continued from an existing checkpoint
+	Resumed bool
+	//how the blocks were sampled, rerunning with them gives the same samples; empty when
+	//the recollected blocks belong to jobs sampled differently
+	Sampler    SamplingStrategy
+	SampleSeed int64
+
+	BlocksProcessed     uint64
+	TransactionsSampled uint64
+	//sampled transactions left out: failed, without a receipt or not extractable
+	TransactionsSkipped uint64
+	//errors that only cost a sample, the error stopping the run is returned separately
+	Errors    uint64
+	LastError error
+
+	Duration time.Duration
+}
 
-	// Read the INFURA_API_KEYS and ETHERSCAN_KEYS from environment variables
-	infkeys := os.Getenv("INFURA_API_KEYS")
-	ethkeys := os.Getenv("ETHERSCAN_KEYS")
+// GasDataCollector samples the gas prices of every block between the two times. When ctx is
+// cancelled it stops after the block being written, leaving its file and checkpoint complete.
+func GasDataCollector(ctx context.Context, options GasCollectorOptions, startTime string, endTime string) (*GasCollectionResult, error) {
+	result := &GasCollectionResult{Job: GasJobName(startTime, endTime)}
+	began := time.Now()
+	errWhenCollecting := recordRun(&options, result, func() error {
+		err := collectGasData(ctx, options, startTime, endTime, result)
+		result.Duration = time.Since(began)
+		return err
+	})
+	return result, errWhenCollecting
+}
 
-	// Split the comma-separated keys into slices
-	infuraApiKeys := strings.Split(infkeys, ",")
-	etherscanKeys := strings.Split(ethkeys, ",")
+func collectGasData(ctx context.Context, options GasCollectorOptions, startTime string, endTime string, result *GasCollectionResult) error {
+	//every node call is retried with backoff, only terminal errors reach the collector
+	source := NewRetryingBlockSource(options.Source, options.Retry)
 
 	timeToStart, errWhenParsingStartTime := time.Parse(time.RFC3339, startTime)
 	if errWhenParsingStartTime != nil {
-		fmt.Println("An error occurred when parsing start time : ", errWhenParsingStartTime)
-		return
+		return fmt.Errorf("invalid start time: %w", errWhenParsingStartTime)
 	}
 
 	end, errWhenParsingTimeEnd := time.Parse(time.RFC3339, endTime)
 	if errWhenParsingTimeEnd != nil {
-		fmt.Println("An error occurred when parsing time : ", errWhenParsingTimeEnd)
-		return
+		return fmt.Errorf("invalid end time: %w", errWhenParsingTimeEnd)
 	}
-
-	apiKeyIndex := 0
-	etherscanApiKeyIndex := 0
-	var infuraClient *ethclient.Client
-	var errWhenGetingInfuraClient error
-
-	infuraClient, errWhenGetingInfuraClient = CreateInfuraClient(infuraApiKeys[apiKeyIndex])
-	if errWhenGetingInfuraClient != nil {
-		fmt.Println("Error when calling Infura client: ", errWhenGetingInfuraClient)
-		return
+	if !end.After(timeToStart) {
+		return fmt.Errorf("end time %s is not after start time %s", endTime, startTime)
 	}
 
-	timeObj := timeToStart.Unix()
-	toTime := end.Unix()
+	//etherscan is only used when a transaction cannot be read from the block
+	extractor := NewTransactionExtractor(options.EtherscanKeys, options.EtherscanApiUrl, options.MaxEtherscanRequests, options.Retry)
 
-	var blockUrl string
+	job := result.Job
 
-	//get the starting block
-	blockUrl = CreateBlockUrl(etherscanKeys[etherscanApiKeyIndex], timeObj)
-
-	var blockNoRes *http.Response
-	var errWhenGettingBlockNumber error
-
-	for {
-		blockNoRes, errWhenGettingBlockNumber = http.Get(blockUrl)
-		if errWhenGettingBlockNumber != nil {
-			//rotate etherscan API key
-			etherscanApiKeyIndex = (etherscanApiKeyIndex + 1) % len(etherscanKeys)
-			blockUrl = CreateBlockUrl(etherscanKeys[etherscanApiKeyIndex], timeObj)
-			blockNoRes, errWhenGettingBlockNumber = http.Get(blockUrl)
-			if errWhenGettingBlockNumber != nil {
-				fmt.Println("Error when calling the etherscan API to get initial block :" + errWhenGettingBlockNumber.Error())
-				fmt.Println("Loop sleeping for 28 hours")
-				time.Sleep(28 * time.Hour)
-			}
-		} else {
-			break
+	var checkpoint *Checkpoint
+	if options.Resume && options.Checkpoints != nil {
+		var errWhenLoadingCheckpoint error
+		checkpoint, errWhenLoadingCheckpoint = options.Checkpoints.Load(job)
+		if errWhenLoadingCheckpoint != nil {
+			return fmt.Errorf("loading checkpoint: %w", errWhenLoadingCheckpoint)
 		}
 	}
 
-	defer blockNoRes.Body.Close()
-	body, errWhenReadingTheBlockNo := ioutil.ReadAll(blockNoRes.Body)
-	if errWhenReadingTheBlockNo != nil {
-		fmt.Println("Error when reading the block number from response : ", errWhenReadingTheBlockNo)
-		return
-	}
-
-	var blockNoJsonResponse BlockNumberResponse
-	errWhenUnMarshallingBlock := json.Unmarshal(body, &blockNoJsonResponse)
-	if errWhenUnMarshallingBlock != nil {
-		fmt.Println("Error when un marshalling : ", errWhenUnMarshallingBlock)
-		return
-	}
-
-	var startBlock big.Int
-	_, suc := startBlock.SetString(blockNoJsonResponse.Result, 10)
-	if !suc {
-		fmt.Println("Convert failed 0")
-		return
-	}
-
-	//get the ending block;
-	blockUrl = CreateBlockUrl(etherscanKeys[etherscanApiKeyIndex], toTime)
-	for {
-		blockNoRes, errWhenGettingBlockNumber = http.Get(blockUrl)
-		if errWhenGettingBlockNumber != nil {
-			//rotate etherscan API key
-			etherscanApiKeyIndex = (etherscanApiKeyIndex + 1) % len(etherscanKeys)
-			blockUrl = CreateBlockUrl(etherscanKeys[etherscanApiKeyIndex], timeObj)
-			blockNoRes, errWhenGettingBlockNumber = http.Get(blockUrl)
-			if errWhenGettingBlockNumber != nil {
-				fmt.Println("Error when calling the etherscan API to get last block :" + errWhenGettingBlockNumber.Error())
-				fmt.Println("Loop sleeping for 28 hours")
-				time.Sleep(28 * time.Hour)
+	if checkpoint != nil {
+		fmt.Println("Resuming ", job, " from block ", checkpoint.NextBlock)
+		result.Resumed = true
+	} else {
+		startBlock, endBlock, errWhenResolvingRange := resolveBlockRange(ctx, source, timeToStart.Unix(), end.Unix())
+		if errWhenResolvingRange != nil {
+			return errWhenResolvingRange
+		}
+		//the last block of the range is only known once a later block is confirmed
+		errWhenCheckingEnd := checkRangeEnded(ctx, source, endBlock, options.Confirmations)
+		if errWhenCheckingEnd != nil {
+			return errWhenCheckingEnd
+		}
+		checkpoint = &Checkpoint{Job: job, StartBlock: startBlock, EndBlock: endBlock, NextBlock: startBlock}
+		errWhenSettingSampling := setCheckpointSampling(checkpoint, &options)
+		if errWhenSettingSampling != nil {
+			return errWhenSettingSampling
+		}
+
+		//record the resolved range right away, so a job without blocks is known to be done
+		if options.Checkpoints != nil {
+			errWhenSavingCheckpoint := options.Checkpoints.Save(*checkpoint)
+			if errWhenSavingCheckpoint != nil {
+				fmt.Println("Error when saving the checkpoint : ", errWhenSavingCheckpoint)
 			}
-		} else {
-			break
 		}
 	}
+	result.StartBlock = checkpoint.StartBlock
+	result.EndBlock = checkpoint.EndBlock
 
-	defer blockNoRes.Body.Close()
-	body, errWhenReadingTheBlockNo = ioutil.ReadAll(blockNoRes.Body)
-	if errWhenReadingTheBlockNo != nil {
-		fmt.Println("Error when reading the block number from response : ", errWhenReadingTheBlockNo)
-		return
+	if checkpoint.Completed() {
+		fmt.Println("Job ", job, " has already been completed")
+		return nil
 	}
 
-	errWhenUnMarshallingBlock = json.Unmarshal(body, &blockNoJsonResponse)
-	if errWhenUnMarshallingBlock != nil {
-		fmt.Println("Error when un marshalling : ", errWhenUnMarshallingBlock)
-		return
+	if result.Resumed {
+		errWhenSettingSampling := setCheckpointSampling(checkpoint, &options)
+		if errWhenSettingSampling != nil {
+			return errWhenSettingSampling
+		}
+	}
+	sampling := options.sampling(checkpoint.SampleSeed)
+	result.Sampler, result.SampleSeed = sampling.sampler.Name(), sampling.seed
+	errWhenCreatingDir := options.createOutputDir()
+	if errWhenCreatingDir != nil {
+		return errWhenCreatingDir
 	}
 
-	var endBlock big.Int
-	_, sucE := endBlock.SetString(blockNoJsonResponse.Result, 10)
-	if !sucE {
-		fmt.Println("Convert failed 1")
-		return
+	//rows an interrupted run wrote past its checkpoint are replaced
+	firstBlock, endBlock := checkpoint.NextBlock, checkpoint.EndBlock
+	output := newGasOutput(&options, func(number uint64) bool {
+		return number >= firstBlock && number < endBlock
+	})
+
+	confirmations := newConfirmationGate(source, options.Confirmations)
+	fetchBlock := func(currentBlock uint64) *blockGasData {
+		errWhenWaiting := confirmations.wait(ctx, currentBlock)
+		if errWhenWaiting != nil {
+			return &blockGasData{number: currentBlock, err: errWhenWaiting}
+		}
+		return fetchBlockGasData(ctx, source, extractor, currentBlock, sampling, options.AggregateScope)
 	}
 
-	//convert end block and start block into int
-	startingBlock := startBlock.Int64()
-	endingBlock := endBlock.Int64()
+	writeBlock := checkpointedWriter(ctx, &options, output, checkpoint, result)
 
-	for i := startingBlock; i < endingBlock; i++ {
-		currentBlock := i
+	//blocks and receipts are fetched by the worker pool, files are written in block order
+	errWhenCollecting := fetchInOrder(ctx, checkpoint.NextBlock, checkpoint.EndBlock, options.Workers, fetchBlock, writeBlock)
+	if errWhenCollecting != nil {
+		flushGasOutput(output)
+		return errWhenCollecting
+	}
+	return output.Close()
+}
 
-		var block *types.Block
-		var errWhenLoadingBlock error
+// checkpointedWriter returns the write function of fetchInOrder for a job: it writes every
+// block to output, counts it in result and moves the checkpoint past it.
+func checkpointedWriter(ctx context.Context, options *GasCollectorOptions, output gasOutput, checkpoint *Checkpoint, result *GasCollectionResult) func(currentBlock uint64, data *blockGasData) error {
+	return func(currentBlock uint64, data *blockGasData) error {
+		//a block that could not be fetched after all retries stops the run, resume continues from it
+		if data.err != nil {
+			return fmt.Errorf("block %d: %w", currentBlock, data.err)
+		}
+		//once cancelled, blocks fetched ahead are dropped so shutdown is not delayed
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 
-		var bigIntCurrentBlock big.Int
-		bigIntCurrentBlock.SetInt64(currentBlock)
-		//a do while approach where if an error occurs the loop will sleep for 25hours
-		for {
-			block, errWhenLoadingBlock = infuraClient.BlockByNumber(context.Background(), &bigIntCurrentBlock)
-			if errWhenLoadingBlock != nil {
-				//rotate API key
-				apiKeyIndex = (apiKeyIndex + 1) % len(infuraApiKeys)
-				infuraClient, errWhenGetingInfuraClient = CreateInfuraClient(infuraApiKeys[apiKeyIndex])
-				if errWhenGetingInfuraClient != nil {
-					fmt.Println("Error when calling Infura client: ", errWhenGetingInfuraClient)
-					fmt.Println("Loop sleeping for 28 hours......")
-					time.Sleep(28 * time.Hour)
-				}
-			} else {
-				break
-			}
+		errWhenWritingBlock := output.WriteBlock(data)
+		if errWhenWritingBlock != nil {
+			return fmt.Errorf("writing block %d: %w", currentBlock, errWhenWritingBlock)
 		}
 
-		//CSV file initialization
-		fileName := strconv.FormatInt(currentBlock, 10)
-		file, errWhenCreatingCSV := os.Create(fileName + ".csv")
-		if errWhenCreatingCSV != nil {
-			fmt.Println("Error when creating the CSV file : ", errWhenCreatingCSV)
-			continue
+		result.add(data)
+
+		checkpoint.NextBlock = currentBlock + 1
+		if options.Checkpoints != nil {
+			errWhenSavingCheckpoint := options.Checkpoints.Save(*checkpoint)
+			if errWhenSavingCheckpoint != nil {
+				fmt.Println("Error when saving the checkpoint : ", errWhenSavingCheckpoint)
+			}
 		}
-		defer file.Close()
-
-		//write headers into CSV file
-		headers := []string{"Timestamp", "Gas Price(Gwei)"}
-		writer := csv.NewWriter(bufio.NewWriter(file))
-		errWhenWritingHeadersToCsv := writer.Write(headers)
-		if errWhenWritingHeadersToCsv != nil {
-			fmt.Println("Error when writing to the headers CSV file : ", errWhenWritingHeadersToCsv)
-			continue
+		return nil
+	}
+}
+
+// RecollectGasBlocks collects the given blocks again and overwrites their files, for
+// example the gaps found by ScanGaps. Every block is sampled with the sampler and seed of the
+// job that collected it, see jobSamplings. Checkpoints are left untouched. The blocks written
+// before an error are counted in the result.
+func RecollectGasBlocks(ctx context.Context, options GasCollectorOptions, blocks []uint64) (*GasCollectionResult, error) {
+	return recollectGasBlocks(ctx, options, blocks, nil)
+}
+
+// recollectGasBlocks calls written, when set, with the number of rows of every block written.
+func recollectGasBlocks(ctx context.Context, options GasCollectorOptions, blocks []uint64, written func(number uint64, rows int)) (*GasCollectionResult, error) {
+	result := &GasCollectionResult{Job: "recollect"}
+	began := time.Now()
+	errWhenRecollecting := recordRun(&options, result, func() error {
+		err := recollectBlocks(ctx, options, blocks, written, result)
+		result.Duration = time.Since(began)
+		return err
+	})
+	return result, errWhenRecollecting
+}
+
+func recollectBlocks(ctx context.Context, options GasCollectorOptions, blocks []uint64, written func(number uint64, rows int), result *GasCollectionResult) error {
+
+	source := NewRetryingBlockSource(options.Source, options.Retry)
+	extractor := NewTransactionExtractor(options.EtherscanKeys, options.EtherscanApiUrl, options.MaxEtherscanRequests, options.Retry)
+	samplings, errWhenLoadingSamplings := jobSamplings(&options, blocks)
+	if errWhenLoadingSamplings != nil {
+		return errWhenLoadingSamplings
+	}
+	for i, number := range blocks {
+		sampling := samplings[number]
+		if i == 0 {
+			result.Sampler, result.SampleSeed = sampling.sampler.Name(), sampling.seed
+		} else if sampling.sampler.Name() != result.Sampler || sampling.seed != result.SampleSeed {
+			result.Sampler, result.SampleSeed = "", 0
+			break
 		}
-		headers = nil
-		writer.Flush()
+	}
+	errWhenCreatingDir := options.createOutputDir()
+	if errWhenCreatingDir != nil {
+		return errWhenCreatingDir
+	}
 
-		//get the number of transactions in a block
-		numTxns := len(block.Transactions())
+	recollected := make(map[uint64]bool)
+	for _, number := range blocks {
+		recollected[number] = true
+	}
+	output := newGasOutput(&options, func(number uint64) bool {
+		return recollected[number]
+	})
+
+	confirmations := newConfirmationGate(source, options.Confirmations)
+	fetchBlock := func(currentBlock uint64) *blockGasData {
+		errWhenWaiting := confirmations.wait(ctx, currentBlock)
+		if errWhenWaiting != nil {
+			return &blockGasData{number: currentBlock, err: errWhenWaiting}
+		}
+		return fetchBlockGasData(ctx, source, extractor, currentBlock, samplings[currentBlock], options.AggregateScope)
+	}
+	writeBlock := func(currentBlock uint64, data *blockGasData) error {
+		if data.err != nil {
+			return fmt.Errorf("block %d: %w", currentBlock, data.err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		errWhenWritingBlock := output.WriteBlock(data)
+		if errWhenWritingBlock != nil {
+			return fmt.Errorf("writing block %d: %w", currentBlock, errWhenWritingBlock)
+		}
+		result.add(data)
+		if written != nil {
+			written(currentBlock, len(data.records))
+		}
+		return nil
+	}
 
-		randomIndicies := GenerateRandomIndices(numTxns, numTransactions)
+	//runs of consecutive blocks share the worker pool
+	for _, blockRange := range blockRuns(blocks) {
+		errWhenCollecting := fetchInOrder(ctx, blockRange.From, blockRange.To, options.Workers, fetchBlock, writeBlock)
+		if errWhenCollecting != nil {
+			flushGasOutput(output)
+			return errWhenCollecting
+		}
+	}
+	return output.Close()
+}
 
-		selectedTxs := make([]*types.Transaction, 0)
-		selectedCount := 0
+// jobSamplings returns the sampling of the job each block was collected by, read from the
+// checkpoint whose range holds the block with its sample size and price strata, so a
+// recollected block gets the sample it was first written with. Blocks without such a
+// checkpoint are sampled with the configured sampler and seed, one random seed for all of
+// them when it is zero.
+func jobSamplings(options *GasCollectorOptions, blocks []uint64) (map[uint64]*blockSampling, error) {
+	var checkpoints []Checkpoint
+	if options.Checkpoints != nil {
+		var errWhenListing error
+		checkpoints, errWhenListing = options.Checkpoints.List()
+		if errWhenListing != nil {
+			return nil, fmt.Errorf("loading checkpoints: %w", errWhenListing)
+		}
+	}
 
-		for _, idx := range randomIndicies {
-			tx := block.Transactions()[idx]
-			if tx.To() != nil {
-				selectedTxs = append(selectedTxs, tx)
-				selectedCount++
-				if selectedCount == numTransactions {
-					break
-				}
+	samplings := make(map[uint64]*blockSampling)
+	byJob := make(map[string]*blockSampling)
+	var fallback *blockSampling
+	for _, number := range blocks {
+		checkpoint := coveringCheckpoint(checkpoints, number)
+		if checkpoint == nil {
+			if fallback == nil {
+				fallback = options.sampling(options.SampleSeed)
 			}
+			fmt.Println("Block ", number, " is not in the range of any job, sampling it with seed ", fallback.seed)
+			samplings[number] = fallback
+			continue
 		}
 
-		//query block transactions
-		for _, tx := range selectedTxs {
-			stringTxnHash := tx.Hash().String()
-			var txnReceipt *types.Receipt
-			var errWhenGettingTxnReceipt error
-			//handle API key issue
-			for {
-				// get the transaction receipt
-				txnReceipt, errWhenGettingTxnReceipt = infuraClient.TransactionReceipt(context.Background(), tx.Hash())
-				if errWhenGettingTxnReceipt != nil {
-					//rotate API key
-					apiKeyIndex = (apiKeyIndex + 1) % len(infuraApiKeys)
-					infuraClient, errWhenGetingInfuraClient = CreateInfuraClient(infuraApiKeys[apiKeyIndex])
-					if errWhenGetingInfuraClient != nil {
-						fmt.Println("Error when calling Infura client: ", errWhenGetingInfuraClient)
-						fmt.Println("Loop sleeping for 28 hours......")
-						time.Sleep(28 * time.Hour)
-					}
-				} else {
-					break
+		sampling, ok := byJob[checkpoint.Job]
+		if !ok {
+			sampling = options.sampling(checkpoint.SampleSeed)
+			if checkpoint.Sampler != "" {
+				strata := checkpoint.PriceStrata
+				if checkpoint.SampleSize == 0 {
+					//checkpoints written before the price strata were recorded
+					strata = priceStrata(sampling.sampler)
 				}
-			}
-
-			var block *types.Block
-			var err error
-
-			for {
-				// get the timestamp from the block header
-				block, err = infuraClient.BlockByHash(context.Background(), txnReceipt.BlockHash)
-				if err != nil {
-					//rotate API key
-					apiKeyIndex = (apiKeyIndex + 1) % len(infuraApiKeys)
-					infuraClient, errWhenGetingInfuraClient = CreateInfuraClient(infuraApiKeys[apiKeyIndex])
-					if errWhenGetingInfuraClient != nil {
-						fmt.Println("Error when calling Infura client: ", errWhenGetingInfuraClient)
-						fmt.Println("Loop sleeping for 28 hours......")
-						time.Sleep(28 * time.Hour)
-					}
-				} else {
-					break
+				sampler, errWhenCreatingSampler := newSamplerWithStrata(checkpoint.Sampler, strata)
+				if errWhenCreatingSampler != nil {
+					return nil, fmt.Errorf("job %s: %w", checkpoint.Job, errWhenCreatingSampler)
 				}
+				sampling.sampler = sampler
+			}
+			if checkpoint.SampleSize != 0 {
+				sampling.size = checkpoint.SampleSize
 			}
+			byJob[checkpoint.Job] = sampling
+		}
+		samplings[number] = sampling
+	}
+	return samplings, nil
+}
 
-			blockTimestamp := block.Time()
-
-			// convert the block timestamp to time.Time
-			transactionTime := time.Unix(int64(blockTimestamp), 0).UTC()
-
-			// format the timestamp as desired
-			timestampFormat := "Jan-02-2006 03:04:05 PM UTC"
-			transactionTimestamp := transactionTime.Format(timestampFormat)
-
-			//check the status of the transaction
-			if txnReceipt.Status == 1 {
-
-				var transactionUrl string
-				//call etherscan API to get the transaction details
-				transactionUrl = CreateTransactionUrl(etherscanKeys[etherscanApiKeyIndex], stringTxnHash)
-
-				var transactionRes *http.Response
-				var errWhenGettingTransactionDetails error
-
-				//handle API key issue by waiting 25 hours
-				for {
-					transactionRes, errWhenGettingTransactionDetails = http.Get(transactionUrl)
-					if errWhenGettingTransactionDetails != nil {
-						//rotate etherscan API key
-						etherscanApiKeyIndex = (etherscanApiKeyIndex + 1) % len(etherscanKeys)
-						transactionUrl = CreateTransactionUrl(etherscanKeys[etherscanApiKeyIndex], stringTxnHash)
-						transactionRes, errWhenGettingTransactionDetails = http.Get(transactionUrl)
-						if errWhenGettingTransactionDetails != nil {
-							fmt.Println("Error when getting transaction from etherscan : " + errWhenGettingTransactionDetails.Error())
-							fmt.Println("Loop sleeping for 28 hours...")
-							time.Sleep(28 * time.Hour)
-						}
-					} else {
-						break
-					}
-				}
+// coveringCheckpoint returns the checkpoint with a seed whose job wrote the block, or else
+// whose range holds it; nil when there is none.
+func coveringCheckpoint(checkpoints []Checkpoint, number uint64) *Checkpoint {
+	var covering *Checkpoint
+	for i := range checkpoints {
+		checkpoint := &checkpoints[i]
+		if checkpoint.SampleSeed == 0 || number < checkpoint.StartBlock || number >= checkpoint.EndBlock {
+			continue
+		}
+		if number < checkpoint.NextBlock {
+			return checkpoint
+		}
+		if covering == nil {
+			covering = checkpoint
+		}
+	}
+	return covering
+}
 
-				defer transactionRes.Body.Close()
-				txnBody, errWhenReadingTxnBody := ioutil.ReadAll(transactionRes.Body)
-				if errWhenReadingTxnBody != nil {
-					fmt.Println("Error when reading transaction body : ", errWhenReadingTxnBody)
-					continue
-				}
+// flushGasOutput keeps the blocks written before a run stopped early.
+func flushGasOutput(output gasOutput) {
+	errWhenFlushing := output.Flush()
+	if errWhenFlushing != nil {
+		fmt.Println("Error when flushing the output : ", errWhenFlushing)
+	}
+}
 
-				var transactionResponse TransactionResponse
-				errWhenUnmarshallingTxnResponse := json.Unmarshal(txnBody, &transactionResponse)
-				if errWhenUnmarshallingTxnResponse != nil {
-					fmt.Println("Error when unmarshaling transaction body : ", errWhenUnmarshallingTxnResponse)
-					continue
-				}
+// add counts a written block in the result.
+func (r *GasCollectionResult) add(data *blockGasData) {
+	r.BlocksProcessed++
+	r.TransactionsSampled += uint64(len(data.records))
+	r.TransactionsSkipped += data.skipped
+	r.Errors += data.errors
+	if data.lastError != nil {
+		r.LastError = fmt.Errorf("block %d: %w", data.number, data.lastError)
+	}
+}
 
-				fmt.Println("Hash : ", stringTxnHash)
-				fmt.Println("Timestamp : ", transactionTimestamp)
-				fmt.Println("Gas Price (Gwei) : ", weiToGwei(hexToString(transactionResponse.Result.GasPrice)))
+// blockSampling is how the transactions of every block of a run are sampled.
+type blockSampling struct {
+	sampler Sampler
+	size    int
+	//job seed, see BlockSampleSeed
+	seed int64
+}
 
-				data := []string{transactionTimestamp, weiToGwei(hexToString(transactionResponse.Result.GasPrice))}
+// sampling returns the sampling of a run with the job seed, a random one when zero.
+func (o *GasCollectorOptions) sampling(seed int64) *blockSampling {
+	sampling := &blockSampling{sampler: o.sampler(), size: o.sampleSize(), seed: seed}
+	if sampling.seed == 0 {
+		sampling.seed = newJobSeed()
+	}
+	return sampling
+}
 
-				//stringData := `0x` + hex.EncodeToString(tx.Data())
+func (o *GasCollectorOptions) sampleSize() int {
+	if o.SampleSize < 1 {
+		return defaultSampleSize
+	}
+	return o.SampleSize
+}
 
-				//write data to CSV
-				errWhenWritingData := writer.Write(data)
-				if errWhenWritingData != nil {
-					fmt.Println("Error when writing data : ", errWhenWritingData)
-					continue
-				}
-				writer.Flush()
-				data = nil //manually release data
-			} else {
-				//skip
-				continue
-			}
+func (o *GasCollectorOptions) sampler() Sampler {
+	if o.Sampler == nil {
+		return UniformSampler{}
+	}
+	return o.Sampler
+}
+
+// ErrSamplingChanged is returned when a job is resumed with another sampler, sample size or
+// number of price strata than it started with, which would mix two kinds of samples.
+var ErrSamplingChanged = errors.New("sampling settings changed")
+
+// setCheckpointSampling records the sampling settings and job seed of a job in its checkpoint.
+// A job keeps the seed it started with, so resuming it samples the remaining blocks as an
+// uninterrupted run would have; checkpoints written without a seed get one. Resuming with
+// other settings fails with ErrSamplingChanged.
+func setCheckpointSampling(checkpoint *Checkpoint, options *GasCollectorOptions) error {
+	sampler := options.sampler()
+	size, strata := options.sampleSize(), priceStrata(sampler)
+	//checkpoints written before the sample size was recorded only have the sampler
+	if checkpoint.Sampler != "" && checkpoint.Sampler != sampler.Name() ||
+		checkpoint.SampleSize != 0 && (checkpoint.SampleSize != size || checkpoint.PriceStrata != strata) {
+		return fmt.Errorf("%w: job %s was sampled with %s, not %s; resume it with the settings it started with",
+			ErrSamplingChanged, checkpoint.Job, describeSampling(checkpoint.Sampler, checkpoint.SampleSize, checkpoint.PriceStrata),
+			describeSampling(sampler.Name(), size, strata))
+	}
+	checkpoint.Sampler, checkpoint.SampleSize, checkpoint.PriceStrata = sampler.Name(), size, strata
+	if checkpoint.SampleSeed == 0 {
+		checkpoint.SampleSeed = options.SampleSeed
+	}
+	if checkpoint.SampleSeed == 0 {
+		checkpoint.SampleSeed = newJobSeed()
+	}
+	return nil
+}
+
+// describeSampling names a sampler with its sample size and price strata, when known.
+func describeSampling(sampler SamplingStrategy, size int, strata int) string {
+	description := string(sampler)
+	if size > 0 {
+		description += " of " + strconv.Itoa(size) + " transactions"
+	}
+	if strata > 0 {
+		description += " in " + strconv.Itoa(strata) + " price strata"
+	}
+	return description
+}
+
+func (o *GasCollectorOptions) createOutputDir() error {
+	if o.Store != nil {
+		return nil
+	}
+	if o.OutputDir != "" {
+		errWhenCreatingDir := os.MkdirAll(o.OutputDir, 0755)
+		if errWhenCreatingDir != nil {
+			return fmt.Errorf("creating output folder: %w", errWhenCreatingDir)
+		}
+	}
+	if o.Aggregates {
+		errWhenCreatingDir := os.MkdirAll(o.aggregatesDir(), 0755)
+		if errWhenCreatingDir != nil {
+			return fmt.Errorf("creating aggregates folder: %w", errWhenCreatingDir)
 		}
-		writer.Flush()
-		defer file.Close() //close file to release memeory
+	}
+	return nil
+}
+
+// aggregatesDir is the folder of the aggregate files, "aggregates" in the output folder
+// unless AggregatesDir is set.
+func (o *GasCollectorOptions) aggregatesDir() string {
+	if o.AggregatesDir != "" {
+		return o.AggregatesDir
+	}
+	return filepath.Join(o.OutputDir, "aggregates")
+}
 
+// ResolveBlockRange returns the blocks mined closest before two RFC3339 times, the range
+// GasDataCollector collects for them.
+func ResolveBlockRange(ctx context.Context, source BlockSource, startTime string, endTime string) (BlockRange, error) {
+	start, errWhenParsingStartTime := time.Parse(time.RFC3339, startTime)
+	if errWhenParsingStartTime != nil {
+		return BlockRange{}, fmt.Errorf("invalid start time: %w", errWhenParsingStartTime)
+	}
+	end, errWhenParsingTimeEnd := time.Parse(time.RFC3339, endTime)
+	if errWhenParsingTimeEnd != nil {
+		return BlockRange{}, fmt.Errorf("invalid end time: %w", errWhenParsingTimeEnd)
 	}
 
-	// signal that data collection has finished
-	done <- true
+	startBlock, endBlock, err := resolveBlockRange(ctx, NewRetryingBlockSource(source, RetryPolicy{}), start.Unix(), end.Unix())
+	return BlockRange{From: startBlock, To: endBlock}, err
+}
+
+// resolveBlockRange returns the blocks mined closest before the start and end timestamps.
+func resolveBlockRange(ctx context.Context, source BlockSource, startTime int64, endTime int64) (uint64, uint64, error) {
+	resolver := NewBlockResolver(source, NewHeaderCache(headerCacheSize))
 
+	//get the starting block
+	startBlock, errWhenResolvingBlock := resolver.BlockBefore(ctx, startTime)
+	if errWhenResolvingBlock != nil {
+		return 0, 0, fmt.Errorf("resolving the initial block: %w", errWhenResolvingBlock)
+	}
+
+	//get the ending block
+	endBlock, errWhenResolvingBlock := resolver.BlockBefore(ctx, endTime)
+	if errWhenResolvingBlock != nil {
+		return 0, 0, fmt.Errorf("resolving the last block: %w", errWhenResolvingBlock)
+	}
+
+	return startBlock, endBlock, nil
 }
 
-func CreateInfuraClient(apiKey string) (*ethclient.Client, error) {
-	client, err := ethclient.Dial("https://mainnet.infura.io/v3/" + apiKey)
+// ErrRangeNotEnded is returned when the chain has not moved far enough past the end time of a
+// range for its last block to be known. No checkpoint is saved, the range is tried again later.
+var ErrRangeNotEnded = errors.New("the chain has not passed the end of the range yet")
+
+// checkRangeEnded returns ErrRangeNotEnded unless the block after endBlock, the first one
+// mined after the end time, has the confirmations the blocks are collected at.
+func checkRangeEnded(ctx context.Context, source BlockSource, endBlock uint64, confirmations uint64) error {
+	head, err := source.BlockNumber(ctx)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("reading the chain head: %w", err)
 	}
-	return client, nil
+	needed := confirmedHead(endBlock+1, confirmations)
+	if head < needed {
+		return fmt.Errorf("%w: the range ends at block %d, head is %d and block %d is needed", ErrRangeNotEnded, endBlock, head, needed)
+	}
+	return nil
 }
 
-func CreateBlockUrl(apiKey string, timeObj int64) string {
-	return `https://api.etherscan.io/api?module=block&action=getblocknobytime&timestamp=` + strconv.FormatInt(timeObj, 10) + `&closest=before&apikey=` + apiKey
+// blockGasData holds the sampled records of one block, ready to be written.
+type blockGasData struct {
+	number    uint64
+	timestamp time.Time
+	//sampler, seed, sample size and price strata the records were drawn with
+	sampler   SamplingStrategy
+	seed      int64
+	size      int
+	strata    int
+	records   []*TransactionRecord
+	aggregate *BlockAggregate
+	err       error
+
+	//samples left out and the errors that caused some of them
+	skipped   uint64
+	errors    uint64
+	lastError error
 }
 
-func CreateTransactionUrl(apiKey string, txn string) string {
-	return `https://api.etherscan.io/api?module=proxy&action=eth_getTransactionByHash&txhash=` + txn + `&apikey=` + apiKey
+// fetchBlockGasData loads a block, samples its transactions and reads their receipts.
+func fetchBlockGasData(ctx context.Context, source BlockSource, extractor *TransactionExtractor, currentBlock uint64, sampling *blockSampling, scope AggregateScope) *blockGasData {
+	data := &blockGasData{number: currentBlock, sampler: sampling.sampler.Name(), seed: BlockSampleSeed(sampling.seed, currentBlock),
+		size: sampling.size, strata: priceStrata(sampling.sampler)}
+
+	var bigIntCurrentBlock big.Int
+	bigIntCurrentBlock.SetUint64(currentBlock)
+
+	block, errWhenLoadingBlock := source.BlockByNumber(ctx, &bigIntCurrentBlock)
+	if errWhenLoadingBlock != nil {
+		data.err = errWhenLoadingBlock
+		return data
+	}
+
+	// convert the block timestamp to time.Time
+	transactionTime := time.Unix(int64(block.Time()), 0).UTC()
+	data.timestamp = transactionTime
+
+	//contract creations are left out before sampling, so they do not shrink the sample
+	rng := rand.New(rand.NewSource(data.seed))
+	selectedTxs := sampling.sampler.Sample(rng, block.BaseFee(), samplingCandidates(block), sampling.size)
+
+	//query block transactions
+	receipts := make(map[common.Hash]*types.Receipt)
+	for _, tx := range selectedTxs {
+		stringTxnHash := tx.Hash().String()
+
+		// get the transaction receipt
+		txnReceipt, errWhenGettingTxnReceipt := source.TransactionReceipt(ctx, tx.Hash())
+		if errWhenGettingTxnReceipt != nil {
+			//a missing receipt only loses this sample
+			if ClassifyError(errWhenGettingTxnReceipt) == ErrorClassNotFound {
+				fmt.Println("Receipt not found for transaction ", stringTxnHash)
+				data.skipped++
+				continue
+			}
+			data.err = errWhenGettingTxnReceipt
+			return data
+		}
+		receipts[tx.Hash()] = txnReceipt
+
+		//check the status of the transaction
+		if txnReceipt.Status != 1 {
+			//skip
+			data.skipped++
+			continue
+		}
+
+		//read the transaction details from the block, etherscan is only a fallback
+		details, errWhenExtractingDetails := extractor.Extract(ctx, tx, block, txnReceipt)
+		if errWhenExtractingDetails != nil {
+			fmt.Println("Error when extracting transaction details : ", errWhenExtractingDetails)
+			data.skipped++
+			data.errors++
+			data.lastError = fmt.Errorf("transaction %s: %w", stringTxnHash, errWhenExtractingDetails)
+			continue
+		}
+
+		data.records = append(data.records, newTransactionRecord(details, txnReceipt, transactionTime))
+	}
+
+	prices, tips := samplePrices(data.records)
+	if scope == AggregateAll {
+		var errWhenGettingPrices error
+		prices, tips, errWhenGettingPrices = blockPrices(ctx, source, block, receipts)
+		if errWhenGettingPrices != nil {
+			data.err = errWhenGettingPrices
+			return data
+		}
+	}
+	data.aggregate = newBlockAggregate(block)
+	data.aggregate.Sampler, data.aggregate.SampleSeed = data.sampler, data.seed
+	data.aggregate.setSamples(data.records, data.skipped)
+	data.aggregate.setPrices(prices, tips)
+
+	return data
 }
 
-// Function to generate random indices
-func GenerateRandomIndices(max, count int) []int {
-	indices := make([]int, count)
-	for i := 0; i < count; i++ {
-		indices[i] = rand.Intn(max)
+// writeBlockGasData writes the records of a block to <block>.<format> in outputDir.
+func writeBlockGasData(outputDir string, format OutputFormat, data *blockGasData) error {
+	fileName := filepath.Join(outputDir, strconv.FormatUint(data.number, 10)+format.Extension())
+	errWhenWriting := writeRecordFile(fileName, format, gasSampleColumns, data.records)
+	if errWhenWriting != nil {
+		return errWhenWriting
 	}
-	return indices
+	return writeManifestFile(manifestPath(fileName), []*manifestBlock{newManifestBlock(data)})
 }
@@ -0,0 +1,257 @@
+package datacollector
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// OutputLayout decides how the sampled rows are split into files.
+type OutputLayout string
+
+const (
+	//one <block>.csv per block
+	OutputPerBlock OutputLayout = "block"
+	//one gas_<date>.csv per UTC day of the block timestamps
+	OutputPerDay OutputLayout = "day"
+	//one gas_<first>-<last>.csv per BlocksPerFile blocks
+	OutputPerBlocks OutputLayout = "blocks"
+)
+
+// DefaultBlocksPerFile is the file size of the OutputPerBlocks layout when none is set.
+const DefaultBlocksPerFile = 1000
+
+// partialSuffix marks a consolidated file that is still being written
+const partialSuffix = ".partial"
+
+// gasOutput receives the blocks of a run in block order.
+type gasOutput interface {
+	WriteBlock(data *blockGasData) error
+	//Flush writes the blocks an output keeps back, it is called when a run stops early
+	Flush() error
+	//Close finishes the file being written. It is not called when a run stops early, so
+	//an unfinished file is kept and continued by the next run.
+	Close() error
+}
+
+func newGasOutput(options *GasCollectorOptions, replaces func(number uint64) bool) gasOutput {
+	if options.Store != nil {
+		return storeGasOutput{store: options.Store}
+	}
+	blocksPerFile := options.BlocksPerFile
+	if blocksPerFile < 1 {
+		blocksPerFile = DefaultBlocksPerFile
+	}
+
+	var output gasOutput
+	switch options.OutputLayout {
+	case OutputPerDay, OutputPerBlocks:
+		output = &consolidatedGasOutput{dir: options.OutputDir, format: options.OutputFormat, layout: options.OutputLayout, blocksPerFile: uint64(blocksPerFile), replaces: replaces}
+	default:
+		output = perBlockGasOutput{dir: options.OutputDir, format: options.OutputFormat}
+	}
+	if !options.Aggregates {
+		return output
+	}
+
+	aggregates := &aggregateGasOutput{gasOutput: output, dir: options.aggregatesDir(), format: options.OutputFormat, replaces: replaces}
+	if options.OutputLayout == OutputPerBlocks {
+		aggregates.blocksPerFile = uint64(blocksPerFile)
+	}
+	return aggregates
+}
+
+type perBlockGasOutput struct {
+	dir    string
+	format OutputFormat
+}
+
+func (o perBlockGasOutput) WriteBlock(data *blockGasData) error {
+	return writeBlockGasData(o.dir, o.format, data)
+}
+
+func (o perBlockGasOutput) Flush() error {
+	return nil
+}
+
+func (o perBlockGasOutput) Close() error {
+	return nil
+}
+
+// consolidatedGasOutput collects the records of many blocks, with their block number, in
+// one file per day or per block range. The file being written is a stagedFile, its records
+// are synced to disk before the checkpoint moves past a block. Every block written, with or
+// without samples, is listed in the manifest of the file, staged the same way.
+type consolidatedGasOutput struct {
+	dir           string
+	format        OutputFormat
+	layout        OutputLayout
+	blocksPerFile uint64
+	//records of these blocks found in an existing file are dropped, they are written again
+	replaces func(number uint64) bool
+
+	name     string
+	file     *stagedFile[TransactionRecord]
+	manifest *stagedFile[manifestBlock]
+}
+
+func (o *consolidatedGasOutput) fileName(data *blockGasData) string {
+	if o.layout == OutputPerDay {
+		return "gas_" + data.timestamp.UTC().Format("2006-01-02") + o.format.Extension()
+	}
+	first := data.number / o.blocksPerFile * o.blocksPerFile
+	return "gas_" + strconv.FormatUint(first, 10) + "-" + strconv.FormatUint(first+o.blocksPerFile-1, 10) + o.format.Extension()
+}
+
+func (o *consolidatedGasOutput) WriteBlock(data *blockGasData) error {
+	name := o.fileName(data)
+	if name != o.name {
+		//rotate: the previous file is complete once the blocks move on
+		errWhenClosing := o.Close()
+		if errWhenClosing != nil {
+			return errWhenClosing
+		}
+		errWhenOpening := o.open(name)
+		if errWhenOpening != nil {
+			return errWhenOpening
+		}
+	}
+	errWhenWriting := o.file.Append(data.records...)
+	if errWhenWriting != nil {
+		return errWhenWriting
+	}
+	return o.manifest.Append(newManifestBlock(data))
+}
+
+// open continues the file of an interrupted run, or the finished file when a block belongs
+// to a file written before, or starts a new one.
+func (o *consolidatedGasOutput) open(name string) error {
+	path := filepath.Join(o.dir, name)
+	file, err := openStagedFile(path, readGasRecords, func(record *TransactionRecord) bool {
+		return o.replaces == nil || !o.replaces(record.Block)
+	})
+	if err != nil {
+		return err
+	}
+	manifest, err := openStagedFile(manifestPath(path), readManifest, func(block *manifestBlock) bool {
+		return o.replaces == nil || !o.replaces(block.Block)
+	})
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	//files written before manifests were kept only list the blocks with records
+	listed := make(map[uint64]bool)
+	for _, block := range manifest.items {
+		listed[block.Block] = true
+	}
+	var unlisted []*manifestBlock
+	byBlock := make(map[uint64]*manifestBlock)
+	for _, record := range file.items {
+		if listed[record.Block] {
+			continue
+		}
+		block, ok := byBlock[record.Block]
+		if !ok {
+			block = &manifestBlock{Block: record.Block}
+			byBlock[record.Block] = block
+			unlisted = append(unlisted, block)
+		}
+		block.Transactions++
+	}
+	err = manifest.Append(unlisted...)
+	if err != nil {
+		file.Close()
+		manifest.Close()
+		return err
+	}
+
+	o.name, o.file, o.manifest = name, file, manifest
+	return nil
+}
+
+// Flush does nothing: the partial file already holds every block written, and is finished by
+// the next run.
+func (o *consolidatedGasOutput) Flush() error {
+	return nil
+}
+
+// Close writes the current file in its format and removes its partial file.
+func (o *consolidatedGasOutput) Close() error {
+	if o.file == nil {
+		return nil
+	}
+	file, manifest := o.file, o.manifest
+	o.file, o.manifest, o.name = nil, nil, ""
+	errWhenFinishing := file.Finish(func(w io.Writer, records []*TransactionRecord) error {
+		return writeRecords(w, o.format, consolidatedColumns, records)
+	})
+	if errWhenFinishing != nil {
+		return errWhenFinishing
+	}
+	return manifest.Finish(writeManifest)
+}
+
+// isConsolidatedFile reports whether name is a finished or partial day or block range file.
+func isConsolidatedFile(name string) bool {
+	return strings.HasPrefix(name, "gas_") && (IsOutputFile(name) || IsOutputFile(strings.TrimSuffix(name, partialSuffix)))
+}
+
+// IsSampleFile reports whether path is a finished sample file: a block file, <number>.csv
+// in the output format, or a day or block range file. The aggregate, rollup and mempool files,
+// the manifests and the files still being written are not. The full-tx files, <unix>.csv,
+// cannot be told from block files by their name, they are only found in their own folder.
+func IsSampleFile(path string) bool {
+	name := filepath.Base(path)
+	format := formatOf(name)
+	if format == "" || strings.HasSuffix(name, manifestSuffix) {
+		return false
+	}
+	if strings.HasPrefix(name, "gas_") {
+		return true
+	}
+	_, err := strconv.ParseUint(strings.TrimSuffix(name, format.Extension()), 10, 64)
+	return err == nil
+}
+
+// consolidatedBlocks returns the blocks written to the consolidated files of dir with their
+// number of records, read from the manifests of the files or, for files without one, from the
+// records themselves.
+func consolidatedBlocks(dir string) (map[uint64]int, error) {
+	blocks := make(map[uint64]int)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isConsolidatedFile(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+
+		listed, err := readManifest(manifestPath(path))
+		if err == nil {
+			for _, block := range listed {
+				blocks[block.Block] = block.Transactions
+			}
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("reading the manifest of %s: %w", entry.Name(), err)
+		}
+
+		records, err := readGasRecords(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", entry.Name(), err)
+		}
+		for _, record := range records {
+			blocks[record.Block]++
+		}
+	}
+	return blocks, nil
+}
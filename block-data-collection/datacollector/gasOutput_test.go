@@ -0,0 +1,32 @@
+package datacollector
+
+import "testing"
+
+func TestIsSampleFile(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"out/17000000.csv", true},
+		{"out/17000000.jsonl", true},
+		{"out/gas_2024-01-01.csv", true},
+		{"out/gas_17000000-17000999.parquet", true},
+		//a full-tx file, told apart by its folder
+		{"out/output/1700000000.csv", true},
+		{"out/gas_2024-01-01.csv.partial", false},
+		{"out/17000000.csv.tmp", false},
+		{"out/17000000.csv.manifest.json", false},
+		{"out/gas_2024-01-01.csv.manifest.json", false},
+		{"out/aggregates/aggregates_2024-01-01.csv", false},
+		{"out/mempool/mempool_2024-01-01.csv", false},
+		{"out/rollups/rollup_hour_2024-01-01T00:00:00Z_2024-01-02T00:00:00Z.csv", false},
+		{"out/checkpoints.json", false},
+		{"out/notes.csv", false},
+		{"out/17000000.txt", false},
+	}
+	for _, test := range tests {
+		if got := IsSampleFile(test.path); got != test.want {
+			t.Errorf("IsSampleFile(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package datacollector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// BlockSamples are the sampled transactions of one block.
+type BlockSamples struct {
+	Number    uint64
+	Timestamp time.Time
+	//hashes of the block and its parent, to detect reorgs
+	Hash       common.Hash
+	ParentHash common.Hash
+	Records    []*TransactionRecord
+	//samples left out: failed, without a receipt or not extractable
+	Skipped uint64
+	//sampler, seed, sample size and price strata the records were drawn with, see
+	//BlockSampleSeed
+	Sampler     SamplingStrategy
+	SampleSeed  int64
+	SampleSize  int
+	PriceStrata int
+	//statistics of the block's gas prices
+	Aggregate *BlockAggregate
+}
+
+// GasStore keeps the sampled blocks in a database instead of output files.
+type GasStore interface {
+	//WriteBlock replaces the samples of a block, so a block collected again is not duplicated
+	WriteBlock(block *BlockSamples) error
+	//ScanGaps reports the blocks of blockRange that were never written or have no samples
+	ScanGaps(blockRange BlockRange) (*GapReport, error)
+	//Flush writes the blocks a store batches, Close flushes too
+	Flush() error
+	Close() error
+}
+
+// JobRunRecorder keeps a history of the collection runs.
+type JobRunRecorder interface {
+	StartRun(job string, startedAt time.Time) (int64, error)
+	FinishRun(id int64, result *GasCollectionResult, err error) error
+}
+
+// Job run states recorded by a JobRunRecorder.
+const (
+	RunRunning     = "running"
+	RunCompleted   = "completed"
+	RunFailed      = "failed"
+	RunInterrupted = "interrupted"
+)
+
+// runStatus returns the state a run finished in.
+func runStatus(err error) string {
+	if err == nil {
+		return RunCompleted
+	}
+	if errors.Is(err, context.Canceled) {
+		return RunInterrupted
+	}
+	return RunFailed
+}
+
+// recordRun runs collect and records it with options.Runs when set. Failing to record a run
+// is reported but does not fail the run.
+func recordRun(options *GasCollectorOptions, result *GasCollectionResult, collect func() error) error {
+	if options.Runs == nil {
+		return collect()
+	}
+
+	id, errWhenStarting := options.Runs.StartRun(result.Job, time.Now().UTC())
+	if errWhenStarting != nil {
+		fmt.Println("Error when recording the job run : ", errWhenStarting)
+		return collect()
+	}
+	errWhenCollecting := collect()
+	errWhenFinishing := options.Runs.FinishRun(id, result, errWhenCollecting)
+	if errWhenFinishing != nil {
+		fmt.Println("Error when recording the job run : ", errWhenFinishing)
+	}
+	return errWhenCollecting
+}
+
+// storeGasOutput writes the blocks of a run to a GasStore.
+type storeGasOutput struct {
+	store GasStore
+}
+
+func (o storeGasOutput) WriteBlock(data *blockGasData) error {
+	return o.store.WriteBlock(&BlockSamples{Number: data.number, Timestamp: data.timestamp, Records: data.records, Skipped: data.skipped,
+		Hash: data.aggregate.Hash, ParentHash: data.aggregate.ParentHash,
+		Sampler: data.sampler, SampleSeed: data.seed, SampleSize: data.size, PriceStrata: data.strata, Aggregate: data.aggregate})
+}
+
+func (o storeGasOutput) Flush() error {
+	return o.store.Flush()
+}
+
+func (o storeGasOutput) Close() error {
+	return o.store.Flush()
+}
@@ -0,0 +1,272 @@
+package datacollector
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrNoKeys = errors.New("key pool has no API keys")
+
+const (
+	//Etherscan allows 5 calls per second per key on the free plan
+	EtherscanRequestsPerSecond = 5
+	//how long a rate limited or rejected key is left unused
+	DefaultKeyCooldown = time.Minute
+)
+
+// KeyPool hands out API keys for a provider. Every key has its own token bucket so
+// requests are spread evenly and no key goes over the provider's per-key rate, keys that
+// hit a rate limit or are rejected are benched for a cooldown period, and per-key usage
+// is counted. It is safe for concurrent use.
+type KeyPool struct {
+	rate     float64
+	burst    float64
+	cooldown time.Duration
+	//requests allowed per key per UTC day, 0 means unlimited
+	dailyQuota uint64
+
+	mu   sync.Mutex
+	keys []*pooledKey
+	next int
+}
+
+type pooledKey struct {
+	key          string
+	tokens       float64
+	refilledAt   time.Time
+	benchedUntil time.Time
+
+	requests     uint64
+	failures     uint64
+	rateLimited  uint64
+	authFailures uint64
+
+	quotaDay      time.Time
+	requestsToday uint64
+}
+
+// KeyStats is the usage of one key. Key only shows the first characters of the key.
+type KeyStats struct {
+	Key          string
+	Requests     uint64
+	Failures     uint64
+	RateLimited  uint64
+	AuthFailures uint64
+	BenchedUntil time.Time
+
+	RequestsToday uint64
+	//requests left today, only meaningful when the pool has a daily quota
+	QuotaRemaining uint64
+}
+
+// NewKeyPool creates a pool allowing requestsPerSecond per key. Empty keys are ignored.
+func NewKeyPool(keys []string, requestsPerSecond float64, cooldown time.Duration) *KeyPool {
+	if requestsPerSecond <= 0 {
+		requestsPerSecond = 1
+	}
+	burst := requestsPerSecond
+	if burst < 1 {
+		burst = 1
+	}
+
+	now := time.Now()
+	pool := &KeyPool{rate: requestsPerSecond, burst: burst, cooldown: cooldown}
+	for _, key := range keys {
+		if key != "" {
+			pool.keys = append(pool.keys, &pooledKey{key: key, tokens: burst, refilledAt: now})
+		}
+	}
+	return pool
+}
+
+// SetDailyQuota limits every key to quota requests per UTC day. Keys that used up their
+// quota are skipped until the next day.
+func (p *KeyPool) SetDailyQuota(quota uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dailyQuota = quota
+}
+
+func (p *KeyPool) Len() int {
+	return len(p.keys)
+}
+
+// Acquire waits until a key that is not benched has a free request and returns it.
+func (p *KeyPool) Acquire(ctx context.Context) (string, error) {
+	if len(p.keys) == 0 {
+		return "", ErrNoKeys
+	}
+
+	for {
+		p.mu.Lock()
+		key, wait := p.take(time.Now())
+		p.mu.Unlock()
+		if key != "" {
+			return key, nil
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return "", ctx.Err()
+		}
+	}
+}
+
+// Do runs call with the next key and reports the outcome. When the key is rate limited or
+// rejected it gets benched and call is tried again with another key, so one revoked key
+// does not fail the request while others still work. The error is returned once every key
+// was tried or is benched.
+func (p *KeyPool) Do(ctx context.Context, call func(key string) error) error {
+	for attempt := 1; ; attempt++ {
+		key, err := p.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		err = call(key)
+		p.Report(key, err)
+		if err == nil || attempt >= len(p.keys) || !p.usable(time.Now()) {
+			return err
+		}
+		if class := ClassifyError(err); class != ErrorClassAuth && class != ErrorClassRateLimit {
+			return err
+		}
+	}
+}
+
+// usable reports whether a key is neither benched nor out of its daily quota.
+func (p *KeyPool) usable(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	for _, k := range p.keys {
+		if now.Before(k.benchedUntil) {
+			continue
+		}
+		if p.dailyQuota > 0 && k.quotaDay.Equal(today) && k.requestsToday >= p.dailyQuota {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// take picks the next available key round robin, or returns how long to wait for one.
+func (p *KeyPool) take(now time.Time) (string, time.Duration) {
+	wait := time.Duration(-1)
+	for offset := 0; offset < len(p.keys); offset++ {
+		index := (p.next + offset) % len(p.keys)
+		k := p.keys[index]
+
+		if now.Before(k.benchedUntil) {
+			wait = shorterWait(wait, k.benchedUntil.Sub(now))
+			continue
+		}
+
+		today := now.UTC().Truncate(24 * time.Hour)
+		if !k.quotaDay.Equal(today) {
+			k.quotaDay = today
+			k.requestsToday = 0
+		}
+		if p.dailyQuota > 0 && k.requestsToday >= p.dailyQuota {
+			wait = shorterWait(wait, today.Add(24*time.Hour).Sub(now))
+			continue
+		}
+
+		//refill the bucket for the time since the last request
+		k.tokens += now.Sub(k.refilledAt).Seconds() * p.rate
+		if k.tokens > p.burst {
+			k.tokens = p.burst
+		}
+		k.refilledAt = now
+
+		if k.tokens < 1 {
+			wait = shorterWait(wait, time.Duration((1-k.tokens)/p.rate*float64(time.Second)))
+			continue
+		}
+
+		k.tokens--
+		k.requests++
+		k.requestsToday++
+		p.next = (index + 1) % len(p.keys)
+		return k.key, 0
+	}
+
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return "", wait
+}
+
+func shorterWait(current time.Duration, candidate time.Duration) time.Duration {
+	if current < 0 || candidate < current {
+		return candidate
+	}
+	return current
+}
+
+// Report records the outcome of a request made with key. Rate limit and auth errors
+// bench the key for the cooldown period.
+func (p *KeyPool) Report(key string, err error) {
+	if err == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, k := range p.keys {
+		if k.key != key {
+			continue
+		}
+
+		k.failures++
+		switch ClassifyError(err) {
+		case ErrorClassRateLimit:
+			k.rateLimited++
+			k.benchedUntil = time.Now().Add(p.cooldown)
+		case ErrorClassAuth:
+			k.authFailures++
+			k.benchedUntil = time.Now().Add(p.cooldown)
+		}
+		return
+	}
+}
+
+func (p *KeyPool) Stats() []KeyStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	stats := make([]KeyStats, 0, len(p.keys))
+	for _, k := range p.keys {
+		keyStats := KeyStats{
+			Key:          maskKey(k.key),
+			Requests:     k.requests,
+			Failures:     k.failures,
+			RateLimited:  k.rateLimited,
+			AuthFailures: k.authFailures,
+			BenchedUntil: k.benchedUntil,
+		}
+		if k.quotaDay.Equal(today) {
+			keyStats.RequestsToday = k.requestsToday
+		}
+		if p.dailyQuota > keyStats.RequestsToday {
+			keyStats.QuotaRemaining = p.dailyQuota - keyStats.RequestsToday
+		}
+		stats = append(stats, keyStats)
+	}
+	return stats
+}
+
+func maskKey(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+	return key[:4] + "****"
+}
@@ -0,0 +1,160 @@
+package datacollector
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyPoolTake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 23, 58, 0, 0, time.UTC)
+
+	type step struct {
+		//time since start, the key handed out or else the wait for one
+		at   time.Duration
+		key  string
+		wait time.Duration
+	}
+	tests := []struct {
+		name  string
+		keys  []string
+		rate  float64
+		quota uint64
+		bench map[string]time.Duration
+		steps []step
+	}{
+		{
+			name: "burst then refill",
+			keys: []string{"a"},
+			rate: 5,
+			steps: []step{
+				{0, "a", 0}, {0, "a", 0}, {0, "a", 0}, {0, "a", 0}, {0, "a", 0},
+				{0, "", 200 * time.Millisecond},
+				{100 * time.Millisecond, "", 100 * time.Millisecond},
+				{200 * time.Millisecond, "a", 0},
+				{200 * time.Millisecond, "", 200 * time.Millisecond},
+			},
+		},
+		{
+			name: "refill is capped at the burst",
+			keys: []string{"a"},
+			rate: 2,
+			steps: []step{
+				{0, "a", 0}, {0, "a", 0},
+				{10 * time.Second, "a", 0}, {10 * time.Second, "a", 0},
+				{10 * time.Second, "", 500 * time.Millisecond},
+			},
+		},
+		{
+			name: "rate below one request per second",
+			keys: []string{"a"},
+			rate: 0.5,
+			steps: []step{
+				{0, "a", 0},
+				{0, "", 2 * time.Second},
+				{time.Second, "", time.Second},
+				{2 * time.Second, "a", 0},
+			},
+		},
+		{
+			name: "round robin",
+			keys: []string{"a", "b"},
+			rate: 1,
+			steps: []step{
+				{0, "a", 0}, {0, "b", 0},
+				{0, "", time.Second},
+				{500 * time.Millisecond, "", 500 * time.Millisecond},
+				{time.Second, "a", 0}, {time.Second, "b", 0},
+			},
+		},
+		{
+			name:  "benched key is skipped",
+			keys:  []string{"a", "b"},
+			rate:  1,
+			bench: map[string]time.Duration{"a": 3 * time.Second},
+			steps: []step{
+				{0, "b", 0},
+				{0, "", time.Second},
+				{time.Second, "b", 0},
+				{3 * time.Second, "a", 0},
+			},
+		},
+		{
+			name:  "daily quota waits for the next UTC day",
+			keys:  []string{"a"},
+			rate:  100,
+			quota: 2,
+			steps: []step{
+				{0, "a", 0}, {0, "a", 0},
+				{0, "", 2 * time.Minute},
+				{90 * time.Second, "", 30 * time.Second},
+				{2 * time.Minute, "a", 0},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := NewKeyPool(test.keys, test.rate, DefaultKeyCooldown)
+			pool.SetDailyQuota(test.quota)
+			for _, k := range pool.keys {
+				k.refilledAt = start
+				k.benchedUntil = start.Add(test.bench[k.key])
+			}
+
+			for i, s := range test.steps {
+				key, wait := pool.take(start.Add(s.at))
+				if key != s.key || wait != s.wait {
+					t.Fatalf("step %d at %s: took %q and wait %s, want %q and %s", i, s.at, key, wait, s.key, s.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyPoolDo(t *testing.T) {
+	rejected := &HTTPStatusError{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized"}
+	limited := testRPCError{-32005, "daily request count exceeded"}
+	failed := &HTTPStatusError{StatusCode: http.StatusBadGateway, Status: "502 Bad Gateway"}
+
+	tests := []struct {
+		name string
+		//error returned for each key, the other keys succeed
+		errs      map[string]error
+		wantCalls []string
+		wantErr   error
+	}{
+		{"first key works", nil, []string{"a"}, nil},
+		{"rejected key switched", map[string]error{"a": rejected}, []string{"a", "b"}, nil},
+		{"rate limited key switched", map[string]error{"a": limited}, []string{"a", "b"}, nil},
+		{"two keys rejected", map[string]error{"a": rejected, "b": limited}, []string{"a", "b", "c"}, nil},
+		{"other error not switched", map[string]error{"a": failed}, []string{"a"}, failed},
+		{"every key rejected", map[string]error{"a": rejected, "b": rejected, "c": limited}, []string{"a", "b", "c"}, limited},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := NewKeyPool([]string{"a", "b", "c"}, 100, DefaultKeyCooldown)
+			var calls []string
+			err := pool.Do(context.Background(), func(key string) error {
+				calls = append(calls, key)
+				return test.errs[key]
+			})
+
+			if err != test.wantErr {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if strings.Join(calls, ",") != strings.Join(test.wantCalls, ",") {
+				t.Fatalf("called with %v, want %v", calls, test.wantCalls)
+			}
+			//the switched keys are benched, the next call starts with another one
+			for _, k := range pool.keys {
+				err, ok := test.errs[k.key]
+				benched := k.benchedUntil.After(time.Now())
+				if benched != (ok && err != failed) {
+					t.Fatalf("key %s benched: %v, after the error %v", k.key, benched, err)
+				}
+			}
+		})
+	}
+}
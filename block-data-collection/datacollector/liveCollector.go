@@ -0,0 +1,234 @@
+package datacollector
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// LiveJob is the checkpoint name of the live collection.
+const LiveJob = "live"
+
+const (
+	//DefaultLivePollInterval is how often the head is polled without a subscription
+	DefaultLivePollInterval = 12 * time.Second
+	//DefaultLiveResubscribeInterval is how often a dropped subscription is tried again
+	DefaultLiveResubscribeInterval = time.Minute
+)
+
+// HeadSubscriber announces new chain heads, as an ethclient connected over WebSocket does.
+type HeadSubscriber interface {
+	SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error)
+}
+
+// DialHeadSubscriber connects to a WebSocket JSON-RPC endpoint.
+func DialHeadSubscriber(ctx context.Context, rawUrl string) (*ethclient.Client, error) {
+	return ethclient.DialContext(ctx, rawUrl)
+}
+
+// LiveCollectorOptions configures FollowChainHead. The embedded options are used as for
+// GasDataCollector, Confirmations being the depth a block is collected at.
+type LiveCollectorOptions struct {
+	GasCollectorOptions
+
+	//optional, heads are polled from Source without it or while its subscription is down
+	Heads HeadSubscriber
+	//DefaultLivePollInterval when zero
+	PollInterval time.Duration
+	//DefaultLiveResubscribeInterval when zero
+	ResubscribeInterval time.Duration
+}
+
+// FollowChainHead collects every new block once it has options.Confirmations confirmations
+// (one, the head itself, when zero) until ctx is cancelled. Progress is checkpointed as
+// LiveJob, so a later run continues after the last block written, catching up on the blocks
+// mined in between; the first run starts at the newest confirmed block.
+func FollowChainHead(ctx context.Context, options LiveCollectorOptions) (*GasCollectionResult, error) {
+	result := &GasCollectionResult{Job: LiveJob}
+	began := time.Now()
+	errWhenFollowing := recordRun(&options.GasCollectorOptions, result, func() error {
+		err := followChainHead(ctx, options, result)
+		result.Duration = time.Since(began)
+		return err
+	})
+	return result, errWhenFollowing
+}
+
+func followChainHead(ctx context.Context, options LiveCollectorOptions, result *GasCollectionResult) error {
+	source := NewRetryingBlockSource(options.Source, options.Retry)
+	extractor := NewTransactionExtractor(options.EtherscanKeys, options.EtherscanApiUrl, options.MaxEtherscanRequests, options.Retry)
+	depth := options.Confirmations
+	if depth < 1 {
+		depth = 1
+	}
+
+	heads := &headWatcher{source: source, subscriber: options.Heads,
+		pollInterval: options.PollInterval, resubscribeInterval: options.ResubscribeInterval}
+	if heads.pollInterval <= 0 {
+		heads.pollInterval = DefaultLivePollInterval
+	}
+	if heads.resubscribeInterval <= 0 {
+		heads.resubscribeInterval = DefaultLiveResubscribeInterval
+	}
+	defer heads.unsubscribe()
+
+	var checkpoint *Checkpoint
+	if options.Checkpoints != nil {
+		var errWhenLoadingCheckpoint error
+		checkpoint, errWhenLoadingCheckpoint = options.Checkpoints.Load(LiveJob)
+		if errWhenLoadingCheckpoint != nil {
+			return fmt.Errorf("loading checkpoint: %w", errWhenLoadingCheckpoint)
+		}
+	}
+	if checkpoint != nil {
+		fmt.Println("Resuming the live collection from block ", checkpoint.NextBlock)
+		result.Resumed = true
+	} else {
+		head, errWhenReadingHead := source.BlockNumber(ctx)
+		if errWhenReadingHead != nil {
+			return fmt.Errorf("reading the chain head: %w", errWhenReadingHead)
+		}
+		first := uint64(0)
+		if head+1 >= depth {
+			first = head + 1 - depth
+		}
+		checkpoint = &Checkpoint{Job: LiveJob, StartBlock: first, EndBlock: first, NextBlock: first}
+	}
+	errWhenSettingSampling := setCheckpointSampling(checkpoint, &options.GasCollectorOptions)
+	if errWhenSettingSampling != nil {
+		return errWhenSettingSampling
+	}
+	result.StartBlock, result.EndBlock = checkpoint.NextBlock, checkpoint.NextBlock
+
+	sampling := options.sampling(checkpoint.SampleSeed)
+	result.Sampler, result.SampleSeed = sampling.sampler.Name(), sampling.seed
+	errWhenCreatingDir := options.createOutputDir()
+	if errWhenCreatingDir != nil {
+		return errWhenCreatingDir
+	}
+
+	//rows a previous run wrote past its checkpoint are replaced
+	firstBlock := checkpoint.NextBlock
+	output := newGasOutput(&options.GasCollectorOptions, func(number uint64) bool {
+		return number >= firstBlock
+	})
+	//the current file is left open for the next run to continue, like an interrupted job
+	defer flushGasOutput(output)
+
+	fetchBlock := func(currentBlock uint64) *blockGasData {
+		return fetchBlockGasData(ctx, source, extractor, currentBlock, sampling, options.AggregateScope)
+	}
+	writeBlock := checkpointedWriter(ctx, &options.GasCollectorOptions, output, checkpoint, result)
+
+	for {
+		head, errWhenWaiting := heads.wait(ctx, confirmedHead(checkpoint.NextBlock, depth))
+		if errWhenWaiting != nil {
+			return errWhenWaiting
+		}
+		//the blocks up to the one with depth confirmations, end is exclusive
+		end := head + 2 - depth
+
+		//the live job never completes, its end is the block after the last one collected
+		checkpoint.EndBlock = end
+		errWhenCollecting := fetchInOrder(ctx, checkpoint.NextBlock, end, options.Workers, fetchBlock, writeBlock)
+		result.EndBlock = checkpoint.NextBlock
+		if errWhenCollecting != nil {
+			return errWhenCollecting
+		}
+	}
+}
+
+// headWatcher follows the chain head through a subscription, polling while there is none.
+type headWatcher struct {
+	source              BlockSource
+	subscriber          HeadSubscriber
+	pollInterval        time.Duration
+	resubscribeInterval time.Duration
+
+	subscription   ethereum.Subscription
+	heads          chan *types.Header
+	lastSubscribed time.Time
+	//newest head seen
+	head uint64
+}
+
+// wait returns the newest head once it is at least number.
+func (w *headWatcher) wait(ctx context.Context, number uint64) (uint64, error) {
+	for {
+		if w.head >= number {
+			return w.head, nil
+		}
+		//the head read when subscribing may already be enough
+		w.subscribe(ctx)
+		if w.head >= number {
+			return w.head, nil
+		}
+
+		if w.subscription == nil {
+			head, err := w.source.BlockNumber(ctx)
+			if err != nil {
+				return 0, fmt.Errorf("reading the chain head: %w", err)
+			}
+			w.see(head)
+			if w.head >= number {
+				return w.head, nil
+			}
+			select {
+			case <-time.After(w.pollInterval):
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+			continue
+		}
+
+		select {
+		case header := <-w.heads:
+			w.see(header.Number.Uint64())
+		case err := <-w.subscription.Err():
+			fmt.Println("Error when following new heads, polling instead : ", err)
+			w.unsubscribe()
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// subscribe starts the subscription when there is a subscriber, none is running and the
+// last attempt is at least resubscribeInterval ago.
+func (w *headWatcher) subscribe(ctx context.Context) {
+	if w.subscriber == nil || w.subscription != nil || time.Since(w.lastSubscribed) < w.resubscribeInterval {
+		return
+	}
+	w.lastSubscribed = time.Now()
+	w.heads = make(chan *types.Header, 16)
+	subscription, err := w.subscriber.SubscribeNewHead(ctx, w.heads)
+	if err != nil {
+		fmt.Println("Error when subscribing to new heads, polling instead : ", err)
+		return
+	}
+	w.subscription = subscription
+
+	//a head announced before the subscription started is not sent, read it once
+	head, err := w.source.BlockNumber(ctx)
+	if err == nil {
+		w.see(head)
+	}
+}
+
+func (w *headWatcher) unsubscribe() {
+	if w.subscription != nil {
+		w.subscription.Unsubscribe()
+		w.subscription = nil
+	}
+}
+
+// see records a head; heads of a reorg may go back, the newest number seen is kept.
+func (w *headWatcher) see(head uint64) {
+	if head > w.head {
+		w.head = head
+	}
+}
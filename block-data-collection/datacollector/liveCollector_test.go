@@ -0,0 +1,215 @@
+package datacollector
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// steppingHead is a BlockSource whose head is the next of heads at every read, staying at
+// the last one.
+type steppingHead struct {
+	BlockSource
+	mu    sync.Mutex
+	heads []uint64
+}
+
+func (s *steppingHead) BlockNumber(ctx context.Context) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	head := s.heads[0]
+	if len(s.heads) > 1 {
+		s.heads = s.heads[1:]
+	}
+	return head, nil
+}
+
+// testHeadSubscriber announces heads on every subscription, after failing the first
+// failures subscriptions. A subscription with drop set fails once its heads are read.
+type testHeadSubscriber struct {
+	failures      int
+	heads         []uint64
+	drop          bool
+	subscriptions int
+	started       []*testSubscription
+}
+
+type testSubscription struct {
+	errs         chan error
+	unsubscribed bool
+}
+
+func (s *testSubscription) Err() <-chan error {
+	return s.errs
+}
+
+func (s *testSubscription) Unsubscribe() {
+	s.unsubscribed = true
+}
+
+func (s *testHeadSubscriber) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	s.subscriptions++
+	if s.subscriptions <= s.failures {
+		return nil, errors.New("dial tcp: connection refused")
+	}
+	subscription := &testSubscription{errs: make(chan error, 1)}
+	s.started = append(s.started, subscription)
+	for _, head := range s.heads {
+		ch <- &types.Header{Number: new(big.Int).SetUint64(head)}
+	}
+	if s.drop {
+		subscription.errs <- errors.New("websocket: close 1006")
+	}
+	return subscription, nil
+}
+
+func TestHeadWatcher(t *testing.T) {
+	tests := []struct {
+		name       string
+		subscriber *testHeadSubscriber
+		//heads read from the block source, one per read
+		polled []uint64
+		//wait before subscribing again
+		resubscribe       time.Duration
+		number            uint64
+		want              uint64
+		wantSubscriptions int
+		//the watcher ends with a running subscription
+		wantSubscribed bool
+	}{
+		{"polling without subscriber", nil, []uint64{5, 6, 8}, time.Hour, 8, 8, 0, false},
+		{"head read when subscribing", &testHeadSubscriber{}, []uint64{9}, time.Hour, 8, 9, 1, true},
+		{"heads from the subscription", &testHeadSubscriber{heads: []uint64{7, 9}}, []uint64{5}, time.Hour, 9, 9, 1, true},
+		{"dropped subscription polls", &testHeadSubscriber{drop: true}, []uint64{5, 6, 8}, time.Hour, 8, 8, 1, false},
+		{"dropped subscription is tried again", &testHeadSubscriber{drop: true}, []uint64{5, 6, 8}, time.Nanosecond, 8, 8, 3, true},
+		{"failed subscription is tried again", &testHeadSubscriber{failures: 1, heads: []uint64{9}}, []uint64{5}, time.Nanosecond, 9, 9, 2, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			watcher := &headWatcher{source: &steppingHead{heads: test.polled}, pollInterval: time.Millisecond, resubscribeInterval: test.resubscribe}
+			if test.subscriber != nil {
+				watcher.subscriber = test.subscriber
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			head, err := watcher.wait(ctx, test.number)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if head != test.want {
+				t.Fatalf("head %d, want %d", head, test.want)
+			}
+			if test.subscriber == nil {
+				return
+			}
+			if test.subscriber.subscriptions != test.wantSubscriptions {
+				t.Fatalf("subscribed %d times, want %d", test.subscriber.subscriptions, test.wantSubscriptions)
+			}
+			if (watcher.subscription != nil) != test.wantSubscribed {
+				t.Fatalf("subscribed at the end: %v, want %v", watcher.subscription != nil, test.wantSubscribed)
+			}
+			//every subscription but the running one was closed
+			for i, subscription := range test.subscriber.started {
+				running := watcher.subscription == ethereum.Subscription(subscription)
+				if subscription.unsubscribed == running {
+					t.Fatalf("subscription %d closed: %v, running: %v", i, subscription.unsubscribed, running)
+				}
+			}
+		})
+	}
+}
+
+func TestHeadWatcherCancelled(t *testing.T) {
+	watcher := &headWatcher{source: &steppingHead{heads: []uint64{5}}, subscriber: &testHeadSubscriber{},
+		pollInterval: time.Millisecond, resubscribeInterval: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := watcher.wait(ctx, 6); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the context error", err)
+	}
+}
+
+// waitForCheckpoint waits until the checkpoint of job reaches next.
+func waitForCheckpoint(t *testing.T, checkpoints CheckpointStore, job string, next uint64) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		checkpoint, err := checkpoints.Load(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checkpoint != nil && checkpoint.NextBlock >= next {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not reach block %d", job, next)
+}
+
+func TestFollowChainHead(t *testing.T) {
+	chain := newTestChain(2, 2, 2, 2, 0, 2, 2, 2, 2, 2, 2, 2, 2)
+	chain.reveal(6)
+	dir := t.TempDir()
+	checkpoints := NewFileCheckpointStore(filepath.Join(dir, "checkpoints.json"))
+	options := LiveCollectorOptions{
+		GasCollectorOptions: GasCollectorOptions{Source: chain, Checkpoints: checkpoints, Workers: 2, SampleSize: 1, Confirmations: 2,
+			OutputDir: dir, OutputLayout: OutputPerBlock, OutputFormat: FormatCSV},
+		PollInterval: time.Millisecond,
+	}
+	//follow runs the live collection until the returned stop is called
+	follow := func() (stop func() *GasCollectionResult) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var result *GasCollectionResult
+		done := make(chan struct{})
+		go func() {
+			result, _ = FollowChainHead(ctx, options)
+			close(done)
+		}()
+		return func() *GasCollectionResult {
+			cancel()
+			<-done
+			return result
+		}
+	}
+
+	//the first run starts at the newest block with 2 confirmations, block 4 at head 5
+	stop := follow()
+	waitForCheckpoint(t, checkpoints, LiveJob, 5)
+	chain.reveal(10)
+	waitForCheckpoint(t, checkpoints, LiveJob, 9)
+	if result := stop(); result.Resumed || result.StartBlock != 4 {
+		t.Fatalf("first run %+v, want a new run from block 4", result)
+	}
+
+	//the next run catches up on the blocks mined in between
+	chain.reveal(13)
+	stop = follow()
+	waitForCheckpoint(t, checkpoints, LiveJob, 12)
+	if result := stop(); !result.Resumed || result.StartBlock != 9 {
+		t.Fatalf("second run %+v, want a resumed run from block 9", result)
+	}
+
+	for number := 0; number < 13; number++ {
+		_, err := os.Stat(filepath.Join(dir, strconv.Itoa(number)+".csv"))
+		if collected := number >= 4 && number < 12; collected != (err == nil) {
+			t.Fatalf("block %d written: %v, want %v", number, err == nil, collected)
+		}
+	}
+	checkpoint, err := checkpoints.Load(LiveJob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.StartBlock != 4 || checkpoint.NextBlock != 12 || checkpoint.EndBlock != 12 {
+		t.Fatalf("checkpoint %+v, want blocks 4 to 12", checkpoint)
+	}
+}
@@ -0,0 +1,30 @@
+package datacollector
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrLocked is returned by LockFile when another process holds the lock.
+var ErrLocked = errors.New("held by another process")
+
+// FileLock is an exclusive lock on a file, shared between the processes of one machine.
+type FileLock struct {
+	path string
+	file *os.File
+}
+
+// LockFile takes the lock of path, creating the file when needed, or returns ErrLocked.
+func LockFile(path string) (*FileLock, error) {
+	file, err := lockFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("locking %s: %w", path, err)
+	}
+	return &FileLock{path: path, file: file}, nil
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	return unlockFile(l.path, l.file)
+}
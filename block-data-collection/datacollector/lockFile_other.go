@@ -0,0 +1,22 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package datacollector
+
+import (
+	"os"
+)
+
+// lockFile creates path, it is held as long as the file exists. A crashed run leaves the
+// file behind and it has to be removed by hand.
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, ErrLocked
+	}
+	return file, err
+}
+
+func unlockFile(path string, file *os.File) error {
+	file.Close()
+	return os.Remove(path)
+}
@@ -0,0 +1,84 @@
+package datacollector
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// manifestSuffix names the manifest written next to every sample file, <name>.manifest.json.
+const manifestSuffix = ".manifest.json"
+
+// sampleManifest lists the blocks written to a sample file and how each was sampled,
+// including the blocks without any sample, which have no rows in the file itself.
+type sampleManifest struct {
+	Blocks []*manifestBlock `json:"blocks"`
+}
+
+// manifestBlock is a block written to a sample file.
+type manifestBlock struct {
+	Block        uint64 `json:"block"`
+	Transactions int    `json:"transactions"`
+	//sampler and block seed, see BlockSampleSeed, with the sample size and the number of
+	//price strata of SampleStratifiedPrice; empty for files written without them
+	Sampler     SamplingStrategy `json:"sampler,omitempty"`
+	SampleSeed  int64            `json:"sampleSeed,omitempty"`
+	SampleSize  int              `json:"sampleSize,omitempty"`
+	PriceStrata int              `json:"priceStrata,omitempty"`
+}
+
+func newManifestBlock(data *blockGasData) *manifestBlock {
+	return &manifestBlock{Block: data.number, Transactions: len(data.records),
+		Sampler: data.sampler, SampleSeed: data.seed, SampleSize: data.size, PriceStrata: data.strata}
+}
+
+// manifestPath returns the manifest of a finished or partial sample file.
+func manifestPath(path string) string {
+	if strings.HasSuffix(path, partialSuffix) {
+		return strings.TrimSuffix(path, partialSuffix) + manifestSuffix + partialSuffix
+	}
+	return path + manifestSuffix
+}
+
+func writeManifest(w io.Writer, blocks []*manifestBlock) error {
+	return json.NewEncoder(w).Encode(sampleManifest{Blocks: blocks})
+}
+
+// writeManifestFile writes a manifest with writeFileAtomically.
+func writeManifestFile(path string, blocks []*manifestBlock) error {
+	return writeFileAtomically(path, func(w io.Writer) error {
+		return writeManifest(w, blocks)
+	})
+}
+
+// RemoveSampleFile removes a sample file and its manifest.
+func RemoveSampleFile(path string) error {
+	err := os.Remove(path)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(manifestPath(path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// readManifest reads a finished or partial manifest.
+func readManifest(path string) ([]*manifestBlock, error) {
+	if strings.HasSuffix(path, partialSuffix) {
+		return readJSONLines[manifestBlock](path)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest sampleManifest
+	err = json.Unmarshal(content, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Blocks, nil
+}
@@ -0,0 +1,394 @@
+package datacollector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// DefaultMempoolInterval is how often the mempool is recorded.
+const DefaultMempoolInterval = time.Minute
+
+// MempoolSource tells where the transactions of a MempoolSnapshot come from. The two measure
+// different things and their snapshots are not comparable: a subscription snapshot is the
+// flow of new bids during one interval, a txpool snapshot the stock of bids still waiting at
+// one moment, which leans towards the low bids that are not included.
+type MempoolSource string
+
+const (
+	//the transactions announced by a newPendingTransactions subscription during the whole
+	//interval before the snapshot, each once
+	MempoolSubscription MempoolSource = "subscription"
+	//the pending transactions of txpool_content when the snapshot was taken
+	MempoolTxPool MempoolSource = "txpool"
+)
+
+var (
+	//ErrPendingHashesOnly ends a subscription whose node announces hashes, not transactions
+	ErrPendingHashesOnly = errors.New("the node only announces pending transaction hashes")
+	//ErrTxPoolUnsupported is returned by nodes without the txpool namespace, like most providers
+	ErrTxPoolUnsupported = errors.New("the node does not support txpool_content")
+)
+
+// PendingTransaction holds the fee fields of a transaction waiting in the mempool. Legacy and
+// access list transactions only have a gas price, which is both their max fee and tip.
+type PendingTransaction struct {
+	Hash                 common.Hash
+	Type                 uint8
+	GasPrice             *big.Int
+	MaxFeePerGas         *big.Int
+	MaxPriorityFeePerGas *big.Int
+}
+
+func (t *PendingTransaction) UnmarshalJSON(data []byte) error {
+	//nodes that ignore the full transactions flag send the hash only
+	if len(data) > 0 && data[0] == '"' {
+		return ErrPendingHashesOnly
+	}
+	var fields struct {
+		Hash                 common.Hash    `json:"hash"`
+		Type                 hexutil.Uint64 `json:"type"`
+		GasPrice             *hexutil.Big   `json:"gasPrice"`
+		MaxFeePerGas         *hexutil.Big   `json:"maxFeePerGas"`
+		MaxPriorityFeePerGas *hexutil.Big   `json:"maxPriorityFeePerGas"`
+	}
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	t.Hash, t.Type = fields.Hash, uint8(fields.Type)
+	t.GasPrice = (*big.Int)(fields.GasPrice)
+	t.MaxFeePerGas = (*big.Int)(fields.MaxFeePerGas)
+	t.MaxPriorityFeePerGas = (*big.Int)(fields.MaxPriorityFeePerGas)
+	return nil
+}
+
+// maxFee is the most the transaction pays per gas.
+func (t *PendingTransaction) maxFee() *big.Int {
+	if t.MaxFeePerGas != nil {
+		return t.MaxFeePerGas
+	}
+	return t.GasPrice
+}
+
+// maxTip is the most the transaction pays the validator per gas.
+func (t *PendingTransaction) maxTip() *big.Int {
+	if t.MaxPriorityFeePerGas != nil {
+		return t.MaxPriorityFeePerGas
+	}
+	return t.GasPrice
+}
+
+// PendingSubscriber announces the transactions entering the mempool of a node.
+type PendingSubscriber interface {
+	SubscribePendingTransactions(ctx context.Context, ch chan<- *PendingTransaction) (ethereum.Subscription, error)
+}
+
+// TxPoolReader reads the executable transactions waiting in the mempool of a node.
+type TxPoolReader interface {
+	TxPoolContent(ctx context.Context) ([]*PendingTransaction, error)
+}
+
+// RPCMempoolSource reads the mempool of a node over JSON-RPC. Subscriptions need a
+// WebSocket endpoint.
+type RPCMempoolSource struct {
+	client *rpc.Client
+}
+
+func DialMempoolSource(ctx context.Context, rawUrl string) (*RPCMempoolSource, error) {
+	client, err := rpc.DialContext(ctx, rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	return &RPCMempoolSource{client: client}, nil
+}
+
+// SubscribePendingTransactions subscribes to newPendingTransactions with full transactions,
+// which geth and compatible nodes support. The subscription ends with ErrPendingHashesOnly
+// on nodes that send hashes instead.
+func (s *RPCMempoolSource) SubscribePendingTransactions(ctx context.Context, ch chan<- *PendingTransaction) (ethereum.Subscription, error) {
+	return s.client.EthSubscribe(ctx, ch, "newPendingTransactions", true)
+}
+
+// TxPoolContent returns the pending transactions of txpool_content, the queued ones, which
+// wait for an earlier nonce, left out.
+func (s *RPCMempoolSource) TxPoolContent(ctx context.Context) ([]*PendingTransaction, error) {
+	var content struct {
+		Pending map[common.Address]map[string]*PendingTransaction `json:"pending"`
+	}
+	err := s.client.CallContext(ctx, &content, "txpool_content")
+	var rpcError rpc.Error
+	//-32601 is "method not found"
+	if errors.As(err, &rpcError) && rpcError.ErrorCode() == -32601 {
+		return nil, ErrTxPoolUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var txs []*PendingTransaction
+	for _, byNonce := range content.Pending {
+		for _, tx := range byNonce {
+			txs = append(txs, tx)
+		}
+	}
+	return txs, nil
+}
+
+func (s *RPCMempoolSource) Close() {
+	s.client.Close()
+}
+
+// MempoolSnapshot summarises the fees offered by the transactions of the mempool, either
+// those that arrived during the interval before Time or those waiting at Time, as told by
+// Source. Amounts are in wei.
+type MempoolSnapshot struct {
+	Time   time.Time     `json:"time"`
+	Source MempoolSource `json:"source"`
+	//head block when the snapshot was taken, the bids are compared with its base fee
+	HeadBlock uint64   `json:"headBlock"`
+	BaseFee   *big.Int `json:"baseFee"`
+
+	Transactions int `json:"transactions"`
+	//transactions whose max fee is below the base fee, they wait for it to drop
+	BelowBaseFee int `json:"belowBaseFee"`
+
+	MaxFee         PriceStats `json:"maxFee"`
+	MaxPriorityFee PriceStats `json:"maxPriorityFee"`
+	//tip the transactions at or above the base fee would pay at it, the lower of their max
+	//priority fee and max fee less the base fee; compares with the tips of the block aggregates
+	EffectiveTip PriceStats `json:"effectiveTip"`
+}
+
+// newMempoolSnapshot computes the fee statistics of txs against the base fee of the head block.
+func newMempoolSnapshot(at time.Time, source MempoolSource, headBlock uint64, baseFee *big.Int, txs []*PendingTransaction) *MempoolSnapshot {
+	snapshot := &MempoolSnapshot{Time: at.UTC(), Source: source, HeadBlock: headBlock, BaseFee: baseFee}
+
+	var fees, maxTips, tips []*big.Int
+	for _, tx := range txs {
+		fee, maxTip := tx.maxFee(), tx.maxTip()
+		//a transaction without fee fields is not a transaction
+		if fee == nil || maxTip == nil {
+			continue
+		}
+		snapshot.Transactions++
+		fees = append(fees, fee)
+		maxTips = append(maxTips, maxTip)
+
+		if baseFee == nil {
+			tips = append(tips, maxTip)
+			continue
+		}
+		if fee.Cmp(baseFee) < 0 {
+			snapshot.BelowBaseFee++
+			continue
+		}
+		tip := new(big.Int).Sub(fee, baseFee)
+		if maxTip.Cmp(tip) < 0 {
+			tip = maxTip
+		}
+		tips = append(tips, tip)
+	}
+	snapshot.MaxFee = priceStats(fees)
+	snapshot.MaxPriorityFee = priceStats(maxTips)
+	snapshot.EffectiveTip = priceStats(tips)
+	return snapshot
+}
+
+// MempoolOptions configures SampleMempool. At least one of Subscriber and Pool is needed.
+type MempoolOptions struct {
+	//head block the bids are compared with
+	Source BlockSource
+	//preferred, every transaction entering the mempool between two snapshots
+	Subscriber PendingSubscriber
+	//read on every snapshot while there is no subscription
+	Pool TxPoolReader
+	//DefaultMempoolInterval when zero
+	Interval time.Duration
+	Retry    RetryPolicy
+
+	Dir    string
+	Format OutputFormat
+}
+
+// MempoolResult summarises a SampleMempool run.
+type MempoolResult struct {
+	Snapshots int
+	//snapshots read from the transaction pool, the others come from the subscription
+	FromTxPool int
+	//intervals the subscription only followed in part, without a working pool to read instead
+	Skipped      int
+	Transactions int
+	//subscriptions started, more than one when it dropped
+	Subscriptions int
+	LastSnapshot  *MempoolSnapshot
+	Duration      time.Duration
+}
+
+// SampleMempool records a MempoolSnapshot every options.Interval until ctx is cancelled. The
+// snapshots come from the pending transactions subscription while it runs for the whole
+// interval, and from the transaction pool otherwise; a dropped subscription is tried again
+// at the next snapshot. Without a transaction pool an interval the subscription only saw
+// part of is skipped, its arrivals would read as a quiet interval. The snapshots are written
+// to one file per UTC day, the file of the current day kept partial until the day is over.
+func SampleMempool(ctx context.Context, options MempoolOptions) (*MempoolResult, error) {
+	result := &MempoolResult{}
+	began := time.Now()
+	errWhenSampling := sampleMempool(ctx, options, result)
+	result.Duration = time.Since(began)
+	return result, errWhenSampling
+}
+
+func sampleMempool(ctx context.Context, options MempoolOptions, result *MempoolResult) error {
+	if options.Subscriber == nil && options.Pool == nil {
+		return errors.New("no pending transactions subscription or transaction pool to read the mempool from")
+	}
+	source := NewRetryingBlockSource(options.Source, options.Retry)
+	interval := options.Interval
+	if interval <= 0 {
+		interval = DefaultMempoolInterval
+	}
+
+	output := &mempoolOutput{dir: options.Dir, format: options.Format}
+	errWhenOpening := output.finishEarlierDays(time.Now())
+	if errWhenOpening != nil {
+		return errWhenOpening
+	}
+	defer output.flush()
+
+	subscriber := options.Subscriber
+	pool := options.Pool
+	var subscription ethereum.Subscription
+	var announced chan *PendingTransaction
+	var subscribedAt time.Time
+	unsubscribe := func() {
+		if subscription != nil {
+			subscription.Unsubscribe()
+			subscription, announced = nil, nil
+		}
+	}
+	defer unsubscribe()
+	subscribe := func() {
+		if subscriber == nil || subscription != nil {
+			return
+		}
+		ch := make(chan *PendingTransaction, 1024)
+		var err error
+		subscription, err = subscriber.SubscribePendingTransactions(ctx, ch)
+		if err != nil {
+			fmt.Println("Error when subscribing to pending transactions : ", err)
+			subscription = nil
+			return
+		}
+		result.Subscriptions++
+		announced, subscribedAt = ch, time.Now()
+	}
+	//receiving from a nil channel blocks, so a missing subscription is never selected
+	subscriptionErr := func() <-chan error {
+		if subscription == nil {
+			return nil
+		}
+		return subscription.Err()
+	}
+
+	subscribe()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	periodStart := time.Now()
+	arrivals := make(map[common.Hash]*PendingTransaction)
+	for {
+		select {
+		case tx := <-announced:
+			arrivals[tx.Hash] = tx
+		case err := <-subscriptionErr():
+			unsubscribe()
+			if errors.Is(err, ErrPendingHashesOnly) {
+				fmt.Println("The node only announces pending transaction hashes, its subscription is not used")
+				subscriber = nil
+			} else {
+				fmt.Println("Error when following pending transactions : ", err)
+			}
+			if subscriber == nil && pool == nil {
+				return fmt.Errorf("following pending transactions: %w", err)
+			}
+		case now := <-ticker.C:
+			//only a subscription that ran for the whole period saw every transaction of it
+			covered := subscription != nil && !subscribedAt.After(periodStart)
+			var txs []*PendingTransaction
+			from, read := MempoolSubscription, false
+			switch {
+			case covered:
+				for _, tx := range arrivals {
+					txs = append(txs, tx)
+				}
+				read = true
+			case pool == nil:
+				fmt.Println("Skipping the mempool snapshot at ", now.UTC().Format(time.RFC3339), ", the subscription only followed part of the interval")
+				result.Skipped++
+			default:
+				var errWhenReading error
+				txs, errWhenReading = readTxPool(ctx, options.Retry, pool)
+				if errors.Is(errWhenReading, ErrTxPoolUnsupported) && subscriber != nil {
+					fmt.Println("Error when reading the transaction pool, following pending transactions only : ", errWhenReading)
+					pool = nil
+					result.Skipped++
+				} else if errWhenReading != nil {
+					return errWhenReading
+				}
+				from, read = MempoolTxPool, pool != nil
+			}
+			arrivals = make(map[common.Hash]*PendingTransaction)
+			//a subscription started again here follows the whole next interval
+			subscribe()
+			periodStart = time.Now()
+			if !read {
+				continue
+			}
+
+			head, errWhenReadingHead := source.HeaderByNumber(ctx, nil)
+			if errWhenReadingHead != nil {
+				return fmt.Errorf("reading the head block: %w", errWhenReadingHead)
+			}
+			snapshot := newMempoolSnapshot(now, from, head.Number.Uint64(), head.BaseFee, txs)
+			errWhenWriting := output.write(snapshot)
+			if errWhenWriting != nil {
+				return fmt.Errorf("writing the mempool snapshot: %w", errWhenWriting)
+			}
+			result.Snapshots++
+			result.Transactions += snapshot.Transactions
+			if from == MempoolTxPool {
+				result.FromTxPool++
+			}
+			result.LastSnapshot = snapshot
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// readTxPool reads the transaction pool with retries; ErrTxPoolUnsupported is not retried.
+func readTxPool(ctx context.Context, policy RetryPolicy, pool TxPoolReader) ([]*PendingTransaction, error) {
+	var txs []*PendingTransaction
+	var unsupported error
+	errWhenReading := policy.Do(ctx, "txpool_content", func() error {
+		var err error
+		txs, err = pool.TxPoolContent(ctx)
+		if errors.Is(err, ErrTxPoolUnsupported) {
+			unsupported = err
+			return nil
+		}
+		return err
+	})
+	if unsupported != nil {
+		return nil, unsupported
+	}
+	return txs, errWhenReading
+}
@@ -0,0 +1,230 @@
+package datacollector
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// parquetMempoolSnapshot is the Parquet schema of MempoolSnapshot, amounts in wei as
+// DECIMAL(38,0) like parquetAggregate.
+type parquetMempoolSnapshot struct {
+	Time                 int64   `parquet:"name=time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Source               *string `parquet:"name=source, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	HeadBlock            int64   `parquet:"name=head_block, type=INT64"`
+	BaseFee              *string `parquet:"name=base_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	Transactions         int32   `parquet:"name=transactions, type=INT32"`
+	BelowBaseFee         int32   `parquet:"name=below_base_fee, type=INT32"`
+	MinMaxFee            *string `parquet:"name=min_max_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P10MaxFee            *string `parquet:"name=p10_max_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P25MaxFee            *string `parquet:"name=p25_max_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MedianMaxFee         *string `parquet:"name=median_max_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MeanMaxFee           *string `parquet:"name=mean_max_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P75MaxFee            *string `parquet:"name=p75_max_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P90MaxFee            *string `parquet:"name=p90_max_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P99MaxFee            *string `parquet:"name=p99_max_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MaxMaxFee            *string `parquet:"name=max_max_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MinMaxPriorityFee    *string `parquet:"name=min_max_priority_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P10MaxPriorityFee    *string `parquet:"name=p10_max_priority_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P25MaxPriorityFee    *string `parquet:"name=p25_max_priority_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MedianMaxPriorityFee *string `parquet:"name=median_max_priority_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MeanMaxPriorityFee   *string `parquet:"name=mean_max_priority_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P75MaxPriorityFee    *string `parquet:"name=p75_max_priority_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P90MaxPriorityFee    *string `parquet:"name=p90_max_priority_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P99MaxPriorityFee    *string `parquet:"name=p99_max_priority_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MaxMaxPriorityFee    *string `parquet:"name=max_max_priority_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MinEffectiveTip      *string `parquet:"name=min_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P10EffectiveTip      *string `parquet:"name=p10_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P25EffectiveTip      *string `parquet:"name=p25_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MedianEffectiveTip   *string `parquet:"name=median_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MeanEffectiveTip     *string `parquet:"name=mean_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P75EffectiveTip      *string `parquet:"name=p75_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P90EffectiveTip      *string `parquet:"name=p90_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P99EffectiveTip      *string `parquet:"name=p99_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MaxEffectiveTip      *string `parquet:"name=max_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+}
+
+func toParquetMempoolSnapshot(s *MempoolSnapshot) *parquetMempoolSnapshot {
+	source := string(s.Source)
+	snapshot := &parquetMempoolSnapshot{
+		Time:         s.Time.UnixMilli(),
+		Source:       &source,
+		HeadBlock:    int64(s.HeadBlock),
+		BaseFee:      toParquetDecimal(s.BaseFee),
+		Transactions: int32(s.Transactions),
+		BelowBaseFee: int32(s.BelowBaseFee),
+	}
+	columns := [][]**string{
+		{&snapshot.MinMaxFee, &snapshot.P10MaxFee, &snapshot.P25MaxFee, &snapshot.MedianMaxFee,
+			&snapshot.MeanMaxFee, &snapshot.P75MaxFee, &snapshot.P90MaxFee, &snapshot.P99MaxFee, &snapshot.MaxMaxFee},
+		{&snapshot.MinMaxPriorityFee, &snapshot.P10MaxPriorityFee, &snapshot.P25MaxPriorityFee, &snapshot.MedianMaxPriorityFee,
+			&snapshot.MeanMaxPriorityFee, &snapshot.P75MaxPriorityFee, &snapshot.P90MaxPriorityFee, &snapshot.P99MaxPriorityFee, &snapshot.MaxMaxPriorityFee},
+		{&snapshot.MinEffectiveTip, &snapshot.P10EffectiveTip, &snapshot.P25EffectiveTip, &snapshot.MedianEffectiveTip,
+			&snapshot.MeanEffectiveTip, &snapshot.P75EffectiveTip, &snapshot.P90EffectiveTip, &snapshot.P99EffectiveTip, &snapshot.MaxEffectiveTip},
+	}
+	for i, stats := range []PriceStats{s.MaxFee, s.MaxPriorityFee, s.EffectiveTip} {
+		for j, value := range priceStatsValues(stats) {
+			*columns[i][j] = toParquetDecimal(value)
+		}
+	}
+	return snapshot
+}
+
+// mempoolStatNames name the statistics in priceStatsValues order.
+var mempoolStatNames = []string{"Min", "P10", "P25", "Median", "Mean", "P75", "P90", "P99", "Max"}
+
+// writeMempoolSnapshots writes snapshots to w in format; csv amounts are in Gwei.
+func writeMempoolSnapshots(w io.Writer, format OutputFormat, snapshots []*MempoolSnapshot) error {
+	switch format {
+	case FormatCSV, "":
+		header := []string{"Time", "Source", "Head Block", "Base Fee(Gwei)", "Transactions", "Below Base Fee"}
+		for _, amount := range []string{"Max Fee", "Max Priority Fee", "Effective Tip"} {
+			for _, stat := range mempoolStatNames {
+				header = append(header, stat+" "+amount+"(Gwei)")
+			}
+		}
+
+		csvWriter := csv.NewWriter(w)
+		errWhenWriting := csvWriter.Write(header)
+		for _, snapshot := range snapshots {
+			if errWhenWriting != nil {
+				return errWhenWriting
+			}
+			row := []string{snapshot.Time.UTC().Format(gasTimestampFormat), string(snapshot.Source),
+				strconv.FormatUint(snapshot.HeadBlock, 10), bigToGwei(snapshot.BaseFee),
+				strconv.Itoa(snapshot.Transactions), strconv.Itoa(snapshot.BelowBaseFee)}
+			for _, stats := range []PriceStats{snapshot.MaxFee, snapshot.MaxPriorityFee, snapshot.EffectiveTip} {
+				for _, value := range priceStatsValues(stats) {
+					row = append(row, bigToGwei(value))
+				}
+			}
+			errWhenWriting = csvWriter.Write(row)
+		}
+		csvWriter.Flush()
+		if errWhenWriting != nil {
+			return errWhenWriting
+		}
+		return csvWriter.Error()
+	case FormatJSONL:
+		buffered := bufio.NewWriter(w)
+		encoder := json.NewEncoder(buffered)
+		for _, snapshot := range snapshots {
+			errWhenWriting := encoder.Encode(snapshot)
+			if errWhenWriting != nil {
+				return errWhenWriting
+			}
+		}
+		return buffered.Flush()
+	case FormatParquet:
+		parquetWriter, err := writer.NewParquetWriterFromWriter(w, new(parquetMempoolSnapshot), 1)
+		if err != nil {
+			return err
+		}
+		for _, snapshot := range snapshots {
+			err = parquetWriter.Write(toParquetMempoolSnapshot(snapshot))
+			if err != nil {
+				return err
+			}
+		}
+		return parquetWriter.WriteStop()
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// mempoolOutput writes the mempool snapshots to one mempool_<date> file per UTC day. The
+// file of the current day is a stagedFile, only written in its format once the day is over,
+// like the consolidated sample files.
+type mempoolOutput struct {
+	dir    string
+	format OutputFormat
+
+	name string
+	file *stagedFile[MempoolSnapshot]
+}
+
+func (o *mempoolOutput) fileName(at time.Time) string {
+	return "mempool_" + at.UTC().Format("2006-01-02") + o.format.Extension()
+}
+
+// finishEarlierDays writes the files of the days before now that a stopped run left partial.
+func (o *mempoolOutput) finishEarlierDays(now time.Time) error {
+	errWhenCreatingDir := os.MkdirAll(o.dir, 0755)
+	if errWhenCreatingDir != nil {
+		return errWhenCreatingDir
+	}
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), partialSuffix)
+		if entry.IsDir() || name == entry.Name() || !strings.HasPrefix(name, "mempool_") || name >= o.fileName(now) {
+			continue
+		}
+		file, err := openStagedFile[MempoolSnapshot](filepath.Join(o.dir, name), nil, nil)
+		if err != nil {
+			return err
+		}
+		err = file.Finish(o.encoder(formatOf(name)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *mempoolOutput) write(snapshot *MempoolSnapshot) error {
+	name := o.fileName(snapshot.Time)
+	if name != o.name {
+		errWhenClosing := o.closeFile()
+		if errWhenClosing != nil {
+			return errWhenClosing
+		}
+		//continues the partial file of a stopped run on the same day
+		file, errWhenOpening := openStagedFile[MempoolSnapshot](filepath.Join(o.dir, name), nil, nil)
+		if errWhenOpening != nil {
+			return errWhenOpening
+		}
+		o.name, o.file = name, file
+	}
+	return o.file.Append(snapshot)
+}
+
+// encoder writes the snapshots of a finished file in format.
+func (o *mempoolOutput) encoder(format OutputFormat) func(w io.Writer, snapshots []*MempoolSnapshot) error {
+	return func(w io.Writer, snapshots []*MempoolSnapshot) error {
+		return writeMempoolSnapshots(w, format, snapshots)
+	}
+}
+
+// closeFile writes the current file in its format and removes its partial file.
+func (o *mempoolOutput) closeFile() error {
+	if o.file == nil {
+		return nil
+	}
+	file := o.file
+	o.file, o.name = nil, ""
+	return file.Finish(o.encoder(o.format))
+}
+
+// flush closes the partial file of the current day, which the next run continues.
+func (o *mempoolOutput) flush() {
+	if o.file == nil {
+		return
+	}
+	errWhenClosing := o.file.Close()
+	if errWhenClosing != nil {
+		fmt.Println("Error when closing the mempool file : ", errWhenClosing)
+	}
+	o.file, o.name = nil, ""
+}
@@ -0,0 +1,74 @@
+package datacollector
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// csvRows returns the number of rows of a finished csv file, without its header.
+func csvRows(t *testing.T, path string) int {
+	t.Helper()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(strings.Split(strings.TrimSpace(string(content)), "\n")) - 1
+}
+
+func TestMempoolOutputDays(t *testing.T) {
+	dir := t.TempDir()
+	lastMinute := time.Date(2024, 3, 1, 23, 59, 0, 0, time.UTC)
+	snapshot := func(at time.Time) *MempoolSnapshot {
+		return newMempoolSnapshot(at, MempoolSubscription, 10, nil, []*PendingTransaction{pendingTx(1, 150, 10)})
+	}
+	firstDay := filepath.Join(dir, "mempool_2024-03-01.csv")
+	secondDay := filepath.Join(dir, "mempool_2024-03-02.csv")
+
+	output := &mempoolOutput{dir: dir, format: FormatCSV}
+	for _, at := range []time.Time{lastMinute, lastMinute.Add(30 * time.Second), lastMinute.Add(time.Minute)} {
+		err := output.write(snapshot(at))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the day that is over is finished, the current one stays partial
+	if rows := csvRows(t, firstDay); rows != 2 {
+		t.Fatalf("%d rows for the first day, want 2", rows)
+	}
+	if _, err := os.Stat(firstDay + partialSuffix); !os.IsNotExist(err) {
+		t.Fatalf("partial file of the first day left: %v", err)
+	}
+	output.flush()
+	if _, err := os.Stat(secondDay); !os.IsNotExist(err) {
+		t.Fatalf("second day finished before it is over: %v", err)
+	}
+
+	//a later run on the same day continues the partial file
+	output = &mempoolOutput{dir: dir, format: FormatCSV}
+	err := output.finishEarlierDays(lastMinute.Add(2 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = output.write(snapshot(lastMinute.Add(2 * time.Minute)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output.flush()
+
+	//and the first run of a later day finishes it
+	output = &mempoolOutput{dir: dir, format: FormatCSV}
+	err = output.finishEarlierDays(lastMinute.Add(25 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := csvRows(t, secondDay); rows != 2 {
+		t.Fatalf("%d rows for the second day, want 2", rows)
+	}
+	if _, err := os.Stat(secondDay + partialSuffix); !os.IsNotExist(err) {
+		t.Fatalf("partial file of the second day left: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package datacollector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// pendingTx is a pending dynamic fee transaction, or a legacy one when tip is negative.
+func pendingTx(hash int64, maxFee int64, tip int64) *PendingTransaction {
+	tx := &PendingTransaction{Hash: common.BigToHash(big.NewInt(hash)), Type: types.DynamicFeeTxType,
+		MaxFeePerGas: big.NewInt(maxFee), MaxPriorityFeePerGas: big.NewInt(tip)}
+	if tip < 0 {
+		tx = &PendingTransaction{Hash: tx.Hash, Type: types.LegacyTxType, GasPrice: big.NewInt(maxFee)}
+	}
+	return tx
+}
+
+func TestNewMempoolSnapshot(t *testing.T) {
+	txs := []*PendingTransaction{
+		pendingTx(1, 150, 10),
+		//pays the base fee and only part of its tip
+		pendingTx(2, 105, 10),
+		//below the base fee
+		pendingTx(3, 90, 5),
+		//legacy, all above the base fee is tip
+		pendingTx(4, 120, -1),
+		//no fee fields
+		{Hash: common.HexToHash("0x5")},
+	}
+
+	tests := []struct {
+		name             string
+		baseFee          *big.Int
+		wantBelow        int
+		wantMinTip       int64
+		wantMaxTip       int64
+		wantTransactions int
+	}{
+		{"against the base fee", big.NewInt(100), 1, 5, 20, 4},
+		//the max priority fees, when the head has no base fee
+		{"without base fee", nil, 0, 5, 120, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			snapshot := newMempoolSnapshot(time.Unix(1700000000, 0), MempoolTxPool, 10, test.baseFee, txs)
+			if snapshot.Transactions != test.wantTransactions || snapshot.BelowBaseFee != test.wantBelow {
+				t.Fatalf("%d transactions, %d below the base fee, want %d and %d", snapshot.Transactions, snapshot.BelowBaseFee,
+					test.wantTransactions, test.wantBelow)
+			}
+			if snapshot.MaxFee.Min.Int64() != 90 || snapshot.MaxFee.Max.Int64() != 150 {
+				t.Fatalf("max fees %s to %s, want 90 to 150", snapshot.MaxFee.Min, snapshot.MaxFee.Max)
+			}
+			if snapshot.EffectiveTip.Min.Int64() != test.wantMinTip || snapshot.EffectiveTip.Max.Int64() != test.wantMaxTip {
+				t.Fatalf("tips %s to %s, want %d to %d", snapshot.EffectiveTip.Min, snapshot.EffectiveTip.Max, test.wantMinTip, test.wantMaxTip)
+			}
+		})
+	}
+}
+
+func TestPendingTransactionHashOnly(t *testing.T) {
+	var tx PendingTransaction
+	err := json.Unmarshal([]byte(`"0x0000000000000000000000000000000000000000000000000000000000000001"`), &tx)
+	if !errors.Is(err, ErrPendingHashesOnly) {
+		t.Fatalf("got %v, want ErrPendingHashesOnly", err)
+	}
+	err = json.Unmarshal([]byte(`{"hash":"0x0000000000000000000000000000000000000000000000000000000000000001","type":"0x2","maxFeePerGas":"0x64","maxPriorityFeePerGas":"0xa"}`), &tx)
+	if err != nil || tx.Type != 2 || tx.maxFee().Int64() != 100 || tx.maxTip().Int64() != 10 {
+		t.Fatalf("decoded %+v, %v", tx, err)
+	}
+}
+
+// snapshotHead is a BlockSource of the head header, which cancels the sampling once it was
+// read for the given number of snapshots.
+type snapshotHead struct {
+	BlockSource
+	mu        sync.Mutex
+	snapshots int
+	cancel    context.CancelFunc
+}
+
+func (s *snapshotHead) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots--
+	if s.snapshots <= 0 {
+		s.cancel()
+	}
+	return &types.Header{Number: big.NewInt(100), BaseFee: big.NewInt(100)}, nil
+}
+
+// testPendingSubscriber announces three transactions on every subscription. The first
+// subscriptions listed in drops end right away with their error.
+type testPendingSubscriber struct {
+	drops         []error
+	subscriptions int
+}
+
+func (s *testPendingSubscriber) SubscribePendingTransactions(ctx context.Context, ch chan<- *PendingTransaction) (ethereum.Subscription, error) {
+	s.subscriptions++
+	subscription := &testSubscription{errs: make(chan error, 1)}
+	for i := int64(0); i < 3; i++ {
+		ch <- pendingTx(int64(s.subscriptions)*10+i, 150, 10)
+	}
+	if s.subscriptions <= len(s.drops) {
+		subscription.errs <- s.drops[s.subscriptions-1]
+	}
+	return subscription, nil
+}
+
+// testTxPool holds two pending transactions.
+type testTxPool struct {
+	err error
+}
+
+func (p testTxPool) TxPoolContent(ctx context.Context) ([]*PendingTransaction, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return []*PendingTransaction{pendingTx(1, 150, 10), pendingTx(2, 90, -1)}, nil
+}
+
+func TestSampleMempool(t *testing.T) {
+	dropped := errors.New("websocket: close 1006")
+	tests := []struct {
+		name       string
+		subscriber *testPendingSubscriber
+		pool       TxPoolReader
+		//snapshots written before the sampling is stopped
+		snapshots int
+		want      MempoolResult
+		wantErr   bool
+	}{
+		{
+			name:       "subscription",
+			subscriber: &testPendingSubscriber{},
+			snapshots:  2,
+			want:       MempoolResult{Snapshots: 2, Transactions: 3, Subscriptions: 1},
+		},
+		{
+			//the interval of the drop is only partly seen, the next one from the new subscription
+			name:       "dropped subscription without pool",
+			subscriber: &testPendingSubscriber{drops: []error{dropped}},
+			snapshots:  1,
+			want:       MempoolResult{Snapshots: 1, Skipped: 1, Transactions: 3, Subscriptions: 2},
+		},
+		{
+			name:       "dropped subscription with pool",
+			subscriber: &testPendingSubscriber{drops: []error{dropped}},
+			pool:       testTxPool{},
+			snapshots:  2,
+			want:       MempoolResult{Snapshots: 2, FromTxPool: 1, Transactions: 5, Subscriptions: 2},
+		},
+		{
+			name:      "pool only",
+			pool:      testTxPool{},
+			snapshots: 2,
+			want:      MempoolResult{Snapshots: 2, FromTxPool: 2, Transactions: 4},
+		},
+		{
+			name:       "hashes only with pool",
+			subscriber: &testPendingSubscriber{drops: []error{ErrPendingHashesOnly}},
+			pool:       testTxPool{},
+			snapshots:  2,
+			want:       MempoolResult{Snapshots: 2, FromTxPool: 2, Transactions: 4, Subscriptions: 1},
+		},
+		{
+			name:       "hashes only without pool",
+			subscriber: &testPendingSubscriber{drops: []error{ErrPendingHashesOnly}},
+			want:       MempoolResult{Subscriptions: 1},
+			wantErr:    true,
+		},
+		{
+			name:       "pool unsupported",
+			subscriber: &testPendingSubscriber{drops: []error{dropped}},
+			pool:       testTxPool{err: ErrTxPoolUnsupported},
+			snapshots:  1,
+			want:       MempoolResult{Snapshots: 1, Skipped: 1, Transactions: 3, Subscriptions: 2},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			options := MempoolOptions{Source: &snapshotHead{snapshots: test.snapshots, cancel: cancel}, Pool: test.pool,
+				Interval: 20 * time.Millisecond, Retry: RetryPolicy{MaxAttempts: 1}, Dir: t.TempDir(), Format: FormatCSV}
+			if test.subscriber != nil {
+				options.Subscriber = test.subscriber
+			}
+
+			result, err := SampleMempool(ctx, options)
+			if test.wantErr {
+				if err == nil || errors.Is(err, context.Canceled) {
+					t.Fatalf("got %v, want the subscription error", err)
+				}
+			} else if !errors.Is(err, context.Canceled) {
+				t.Fatalf("got %v, want the sampling stopped after %d snapshots", err, test.snapshots)
+			}
+			if result.Snapshots != test.want.Snapshots || result.FromTxPool != test.want.FromTxPool || result.Skipped != test.want.Skipped ||
+				result.Transactions != test.want.Transactions || result.Subscriptions != test.want.Subscriptions {
+				t.Fatalf("got %d snapshots, %d from the pool, %d skipped, %d transactions and %d subscriptions, want %+v",
+					result.Snapshots, result.FromTxPool, result.Skipped, result.Transactions, result.Subscriptions, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+-- Tables of the postgres output format. {samples}, {blocks} and {checkpoints} are replaced
+-- by the configured table names. Amounts are wei.
+
+CREATE TABLE IF NOT EXISTS {blocks} (
+	number                     bigint NOT NULL,
+	timestamp                  timestamptz NOT NULL,
+	transactions_sampled       integer NOT NULL,
+	transactions_skipped       integer NOT NULL,
+	base_fee                   numeric(78, 0),
+	min_effective_gas_price    numeric(78, 0),
+	max_effective_gas_price    numeric(78, 0),
+	mean_effective_gas_price   numeric(78, 0),
+	median_effective_gas_price numeric(78, 0),
+	min_effective_tip          numeric(78, 0),
+	max_effective_tip          numeric(78, 0),
+	mean_effective_tip         numeric(78, 0),
+	median_effective_tip       numeric(78, 0),
+	collected_at               timestamptz NOT NULL,
+	-- TimescaleDB needs the time column in every unique index
+	PRIMARY KEY (number, timestamp)
+);
+
+CREATE TABLE IF NOT EXISTS {samples} (
+	hash                     text NOT NULL,
+	block                    bigint NOT NULL,
+	timestamp                timestamptz NOT NULL,
+	from_address             text NOT NULL,
+	to_address               text,
+	type                     smallint NOT NULL,
+	value                    numeric(78, 0),
+	gas_price                numeric(78, 0),
+	base_fee                 numeric(78, 0),
+	max_fee_per_gas          numeric(78, 0),
+	max_priority_fee_per_gas numeric(78, 0),
+	effective_gas_price      numeric(78, 0),
+	effective_tip            numeric(78, 0),
+	gas_used                 bigint NOT NULL,
+	input_length             integer NOT NULL,
+	-- TimescaleDB needs the time column in every unique index; the store deletes the rows of a
+	-- hash before writing it again, so a transaction moved by a reorg is stored once
+	PRIMARY KEY (hash, timestamp)
+);
+CREATE INDEX ON {samples} (block);
+
+CREATE TABLE IF NOT EXISTS {checkpoints} (
+	job         text PRIMARY KEY,
+	start_block bigint NOT NULL,
+	end_block   bigint NOT NULL,
+	next_block  bigint NOT NULL,
+	updated_at  timestamptz NOT NULL
+);
@@ -0,0 +1,17 @@
+-- Percentiles, gas used and gas limit of the per-block aggregates. Rows written before have
+-- them null.
+
+ALTER TABLE {blocks}
+	ADD COLUMN IF NOT EXISTS transactions_aggregated integer,
+	ADD COLUMN IF NOT EXISTS gas_used                bigint,
+	ADD COLUMN IF NOT EXISTS gas_limit               bigint,
+	ADD COLUMN IF NOT EXISTS p10_effective_gas_price numeric(78, 0),
+	ADD COLUMN IF NOT EXISTS p25_effective_gas_price numeric(78, 0),
+	ADD COLUMN IF NOT EXISTS p75_effective_gas_price numeric(78, 0),
+	ADD COLUMN IF NOT EXISTS p90_effective_gas_price numeric(78, 0),
+	ADD COLUMN IF NOT EXISTS p99_effective_gas_price numeric(78, 0),
+	ADD COLUMN IF NOT EXISTS p10_effective_tip       numeric(78, 0),
+	ADD COLUMN IF NOT EXISTS p25_effective_tip       numeric(78, 0),
+	ADD COLUMN IF NOT EXISTS p75_effective_tip       numeric(78, 0),
+	ADD COLUMN IF NOT EXISTS p90_effective_tip       numeric(78, 0),
+	ADD COLUMN IF NOT EXISTS p99_effective_tip       numeric(78, 0);
@@ -0,0 +1,10 @@
+-- Sampler and seed of every block sample and the job seed of every checkpoint. Rows written
+-- before have them null.
+
+ALTER TABLE {blocks}
+	ADD COLUMN IF NOT EXISTS sampler     text,
+	ADD COLUMN IF NOT EXISTS sample_seed bigint;
+
+ALTER TABLE {checkpoints}
+	ADD COLUMN IF NOT EXISTS sampler     text,
+	ADD COLUMN IF NOT EXISTS sample_seed bigint;
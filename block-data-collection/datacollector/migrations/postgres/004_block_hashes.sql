@@ -0,0 +1,6 @@
+-- Hashes of every collected block and its parent, to detect reorgs. Rows written before
+-- have them null.
+
+ALTER TABLE {blocks}
+	ADD COLUMN IF NOT EXISTS hash        text,
+	ADD COLUMN IF NOT EXISTS parent_hash text;
@@ -0,0 +1,10 @@
+-- Sample size and price strata of every block sample and checkpoint, next to the sampler and
+-- seed. Rows written before have them null.
+
+ALTER TABLE {blocks}
+	ADD COLUMN IF NOT EXISTS sample_size  integer,
+	ADD COLUMN IF NOT EXISTS price_strata integer;
+
+ALTER TABLE {checkpoints}
+	ADD COLUMN IF NOT EXISTS sample_size  integer,
+	ADD COLUMN IF NOT EXISTS price_strata integer;
@@ -0,0 +1,188 @@
+package datacollector
+
+import (
+	"io"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/types"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// parquetRecord is the Parquet schema of TransactionRecord. Amounts are wei as DECIMAL(38,0),
+// which holds any realistic value and is read exactly by Spark.
+type parquetRecord struct {
+	Block                int64   `parquet:"name=block, type=INT64"`
+	Timestamp            int64   `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Hash                 string  `parquet:"name=hash, type=BYTE_ARRAY, convertedtype=UTF8"`
+	From                 string  `parquet:"name=from, type=BYTE_ARRAY, convertedtype=UTF8"`
+	To                   *string `parquet:"name=to, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Type                 int32   `parquet:"name=type, type=INT32"`
+	Value                *string `parquet:"name=value, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	GasPrice             *string `parquet:"name=gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	BaseFee              *string `parquet:"name=base_fee, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MaxFeePerGas         *string `parquet:"name=max_fee_per_gas, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MaxPriorityFeePerGas *string `parquet:"name=max_priority_fee_per_gas, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	EffectiveGasPrice    *string `parquet:"name=effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	EffectiveTip         *string `parquet:"name=effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	GasUsed              int64   `parquet:"name=gas_used, type=INT64"`
+	InputLength          int32   `parquet:"name=input_length, type=INT32"`
+}
+
+// parquetSink writes the records as one Parquet file. Row groups are cut when the writer's
+// buffer fills; a Parquet file cannot be read before its footer is written by Close, so
+// Flush does nothing.
+type parquetSink struct {
+	writer *writer.ParquetWriter
+}
+
+func (s *parquetSink) Open(w io.Writer) error {
+	parquetWriter, err := writer.NewParquetWriterFromWriter(w, new(parquetRecord), 1)
+	if err != nil {
+		return err
+	}
+	s.writer = parquetWriter
+	return nil
+}
+
+func (s *parquetSink) Write(record *TransactionRecord) error {
+	return s.writer.Write(toParquetRecord(record))
+}
+
+func (s *parquetSink) Flush() error {
+	return nil
+}
+
+func (s *parquetSink) Close() error {
+	return s.writer.WriteStop()
+}
+
+func toParquetRecord(r *TransactionRecord) parquetRecord {
+	record := parquetRecord{
+		Block:                int64(r.Block),
+		Timestamp:            r.Timestamp.UnixMilli(),
+		Hash:                 r.Hash.Hex(),
+		From:                 r.From.Hex(),
+		Type:                 int32(r.Type),
+		Value:                toParquetDecimal(r.Value),
+		GasPrice:             toParquetDecimal(r.GasPrice),
+		BaseFee:              toParquetDecimal(r.BaseFee),
+		MaxFeePerGas:         toParquetDecimal(r.MaxFeePerGas),
+		MaxPriorityFeePerGas: toParquetDecimal(r.MaxPriorityFeePerGas),
+		EffectiveGasPrice:    toParquetDecimal(r.EffectiveGasPrice),
+		EffectiveTip:         toParquetDecimal(r.EffectiveTip),
+		GasUsed:              int64(r.GasUsed),
+		InputLength:          int32(r.InputLength),
+	}
+	if r.To != nil {
+		to := r.To.Hex()
+		record.To = &to
+	}
+	return record
+}
+
+func fromParquetRecord(r *parquetRecord) *TransactionRecord {
+	record := &TransactionRecord{
+		Block:                uint64(r.Block),
+		Timestamp:            time.UnixMilli(r.Timestamp).UTC(),
+		Hash:                 common.HexToHash(r.Hash),
+		From:                 common.HexToAddress(r.From),
+		Type:                 uint8(r.Type),
+		Value:                fromParquetDecimal(r.Value),
+		GasPrice:             fromParquetDecimal(r.GasPrice),
+		BaseFee:              fromParquetDecimal(r.BaseFee),
+		MaxFeePerGas:         fromParquetDecimal(r.MaxFeePerGas),
+		MaxPriorityFeePerGas: fromParquetDecimal(r.MaxPriorityFeePerGas),
+		EffectiveGasPrice:    fromParquetDecimal(r.EffectiveGasPrice),
+		EffectiveTip:         fromParquetDecimal(r.EffectiveTip),
+		GasUsed:              uint64(r.GasUsed),
+		InputLength:          int(r.InputLength),
+	}
+	if r.To != nil {
+		to := common.HexToAddress(*r.To)
+		record.To = &to
+	}
+	return record
+}
+
+// toParquetDecimal encodes an amount as the big endian two's complement bytes of a decimal.
+func toParquetDecimal(value *big.Int) *string {
+	if value == nil {
+		return nil
+	}
+	encoded := types.StrIntToBinary(value.String(), "BigEndian", 0, true)
+	return &encoded
+}
+
+func fromParquetDecimal(encoded *string) *big.Int {
+	if encoded == nil {
+		return nil
+	}
+	value := new(big.Int).SetBytes([]byte(*encoded))
+	//negative amounts do not occur, but decode them correctly anyway
+	if len(*encoded) > 0 && (*encoded)[0]&0x80 != 0 {
+		value.Sub(value, new(big.Int).Lsh(big.NewInt(1), uint(8*len(*encoded))))
+	}
+	return value
+}
+
+// readParquetRecords reads a file written by parquetSink.
+func readParquetRecords(path string) ([]*TransactionRecord, error) {
+	file, err := openParquetFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	parquetReader, err := reader.NewParquetReader(file, new(parquetRecord), 1)
+	if err != nil {
+		return nil, err
+	}
+	defer parquetReader.ReadStop()
+
+	rows := make([]parquetRecord, parquetReader.GetNumRows())
+	if len(rows) > 0 {
+		err = parquetReader.Read(&rows)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	records := make([]*TransactionRecord, len(rows))
+	for i := range rows {
+		records[i] = fromParquetRecord(&rows[i])
+	}
+	return records, nil
+}
+
+// parquetFile lets the Parquet reader open a local file; it is only used for reading.
+type parquetFile struct {
+	*os.File
+}
+
+func openParquetFile(path string) (source.ParquetFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return parquetFile{file}, nil
+}
+
+func (f parquetFile) Open(name string) (source.ParquetFile, error) {
+	if name == "" {
+		name = f.Name()
+	}
+	return openParquetFile(name)
+}
+
+func (f parquetFile) Create(name string) (source.ParquetFile, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return parquetFile{file}, nil
+}
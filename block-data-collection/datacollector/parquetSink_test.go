@@ -0,0 +1,102 @@
+package datacollector
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// equalWei compares two optional amounts.
+func equalWei(a *big.Int, b *big.Int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Cmp(b) == 0
+}
+
+func TestParquetSinkRoundTrip(t *testing.T) {
+	to := common.HexToAddress("0x2")
+	//2^70 + 5, above the uint64 range
+	large := new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), 70), big.NewInt(5))
+	timestamp := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		records []*TransactionRecord
+	}{
+		{"no records", nil},
+		{"records", []*TransactionRecord{
+			{Block: 17000000, Timestamp: timestamp, Hash: common.HexToHash("0x1"), From: common.HexToAddress("0x1"), To: &to, Type: 2,
+				Value: large, GasPrice: big.NewInt(30000000000), BaseFee: big.NewInt(25000000000), MaxFeePerGas: big.NewInt(40000000000),
+				MaxPriorityFeePerGas: big.NewInt(2000000000), EffectiveGasPrice: big.NewInt(27000000000), EffectiveTip: big.NewInt(2000000000),
+				GasUsed: 21000, InputLength: 0},
+			//a contract creation has no recipient, a legacy transaction no fee caps
+			{Block: 17000000, Timestamp: timestamp, Hash: common.HexToHash("0x2"), From: common.HexToAddress("0x3"), Type: 0,
+				Value: big.NewInt(0), GasPrice: large, EffectiveGasPrice: large, EffectiveTip: new(big.Int).Sub(large, big.NewInt(1)),
+				GasUsed: 1500000, InputLength: 4096},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "gas_2024-01-01.parquet")
+			file, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink, err := newSink(FormatParquet, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = sink.Open(file); err != nil {
+				t.Fatal(err)
+			}
+			for _, record := range test.records {
+				if err = sink.Write(record); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+			file.Close()
+
+			read, err := readParquetRecords(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(read) != len(test.records) {
+				t.Fatalf("read %d records, want %d", len(read), len(test.records))
+			}
+			for i, want := range test.records {
+				got := read[i]
+				if got.Block != want.Block || !got.Timestamp.Equal(want.Timestamp) || got.Hash != want.Hash || got.From != want.From ||
+					got.Type != want.Type || got.GasUsed != want.GasUsed || got.InputLength != want.InputLength {
+					t.Fatalf("record %d: read %+v, want %+v", i, got, want)
+				}
+				if (got.To == nil) != (want.To == nil) || got.To != nil && *got.To != *want.To {
+					t.Fatalf("record %d: read recipient %v, want %v", i, got.To, want.To)
+				}
+				for _, amount := range []struct {
+					name      string
+					got, want *big.Int
+				}{
+					{"value", got.Value, want.Value},
+					{"gas price", got.GasPrice, want.GasPrice},
+					{"base fee", got.BaseFee, want.BaseFee},
+					{"max fee per gas", got.MaxFeePerGas, want.MaxFeePerGas},
+					{"max priority fee per gas", got.MaxPriorityFeePerGas, want.MaxPriorityFeePerGas},
+					{"effective gas price", got.EffectiveGasPrice, want.EffectiveGasPrice},
+					{"effective tip", got.EffectiveTip, want.EffectiveTip},
+				} {
+					if !equalWei(amount.got, amount.want) {
+						t.Fatalf("record %d: read %s %v, want %v", i, amount.name, amount.got, amount.want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,563 @@
+package datacollector
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"math/big"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lib/pq"
+)
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+// postgresMigrationsTable records the migrations applied to each set of tables
+const postgresMigrationsTable = "gas_schema_migrations"
+
+// DefaultPostgresBatchBlocks is the number of blocks written per COPY when none is set.
+const DefaultPostgresBatchBlocks = 100
+
+// postgresTableName is a table name, optionally qualified by its schema
+var postgresTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// ValidPostgresTableName reports whether name can be used as a table of the postgres format.
+func ValidPostgresTableName(name string) bool {
+	return postgresTableName.MatchString(name)
+}
+
+// PostgresOptions configures a PostgresStore.
+type PostgresOptions struct {
+	Url string
+	//table names, optionally schema qualified
+	SamplesTable     string
+	BlocksTable      string
+	CheckpointsTable string
+	//blocks collected before they are written with one COPY, DefaultPostgresBatchBlocks when zero
+	BatchBlocks int
+	//turn the samples and blocks tables into TimescaleDB hypertables on the timestamp column
+	Timescale bool
+}
+
+// PostgresStore writes the gas samples and the per-block aggregates to PostgreSQL or
+// TimescaleDB. Blocks are collected in batches and written with COPY into temporary tables,
+// from which they are upserted, so a sample written again replaces the previous one instead
+// of failing on its transaction hash. It is also a CheckpointStore: a checkpoint saved while
+// blocks are waiting is written in the same transaction as those blocks, so the checkpoint
+// never gets ahead of the data.
+type PostgresStore struct {
+	db      *sql.DB
+	options PostgresOptions
+
+	mu          sync.Mutex
+	pending     []*BlockSamples
+	checkpoints map[string]Checkpoint
+}
+
+// OpenPostgresStore connects to the database and applies the migrations it has not seen yet.
+func OpenPostgresStore(options PostgresOptions) (*PostgresStore, error) {
+	for _, table := range []string{options.SamplesTable, options.BlocksTable, options.CheckpointsTable} {
+		if !ValidPostgresTableName(table) {
+			return nil, fmt.Errorf("invalid table name %q", table)
+		}
+	}
+	if options.BatchBlocks < 1 {
+		options.BatchBlocks = DefaultPostgresBatchBlocks
+	}
+
+	db, err := sql.Open("postgres", options.Url)
+	if err != nil {
+		return nil, err
+	}
+	store := &PostgresStore{db: db, options: options, checkpoints: make(map[string]Checkpoint)}
+
+	err = store.migrate()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating the database: %w", err)
+	}
+	return store, nil
+}
+
+// migrate applies the embedded migrations in version order, each in its own transaction.
+func (s *PostgresStore) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS ` + postgresMigrationsTable + ` (
+		version    integer NOT NULL,
+		tables     text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY (version, tables)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	names, err := postgresMigrations.ReadDir("migrations/postgres")
+	if err != nil {
+		return err
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].Name() < names[j].Name() })
+
+	tables := s.options.SamplesTable + "," + s.options.BlocksTable + "," + s.options.CheckpointsTable
+	replacer := strings.NewReplacer("{samples}", s.options.SamplesTable, "{blocks}", s.options.BlocksTable, "{checkpoints}", s.options.CheckpointsTable)
+	for _, entry := range names {
+		version, err := strconv.Atoi(strings.SplitN(entry.Name(), "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("migration %s has no version: %w", entry.Name(), err)
+		}
+		content, err := postgresMigrations.ReadFile(path.Join("migrations/postgres", entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		err = s.applyMigration(version, tables, replacer.Replace(string(content)))
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+	}
+
+	if s.options.Timescale {
+		for _, table := range []string{s.options.SamplesTable, s.options.BlocksTable} {
+			_, err = s.db.Exec(`SELECT create_hypertable($1, 'timestamp', if_not_exists => TRUE, migrate_data => TRUE)`, table)
+			if err != nil {
+				return fmt.Errorf("creating the hypertable %s: %w", table, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *PostgresStore) applyMigration(version int, tables string, statements string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	//collectors starting at the same time apply each migration once
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, postgresMigrationsTable)
+	if err != nil {
+		return err
+	}
+	var applied bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM `+postgresMigrationsTable+` WHERE version = $1 AND tables = $2)`, version, tables).Scan(&applied)
+	if err != nil || applied {
+		return err
+	}
+
+	_, err = tx.Exec(statements)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO `+postgresMigrationsTable+` (version, tables) VALUES ($1, $2)`, version, tables)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close writes the waiting blocks and closes the connection.
+func (s *PostgresStore) Close() error {
+	errWhenFlushing := s.Flush()
+	if errWhenClosing := s.db.Close(); errWhenFlushing == nil {
+		errWhenFlushing = errWhenClosing
+	}
+	return errWhenFlushing
+}
+
+func (s *PostgresStore) WriteBlock(block *BlockSamples) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	//a block written again before the batch is written replaces the waiting one, the upsert
+	//would otherwise keep either of them and the samples of both
+	for i, waiting := range s.pending {
+		if waiting.Number == block.Number {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			break
+		}
+	}
+	s.pending = append(s.pending, block)
+	if len(s.pending) < s.options.BatchBlocks {
+		return nil
+	}
+	return s.flush()
+}
+
+// Flush writes the waiting blocks and checkpoints.
+func (s *PostgresStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flush()
+}
+
+var postgresBlockColumns = []string{"number", "timestamp", "hash", "parent_hash", "transactions_sampled", "transactions_skipped",
+	"sampler", "sample_seed", "sample_size", "price_strata", "transactions_aggregated", "base_fee", "gas_used", "gas_limit",
+	"min_effective_gas_price", "p10_effective_gas_price", "p25_effective_gas_price", "median_effective_gas_price",
+	"mean_effective_gas_price", "p75_effective_gas_price", "p90_effective_gas_price", "p99_effective_gas_price",
+	"max_effective_gas_price",
+	"min_effective_tip", "p10_effective_tip", "p25_effective_tip", "median_effective_tip", "mean_effective_tip",
+	"p75_effective_tip", "p90_effective_tip", "p99_effective_tip", "max_effective_tip", "collected_at"}
+
+var postgresSampleColumns = []string{"hash", "block", "timestamp", "from_address", "to_address", "type", "value",
+	"gas_price", "base_fee", "max_fee_per_gas", "max_priority_fee_per_gas", "effective_gas_price", "effective_tip",
+	"gas_used", "input_length"}
+
+func (s *PostgresStore) flush() error {
+	if len(s.pending) == 0 && len(s.checkpoints) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	collectedAt := time.Now().UTC()
+	var blocks [][]interface{}
+	var samples [][]interface{}
+	var numbers []int64
+	var hashes []string
+	sampleRows := make(map[common.Hash]int)
+	for _, block := range s.pending {
+		aggregate := block.Aggregate
+		row := []interface{}{int64(aggregate.Number), aggregate.Timestamp, sqlHash(block.Hash), sqlHash(block.ParentHash),
+			aggregate.TransactionsSampled,
+			int64(aggregate.TransactionsSkipped), string(block.Sampler), block.SampleSeed, block.SampleSize, block.PriceStrata,
+			aggregate.Transactions, numeric(aggregate.BaseFee),
+			int64(aggregate.GasUsed), int64(aggregate.GasLimit)}
+		row = append(row, numericStats(aggregate.EffectiveGasPrice)...)
+		row = append(row, numericStats(aggregate.EffectiveTip)...)
+		blocks = append(blocks, append(row, collectedAt))
+		numbers = append(numbers, int64(block.Number))
+
+		for _, record := range block.Records {
+			var to interface{}
+			if record.To != nil {
+				to = record.To.Hex()
+			}
+			row := []interface{}{record.Hash.Hex(), int64(block.Number), record.Timestamp, record.From.Hex(), to,
+				int(record.Type), numeric(record.Value), numeric(record.GasPrice), numeric(record.BaseFee),
+				numeric(record.MaxFeePerGas), numeric(record.MaxPriorityFeePerGas), numeric(record.EffectiveGasPrice),
+				numeric(record.EffectiveTip), int64(record.GasUsed), record.InputLength}
+			//a transaction in two blocks of the batch, moved by a reorg, keeps the later one
+			if index, ok := sampleRows[record.Hash]; ok {
+				samples[index] = row
+				continue
+			}
+			sampleRows[record.Hash] = len(samples)
+			hashes = append(hashes, record.Hash.Hex())
+			samples = append(samples, row)
+		}
+	}
+
+	if len(blocks) > 0 {
+		//the timestamp is part of the keys as TimescaleDB needs the time column in every unique
+		//index, so a block collected again after a reorg, with another timestamp, would be
+		//stored next to its old row: the rows of the blocks are replaced instead
+		_, err = tx.Exec(`DELETE FROM `+s.options.BlocksTable+` WHERE number = ANY($1)`, pq.Array(numbers))
+		if err != nil {
+			return fmt.Errorf("replacing the blocks: %w", err)
+		}
+		err = copyUpsert(tx, s.options.BlocksTable, "gas_blocks_staging", postgresBlockColumns, []string{"number", "timestamp"}, blocks)
+		if err != nil {
+			return fmt.Errorf("writing the blocks: %w", err)
+		}
+
+		//a block collected again gets a new sample, the previous one is replaced, and a
+		//transaction moved to another block by a reorg only keeps its new row
+		_, err = tx.Exec(`DELETE FROM `+s.options.SamplesTable+` WHERE block = ANY($1) OR hash = ANY($2)`, pq.Array(numbers), pq.Array(hashes))
+		if err != nil {
+			return fmt.Errorf("replacing the samples: %w", err)
+		}
+		err = copyUpsert(tx, s.options.SamplesTable, "gas_samples_staging", postgresSampleColumns, []string{"hash", "timestamp"}, samples)
+		if err != nil {
+			return fmt.Errorf("writing the samples: %w", err)
+		}
+	}
+
+	for _, checkpoint := range s.checkpoints {
+		err = saveCheckpoint(tx, s.options.CheckpointsTable, checkpoint)
+		if err != nil {
+			return fmt.Errorf("saving the checkpoint: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	s.pending = nil
+	s.checkpoints = make(map[string]Checkpoint)
+	return nil
+}
+
+// copyUpsert copies rows into a temporary table and upserts them into table on the conflict
+// columns. Duplicate keys within rows keep one row, as one upsert cannot update a row twice.
+func copyUpsert(tx *sql.Tx, table string, staging string, columns []string, conflict []string, rows [][]interface{}) error {
+	_, err := tx.Exec(`CREATE TEMPORARY TABLE ` + staging + ` (LIKE ` + table + ` INCLUDING DEFAULTS) ON COMMIT DROP`)
+	if err != nil {
+		return err
+	}
+
+	copyIn, err := tx.Prepare(pq.CopyIn(staging, columns...))
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		_, err = copyIn.Exec(row...)
+		if err != nil {
+			copyIn.Close()
+			return err
+		}
+	}
+	//the empty Exec sends the buffered rows
+	_, err = copyIn.Exec()
+	if errWhenClosing := copyIn.Close(); err == nil {
+		err = errWhenClosing
+	}
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]bool)
+	for _, column := range conflict {
+		keys[column] = true
+	}
+	var updates []string
+	for _, column := range columns {
+		if !keys[column] {
+			updates = append(updates, column+" = excluded."+column)
+		}
+	}
+	list := strings.Join(columns, ", ")
+	_, err = tx.Exec(`INSERT INTO ` + table + ` (` + list + `)
+		SELECT DISTINCT ON (` + strings.Join(conflict, ", ") + `) ` + list + ` FROM ` + staging + `
+		ON CONFLICT (` + strings.Join(conflict, ", ") + `) DO UPDATE SET ` + strings.Join(updates, ", "))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DROP TABLE ` + staging)
+	return err
+}
+
+// numeric returns a wei amount for a numeric column, nil stays NULL.
+func numeric(value *big.Int) interface{} {
+	if value == nil {
+		return nil
+	}
+	return value.String()
+}
+
+// numericStats returns the columns of price statistics, in table order.
+func numericStats(stats PriceStats) []interface{} {
+	var values []interface{}
+	for _, value := range priceStatsValues(stats) {
+		values = append(values, numeric(value))
+	}
+	return values
+}
+
+func (s *PostgresStore) ScanGaps(blockRange BlockRange) (*GapReport, error) {
+	errWhenFlushing := s.Flush()
+	if errWhenFlushing != nil {
+		return nil, errWhenFlushing
+	}
+
+	rows, err := s.db.Query(`SELECT number, transactions_sampled FROM `+s.options.BlocksTable+` WHERE number >= $1 AND number < $2`,
+		int64(blockRange.From), int64(blockRange.To))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sampled := make(map[uint64]int64)
+	for rows.Next() {
+		var number uint64
+		var count int64
+		err = rows.Scan(&number, &count)
+		if err != nil {
+			return nil, err
+		}
+		sampled[number] = count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	report := &GapReport{Range: blockRange}
+	for number := blockRange.From; number < blockRange.To; number++ {
+		count, ok := sampled[number]
+		if !ok {
+			report.Missing = append(report.Missing, number)
+		} else if count == 0 {
+			report.Empty = append(report.Empty, number)
+		}
+	}
+	return report, nil
+}
+
+// ReadAggregates writes the waiting blocks first, so they are included. Blocks written before
+// the percentile columns were added have them null.
+func (s *PostgresStore) ReadAggregates(from time.Time, to time.Time) ([]*BlockAggregate, error) {
+	errWhenFlushing := s.Flush()
+	if errWhenFlushing != nil {
+		return nil, errWhenFlushing
+	}
+
+	columns := postgresBlockColumns[:len(postgresBlockColumns)-1]
+	rows, err := s.db.Query(`SELECT `+strings.Join(columns, ", ")+` FROM `+s.options.BlocksTable+`
+		WHERE timestamp >= $1 AND timestamp < $2 ORDER BY number`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var aggregates []*BlockAggregate
+	for rows.Next() {
+		aggregate := &BlockAggregate{}
+		var hash, parentHash, sampler sql.NullString
+		var seed, size, strata, transactions, gasUsed, gasLimit sql.NullInt64
+		var amounts [19]sql.NullString
+		destinations := []interface{}{&aggregate.Number, &aggregate.Timestamp, &hash, &parentHash, &aggregate.TransactionsSampled, &aggregate.TransactionsSkipped,
+			&sampler, &seed, &size, &strata, &transactions, &amounts[0], &gasUsed, &gasLimit}
+		for i := 1; i < len(amounts); i++ {
+			destinations = append(destinations, &amounts[i])
+		}
+		err = rows.Scan(destinations...)
+		if err != nil {
+			return nil, err
+		}
+
+		wei := make([]*big.Int, len(amounts))
+		for i, amount := range amounts {
+			if !amount.Valid {
+				continue
+			}
+			value, ok := new(big.Int).SetString(amount.String, 10)
+			if !ok {
+				return nil, fmt.Errorf("block %d: amount %q is not a whole number", aggregate.Number, amount.String)
+			}
+			wei[i] = value
+		}
+		aggregate.Timestamp = aggregate.Timestamp.UTC()
+		aggregate.Hash, aggregate.ParentHash = common.HexToHash(hash.String), common.HexToHash(parentHash.String)
+		aggregate.Sampler, aggregate.SampleSeed = SamplingStrategy(sampler.String), seed.Int64
+		aggregate.Transactions = int(transactions.Int64)
+		aggregate.GasUsed, aggregate.GasLimit = uint64(gasUsed.Int64), uint64(gasLimit.Int64)
+		aggregate.BaseFee = wei[0]
+		aggregate.EffectiveGasPrice = priceStatsFromValues(wei[1:10])
+		aggregate.EffectiveTip = priceStatsFromValues(wei[10:19])
+		aggregates = append(aggregates, aggregate)
+	}
+	return aggregates, rows.Err()
+}
+
+// Load returns the latest checkpoint of the job, including one still waiting to be written.
+func (s *PostgresStore) Load(job string) (*Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if checkpoint, ok := s.checkpoints[job]; ok {
+		return &checkpoint, nil
+	}
+
+	checkpoint := &Checkpoint{Job: job}
+	var sampler sql.NullString
+	var seed, size, strata sql.NullInt64
+	err := s.db.QueryRow(`SELECT start_block, end_block, next_block, sampler, sample_seed, sample_size, price_strata, updated_at
+		FROM `+s.options.CheckpointsTable+` WHERE job = $1`, job).
+		Scan(&checkpoint.StartBlock, &checkpoint.EndBlock, &checkpoint.NextBlock, &sampler, &seed, &size, &strata, &checkpoint.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	checkpoint.Sampler, checkpoint.SampleSeed = SamplingStrategy(sampler.String), seed.Int64
+	checkpoint.SampleSize, checkpoint.PriceStrata = int(size.Int64), int(strata.Int64)
+	return checkpoint, nil
+}
+
+// List returns the checkpoints of every job, including the ones still waiting to be written.
+func (s *PostgresStore) List() ([]Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.db.Query(`SELECT job, start_block, end_block, next_block, sampler, sample_seed, sample_size, price_strata, updated_at
+		FROM ` + s.options.CheckpointsTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var checkpoints []Checkpoint
+	for rows.Next() {
+		var checkpoint Checkpoint
+		var sampler sql.NullString
+		var seed, size, strata sql.NullInt64
+		err = rows.Scan(&checkpoint.Job, &checkpoint.StartBlock, &checkpoint.EndBlock, &checkpoint.NextBlock, &sampler, &seed, &size, &strata,
+			&checkpoint.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if _, waiting := s.checkpoints[checkpoint.Job]; waiting {
+			continue
+		}
+		checkpoint.Sampler, checkpoint.SampleSeed = SamplingStrategy(sampler.String), seed.Int64
+		checkpoint.SampleSize, checkpoint.PriceStrata = int(size.Int64), int(strata.Int64)
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, checkpoint := range s.checkpoints {
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	sort.Slice(checkpoints, func(i, j int) bool { return checkpoints[i].Job < checkpoints[j].Job })
+	return checkpoints, nil
+}
+
+// Save writes the checkpoint, or keeps it with the waiting blocks until they are written.
+func (s *PostgresStore) Save(checkpoint Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	checkpoint.UpdatedAt = time.Now().UTC()
+	if len(s.pending) > 0 {
+		s.checkpoints[checkpoint.Job] = checkpoint
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = saveCheckpoint(tx, s.options.CheckpointsTable, checkpoint)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func saveCheckpoint(tx *sql.Tx, table string, checkpoint Checkpoint) error {
+	_, err := tx.Exec(`INSERT INTO `+table+` (job, start_block, end_block, next_block, sampler, sample_seed, sample_size, price_strata,
+			updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (job) DO UPDATE SET start_block = excluded.start_block, end_block = excluded.end_block,
+			next_block = excluded.next_block, sampler = excluded.sampler, sample_seed = excluded.sample_seed,
+			sample_size = excluded.sample_size, price_strata = excluded.price_strata, updated_at = excluded.updated_at`,
+		checkpoint.Job, int64(checkpoint.StartBlock), int64(checkpoint.EndBlock), int64(checkpoint.NextBlock),
+		string(checkpoint.Sampler), checkpoint.SampleSeed, checkpoint.SampleSize, checkpoint.PriceStrata, checkpoint.UpdatedAt)
+	return err
+}
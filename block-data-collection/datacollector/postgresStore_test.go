@@ -0,0 +1,300 @@
+package datacollector
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// testPostgresOptions returns tables of their own for a test, dropped when it ends. The
+// tests run against the database of TEST_POSTGRES_URL and are skipped without it.
+func testPostgresOptions(t *testing.T, batchBlocks int) PostgresOptions {
+	t.Helper()
+	url := os.Getenv("TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("TEST_POSTGRES_URL is not set")
+	}
+
+	prefix := fmt.Sprintf("gas_test_%d", time.Now().UnixNano())
+	options := PostgresOptions{Url: url, SamplesTable: prefix + "_samples", BlocksTable: prefix + "_blocks",
+		CheckpointsTable: prefix + "_checkpoints", BatchBlocks: batchBlocks}
+	t.Cleanup(func() {
+		db, err := sql.Open("postgres", url)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer db.Close()
+		for _, table := range []string{options.SamplesTable, options.BlocksTable, options.CheckpointsTable} {
+			if _, err := db.Exec(`DROP TABLE IF EXISTS ` + table); err != nil {
+				t.Error(err)
+			}
+		}
+		_, err = db.Exec(`DELETE FROM `+postgresMigrationsTable+` WHERE tables = $1`,
+			options.SamplesTable+","+options.BlocksTable+","+options.CheckpointsTable)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	return options
+}
+
+func openTestPostgresStore(t *testing.T, options PostgresOptions) *PostgresStore {
+	t.Helper()
+	store, err := OpenPostgresStore(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// testPostgresBlock is testBlockSamples with the aggregate the postgres blocks table is
+// written from.
+func testPostgresBlock(number uint64, hashes ...int64) *BlockSamples {
+	block := testBlockSamples(number, hashes...)
+	block.Aggregate = &BlockAggregate{Number: number, Timestamp: block.Timestamp, TransactionsSampled: len(hashes),
+		Sampler: block.Sampler, SampleSeed: block.SampleSeed}
+	return block
+}
+
+// postgresSampledHashes returns the hashes stored per block, as integers.
+func postgresSampledHashes(t *testing.T, store *PostgresStore) map[uint64][]int64 {
+	t.Helper()
+	rows, err := store.db.Query(`SELECT block, hash FROM ` + store.options.SamplesTable + ` ORDER BY block, hash`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	hashes := make(map[uint64][]int64)
+	for rows.Next() {
+		var block uint64
+		var hash string
+		if err := rows.Scan(&block, &hash); err != nil {
+			t.Fatal(err)
+		}
+		hashes[block] = append(hashes[block], common.HexToHash(hash).Big().Int64())
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return hashes
+}
+
+func TestPostgresStoreMigrations(t *testing.T) {
+	options := testPostgresOptions(t, 1)
+	names, err := postgresMigrations.ReadDir("migrations/postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//opening again finds every migration applied and changes nothing
+	for open := 0; open < 2; open++ {
+		store, err := OpenPostgresStore(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var applied int
+		err = store.db.QueryRow(`SELECT count(*) FROM `+postgresMigrationsTable+` WHERE tables = $1`,
+			options.SamplesTable+","+options.BlocksTable+","+options.CheckpointsTable).Scan(&applied)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applied != len(names) {
+			t.Fatalf("open %d: %d migrations recorded, want %d", open+1, applied, len(names))
+		}
+
+		//every column written by the store exists
+		for table, columns := range map[string][]string{options.BlocksTable: postgresBlockColumns, options.SamplesTable: postgresSampleColumns} {
+			_, err = store.db.Exec(`SELECT ` + strings.Join(columns, ", ") + ` FROM ` + table + ` LIMIT 0`)
+			if err != nil {
+				t.Fatalf("open %d: %s: %v", open+1, table, err)
+			}
+		}
+		store.Close()
+	}
+}
+
+func TestPostgresStoreWriteBlock(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []*BlockSamples
+		want   map[uint64][]int64
+	}{
+		{
+			name:   "rerun writes the same rows once",
+			writes: []*BlockSamples{testPostgresBlock(10, 1, 2, 3), testPostgresBlock(10, 1, 2, 3)},
+			want:   map[uint64][]int64{10: {1, 2, 3}},
+		},
+		{
+			name:   "transaction sampled twice is stored once",
+			writes: []*BlockSamples{testPostgresBlock(10, 1, 2, 2, 3)},
+			want:   map[uint64][]int64{10: {1, 2, 3}},
+		},
+		{
+			name:   "re-collect replaces the sample",
+			writes: []*BlockSamples{testPostgresBlock(10, 1, 2, 3), testPostgresBlock(11, 4, 5), testPostgresBlock(10, 3, 6)},
+			want:   map[uint64][]int64{10: {3, 6}, 11: {4, 5}},
+		},
+		{
+			name:   "re-collect without samples empties the block",
+			writes: []*BlockSamples{testPostgresBlock(10, 1, 2), testPostgresBlock(10)},
+			want:   map[uint64][]int64{},
+		},
+		{
+			//the blocks have different timestamps, so the rows of hash 2 have different keys
+			name:   "transaction moved to another block by a reorg",
+			writes: []*BlockSamples{testPostgresBlock(10, 1, 2), testPostgresBlock(11, 2, 3)},
+			want:   map[uint64][]int64{10: {1}, 11: {2, 3}},
+		},
+	}
+	//every block in its own batch, and all blocks in one batch
+	for _, batchBlocks := range []int{1, 100} {
+		for _, test := range tests {
+			t.Run(fmt.Sprintf("%s, batches of %d", test.name, batchBlocks), func(t *testing.T) {
+				store := openTestPostgresStore(t, testPostgresOptions(t, batchBlocks))
+				for _, block := range test.writes {
+					if err := store.WriteBlock(block); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := store.Flush(); err != nil {
+					t.Fatal(err)
+				}
+
+				got := postgresSampledHashes(t, store)
+				if len(got) != len(test.want) {
+					t.Fatalf("stored %v, want %v", got, test.want)
+				}
+				for block, hashes := range test.want {
+					if len(got[block]) != len(hashes) {
+						t.Fatalf("stored %v, want %v", got, test.want)
+					}
+					for i := range hashes {
+						if got[block][i] != hashes[i] {
+							t.Fatalf("stored %v, want %v", got, test.want)
+						}
+					}
+				}
+
+				var rows, blocks int
+				err := store.db.QueryRow(`SELECT count(*), count(DISTINCT number) FROM `+store.options.BlocksTable).Scan(&rows, &blocks)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rows != blocks {
+					t.Fatalf("%d block rows for %d blocks", rows, blocks)
+				}
+			})
+		}
+	}
+}
+
+func TestCopyUpsert(t *testing.T) {
+	store := openTestPostgresStore(t, testPostgresOptions(t, 1))
+	timestamp := time.Unix(1700000000, 0).UTC()
+	row := func(hash int64, gasUsed int64) []interface{} {
+		return []interface{}{common.BigToHash(big.NewInt(hash)).Hex(), int64(10), timestamp, common.HexToAddress("0x1").Hex(),
+			nil, 2, nil, nil, nil, nil, nil, nil, nil, gasUsed, 0}
+	}
+
+	tests := []struct {
+		name string
+		rows [][]interface{}
+		//gas used stored per hash
+		want map[int64]int64
+	}{
+		{"new rows", [][]interface{}{row(1, 100), row(2, 200)}, map[int64]int64{1: 100, 2: 200}},
+		{"existing row is updated", [][]interface{}{row(1, 150)}, map[int64]int64{1: 150, 2: 200}},
+		{"duplicate hashes in one batch", [][]interface{}{row(3, 300), row(3, 300), row(2, 250), row(2, 250)}, map[int64]int64{1: 150, 2: 250, 3: 300}},
+		{"no rows", nil, map[int64]int64{1: 150, 2: 250, 3: 300}},
+	}
+	for _, test := range tests {
+		tx, err := store.db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = copyUpsert(tx, store.options.SamplesTable, "gas_samples_staging", postgresSampleColumns, []string{"hash", "timestamp"}, test.rows)
+		if err != nil {
+			tx.Rollback()
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err = tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		got := make(map[int64]int64)
+		rows, err := store.db.Query(`SELECT hash, gas_used FROM ` + store.options.SamplesTable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var hash string
+			var gasUsed int64
+			if err := rows.Scan(&hash, &gasUsed); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := got[common.HexToHash(hash).Big().Int64()]; ok {
+				t.Fatalf("%s: hash %s stored twice", test.name, hash)
+			}
+			got[common.HexToHash(hash).Big().Int64()] = gasUsed
+		}
+		rows.Close()
+
+		if len(got) != len(test.want) {
+			t.Fatalf("%s: stored %v, want %v", test.name, got, test.want)
+		}
+		for hash, gasUsed := range test.want {
+			if got[hash] != gasUsed {
+				t.Fatalf("%s: stored %v, want %v", test.name, got, test.want)
+			}
+		}
+	}
+}
+
+func TestPostgresStoreReorgedBlock(t *testing.T) {
+	//the block collected again after a reorg has another hash and timestamp
+	first := testPostgresBlock(10, 1, 2)
+	first.Hash = common.HexToHash("0xa")
+	second := testPostgresBlock(10, 3)
+	second.Hash = common.HexToHash("0xb")
+	second.Timestamp = first.Timestamp.Add(12 * time.Second)
+	second.Aggregate.Timestamp = second.Timestamp
+	for _, record := range second.Records {
+		record.Timestamp = second.Timestamp
+	}
+
+	for _, batchBlocks := range []int{1, 100} {
+		t.Run(fmt.Sprintf("batches of %d", batchBlocks), func(t *testing.T) {
+			store := openTestPostgresStore(t, testPostgresOptions(t, batchBlocks))
+			for _, block := range []*BlockSamples{first, second} {
+				if err := store.WriteBlock(block); err != nil {
+					t.Fatal(err)
+				}
+				if err := store.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			aggregates, err := store.ReadAggregates(first.Timestamp, second.Timestamp.Add(time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(aggregates) != 1 || aggregates[0].Hash != second.Hash || !aggregates[0].Timestamp.Equal(second.Timestamp) {
+				t.Fatalf("read %d rows for block 10, want one with hash %s at %s", len(aggregates), second.Hash.Hex(), second.Timestamp)
+			}
+			got := postgresSampledHashes(t, store)
+			if len(got) != 1 || len(got[10]) != 1 || got[10][0] != 3 {
+				t.Fatalf("stored %v, want block 10 with 3", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package datacollector
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// TransactionRecord is one output row, the schema shared by every output format. Amounts are
+// in wei; the fee fields of a block before London and the caps of legacy transactions are
+// filled as described on TransactionDetails, BaseFee is nil before London.
+type TransactionRecord struct {
+	Block uint64 `json:"block"`
+	//block time for gas samples, the minute the block was picked for in full transaction files
+	Timestamp time.Time       `json:"timestamp"`
+	Hash      common.Hash     `json:"hash"`
+	From      common.Address  `json:"from"`
+	To        *common.Address `json:"to"`
+	Type      uint8           `json:"type"`
+	Value     *big.Int        `json:"value"`
+
+	GasPrice             *big.Int `json:"gasPrice"`
+	BaseFee              *big.Int `json:"baseFee"`
+	MaxFeePerGas         *big.Int `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas *big.Int `json:"maxPriorityFeePerGas"`
+	EffectiveGasPrice    *big.Int `json:"effectiveGasPrice"`
+	EffectiveTip         *big.Int `json:"effectiveTip"`
+
+	GasUsed     uint64 `json:"gasUsed"`
+	InputLength int    `json:"inputLength"`
+}
+
+// newTransactionRecord builds the record of an extracted transaction.
+func newTransactionRecord(details *TransactionDetails, receipt *types.Receipt, timestamp time.Time) *TransactionRecord {
+	return &TransactionRecord{
+		Block:                details.BlockNumber,
+		Timestamp:            timestamp,
+		Hash:                 details.Hash,
+		From:                 details.From,
+		To:                   details.To,
+		Type:                 details.Type,
+		Value:                details.Value,
+		GasPrice:             details.GasPrice,
+		BaseFee:              details.BaseFee,
+		MaxFeePerGas:         details.MaxFeePerGas,
+		MaxPriorityFeePerGas: details.MaxPriorityFeePerGas,
+		EffectiveGasPrice:    details.EffectiveGasPrice,
+		EffectiveTip:         details.EffectiveTip,
+		GasUsed:              receipt.GasUsed,
+		InputLength:          details.InputLength,
+	}
+}
+
+// recordColumn is a csv column. Columns without parse are only written, never read back.
+type recordColumn struct {
+	name   string
+	format func(r *TransactionRecord) string
+	parse  func(r *TransactionRecord, text string) error
+}
+
+// gasTimestampFormat is the timestamp format of the gas sample csv files
+const gasTimestampFormat = "Jan-02-2006 03:04:05 PM UTC"
+
+// gasSampleColumns are the columns of the per-block gas csv files
+var gasSampleColumns = []recordColumn{
+	{name: "Timestamp",
+		format: func(r *TransactionRecord) string { return r.Timestamp.UTC().Format(gasTimestampFormat) },
+		parse: func(r *TransactionRecord, text string) (err error) {
+			r.Timestamp, err = time.Parse(gasTimestampFormat, text)
+			return err
+		}},
+	gweiColumn("Gas Price(Gwei)", func(r *TransactionRecord) **big.Int { return &r.GasPrice }),
+	gweiColumn("Base Fee(Gwei)", func(r *TransactionRecord) **big.Int { return &r.BaseFee }),
+	gweiColumn("Max Fee Per Gas(Gwei)", func(r *TransactionRecord) **big.Int { return &r.MaxFeePerGas }),
+	gweiColumn("Max Priority Fee Per Gas(Gwei)", func(r *TransactionRecord) **big.Int { return &r.MaxPriorityFeePerGas }),
+	gweiColumn("Effective Gas Price(Gwei)", func(r *TransactionRecord) **big.Int { return &r.EffectiveGasPrice }),
+	gweiColumn("Effective Tip(Gwei)", func(r *TransactionRecord) **big.Int { return &r.EffectiveTip }),
+}
+
+// blockColumn leads the columns of the day and block range csv files
+var blockColumn = recordColumn{name: "Block",
+	format: func(r *TransactionRecord) string { return strconv.FormatUint(r.Block, 10) },
+	parse: func(r *TransactionRecord, text string) (err error) {
+		r.Block, err = strconv.ParseUint(text, 10, 64)
+		return err
+	}}
+
+// consolidatedColumns are the columns of the day and block range csv files
+var consolidatedColumns = append([]recordColumn{blockColumn}, gasSampleColumns...)
+
+// fullTransactionColumns are the columns of the CollectData csv files
+var fullTransactionColumns = []recordColumn{
+	{name: "Transaction Hash", format: func(r *TransactionRecord) string { return r.Hash.String() }},
+	{name: "Timestamp", format: func(r *TransactionRecord) string { return r.Timestamp.Format("2006-01-02 15:04:05 MST") }},
+	{name: "From", format: func(r *TransactionRecord) string { return r.From.Hex() }},
+	{name: "To", format: func(r *TransactionRecord) string {
+		if r.To == nil {
+			return ""
+		}
+		return r.To.Hex()
+	}},
+	{name: "Value(Eth)", format: func(r *TransactionRecord) string { return bigToEth(r.Value) }},
+	{name: "Type", format: func(r *TransactionRecord) string { return getTheTransactionType(strconv.Itoa(int(r.Type))) }},
+	{name: "Transaction Fee(Eth)", format: func(r *TransactionRecord) string {
+		if r.GasPrice == nil {
+			return ""
+		}
+		return calculateTransactionFee(strconv.FormatUint(r.GasUsed, 10), r.GasPrice.String())
+	}},
+	{name: "Gas Price(Gwei)", format: func(r *TransactionRecord) string { return bigToGwei(r.GasPrice) }},
+	//the gas used by the transaction, the column name is kept for existing readers
+	{name: "Gas Limit", format: func(r *TransactionRecord) string { return strconv.FormatUint(r.GasUsed, 10) }},
+	{name: "Block", format: func(r *TransactionRecord) string { return strconv.FormatUint(r.Block, 10) }},
+	{name: "Data array length", format: func(r *TransactionRecord) string { return strconv.Itoa(r.InputLength) }},
+}
+
+// gweiColumn is a wei amount written in Gwei with 9 decimals, so it reads back exactly.
+func gweiColumn(name string, field func(r *TransactionRecord) **big.Int) recordColumn {
+	return recordColumn{name: name,
+		format: func(r *TransactionRecord) string { return bigToGwei(*field(r)) },
+		parse: func(r *TransactionRecord, text string) (err error) {
+			*field(r), err = parseGwei(name, text)
+			return err
+		}}
+}
+
+// parseGwei reads an amount written by bigToGwei back in wei, nil when text is empty.
+func parseGwei(name string, text string) (*big.Int, error) {
+	if text == "" {
+		return nil, nil
+	}
+	gwei, ok := new(big.Rat).SetString(text)
+	if !ok {
+		return nil, fmt.Errorf("%s %q is not a number", name, text)
+	}
+	wei := gwei.Mul(gwei, new(big.Rat).SetInt64(1e9))
+	if !wei.IsInt() {
+		return nil, fmt.Errorf("%s %q is not a whole number of wei", name, text)
+	}
+	return new(big.Int).Set(wei.Num()), nil
+}
+
+// columnNames returns the csv header of columns.
+func columnNames(columns []recordColumn) []string {
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.name
+	}
+	return names
+}
+
+// parseRecord reads a csv row written with columns.
+func parseRecord(columns []recordColumn, row []string) (*TransactionRecord, error) {
+	if len(row) != len(columns) {
+		return nil, fmt.Errorf("%d columns, expected %d", len(row), len(columns))
+	}
+	record := &TransactionRecord{}
+	for i, column := range columns {
+		if column.parse == nil {
+			continue
+		}
+		err := column.parse(record, row[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+func bigToEth(wei *big.Int) string {
+	if wei == nil {
+		return ""
+	}
+	return weiToEth(wei.String())
+}
@@ -0,0 +1,128 @@
+package datacollector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// confirmationPollInterval is how often the chain head is read while waiting for
+// confirmations, about one mainnet block.
+const confirmationPollInterval = 12 * time.Second
+
+// confirmationGate holds blocks back until they have enough confirmations. The head is
+// cached, so blocks that are deep enough do not cost a request.
+type confirmationGate struct {
+	source BlockSource
+	//confirmations a block needs, the head block having one; zero disables the gate
+	depth uint64
+
+	mu   sync.Mutex
+	head uint64
+}
+
+// confirmedHead returns the head at which block number has the given confirmations. A block
+// has head - number + 1 confirmations, the head block having one, and zero confirmations only
+// need the block to exist. The live collection and the end of a range both count this way.
+func confirmedHead(number uint64, confirmations uint64) uint64 {
+	if confirmations == 0 {
+		return number
+	}
+	return number + confirmations - 1
+}
+
+func newConfirmationGate(source BlockSource, depth uint64) *confirmationGate {
+	return &confirmationGate{source: source, depth: depth}
+}
+
+// wait returns once block number has depth confirmations or ctx is done.
+func (g *confirmationGate) wait(ctx context.Context, number uint64) error {
+	if g.depth == 0 {
+		return nil
+	}
+	needed := confirmedHead(number, g.depth)
+
+	announced := false
+	for {
+		g.mu.Lock()
+		head := g.head
+		g.mu.Unlock()
+		if head >= needed {
+			return nil
+		}
+
+		head, err := g.source.BlockNumber(ctx)
+		if err != nil {
+			return fmt.Errorf("reading the chain head: %w", err)
+		}
+		g.mu.Lock()
+		if head > g.head {
+			g.head = head
+		}
+		g.mu.Unlock()
+		if head >= needed {
+			return nil
+		}
+		if !announced {
+			fmt.Println("Waiting for block ", number, " to have ", g.depth, " confirmations, head is ", head)
+			announced = true
+		}
+
+		select {
+		case <-time.After(confirmationPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ReconcileReport lists the stored blocks that are no longer part of the canonical chain.
+type ReconcileReport struct {
+	//stored blocks compared with the chain
+	Checked int
+	//stored blocks without a hash, written before hashes were kept, not checked
+	Unhashed int
+	//blocks whose stored hash differs from the canonical block at their number
+	Reorged []uint64
+	//blocks whose stored parent hash does not match the stored hash of the block before;
+	//one of the two was always replaced, the canonical check tells which
+	Unlinked []uint64
+}
+
+// ReconcileBlocks compares the hashes stored with the block aggregates with the canonical
+// chain and reports the blocks that were replaced by a reorg since they were collected.
+func ReconcileBlocks(ctx context.Context, source BlockSource, aggregates []*BlockAggregate) (*ReconcileReport, error) {
+	source = NewRetryingBlockSource(source, RetryPolicy{})
+	report := &ReconcileReport{}
+
+	sorted := append([]*BlockAggregate{}, aggregates...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Number < sorted[j].Number })
+
+	var previous *BlockAggregate
+	for _, aggregate := range sorted {
+		if aggregate.Hash == (common.Hash{}) {
+			report.Unhashed++
+			previous = nil
+			continue
+		}
+		if previous != nil && previous.Number+1 == aggregate.Number && aggregate.ParentHash != previous.Hash {
+			report.Unlinked = append(report.Unlinked, aggregate.Number)
+		}
+		previous = aggregate
+
+		header, err := source.HeaderByNumber(ctx, new(big.Int).SetUint64(aggregate.Number))
+		if err != nil {
+			return report, fmt.Errorf("header of block %d: %w", aggregate.Number, err)
+		}
+		report.Checked++
+		if header.Hash() != aggregate.Hash {
+			report.Reorged = append(report.Reorged, aggregate.Number)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,180 @@
+package datacollector
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// countingHead is a BlockSource whose head is head, counting the reads of it.
+type countingHead struct {
+	BlockSource
+	head  uint64
+	reads int
+}
+
+func (c *countingHead) BlockNumber(ctx context.Context) (uint64, error) {
+	c.reads++
+	return c.head, nil
+}
+
+func TestConfirmedHead(t *testing.T) {
+	tests := []struct {
+		number        uint64
+		confirmations uint64
+		want          uint64
+	}{
+		{100, 0, 100},
+		{100, 1, 100},
+		{100, 2, 101},
+		{100, 12, 111},
+	}
+	for _, test := range tests {
+		if got := confirmedHead(test.number, test.confirmations); got != test.want {
+			t.Errorf("confirmedHead(%d, %d) = %d, want %d", test.number, test.confirmations, got, test.want)
+		}
+	}
+}
+
+func TestConfirmationGate(t *testing.T) {
+	tests := []struct {
+		name   string
+		head   uint64
+		depth  uint64
+		number uint64
+		ready  bool
+	}{
+		{"no gate", 90, 0, 100, true},
+		{"head block with one confirmation", 100, 1, 100, true},
+		{"block past the head", 100, 1, 101, false},
+		{"enough confirmations", 111, 12, 100, true},
+		{"one confirmation short", 110, 12, 100, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			//a block that is not ready waits for the next poll, cancelled here
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			gate := newConfirmationGate(&countingHead{head: test.head}, test.depth)
+			err := gate.wait(ctx, test.number)
+			if test.ready && err != nil {
+				t.Fatalf("block %d at head %d and depth %d: %v", test.number, test.head, test.depth, err)
+			}
+			if !test.ready && !errors.Is(err, context.Canceled) {
+				t.Fatalf("block %d at head %d and depth %d did not wait: %v", test.number, test.head, test.depth, err)
+			}
+		})
+	}
+}
+
+func TestConfirmationGateCachesHead(t *testing.T) {
+	source := &countingHead{head: 120}
+	gate := newConfirmationGate(source, 12)
+	for _, number := range []uint64{100, 105, 109, 101} {
+		if err := gate.wait(context.Background(), number); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if source.reads != 1 {
+		t.Fatalf("read the head %d times, want once", source.reads)
+	}
+}
+
+func TestCheckRangeEnded(t *testing.T) {
+	tests := []struct {
+		name          string
+		head          uint64
+		endBlock      uint64
+		confirmations uint64
+		ended         bool
+	}{
+		{"next block mined", 100, 99, 0, true},
+		{"last block is the head", 100, 100, 0, false},
+		{"next block has its confirmations", 111, 99, 12, true},
+		{"next block one confirmation short", 110, 99, 12, false},
+		{"next block is the head", 100, 99, 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkRangeEnded(context.Background(), &countingHead{head: test.head}, test.endBlock, test.confirmations)
+			if test.ended && err != nil {
+				t.Fatal(err)
+			}
+			if !test.ended && !errors.Is(err, ErrRangeNotEnded) {
+				t.Fatalf("got %v, want ErrRangeNotEnded", err)
+			}
+		})
+	}
+}
+
+func TestReconcileBlocks(t *testing.T) {
+	chain := headerChain{times: []uint64{1000, 1012, 1024, 1036, 1048, 1060}}
+	canonical := func(number uint64) common.Hash {
+		header, err := chain.HeaderByNumber(context.Background(), new(big.Int).SetUint64(number))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return header.Hash()
+	}
+	//stored aggregate of a canonical block, linked to the block before
+	stored := func(number uint64) *BlockAggregate {
+		aggregate := &BlockAggregate{Number: number, Hash: canonical(number)}
+		if number > 0 {
+			aggregate.ParentHash = canonical(number - 1)
+		}
+		return aggregate
+	}
+	reorged := func(number uint64) *BlockAggregate {
+		aggregate := stored(number)
+		aggregate.Hash = common.HexToHash("0xdead")
+		return aggregate
+	}
+	unhashed := func(number uint64) *BlockAggregate {
+		return &BlockAggregate{Number: number}
+	}
+
+	tests := []struct {
+		name         string
+		aggregates   []*BlockAggregate
+		wantChecked  int
+		wantUnhashed int
+		wantReorged  []uint64
+		wantUnlinked []uint64
+	}{
+		{"canonical", []*BlockAggregate{stored(1), stored(2), stored(3)}, 3, 0, nil, nil},
+		//the block after the replaced one still points at the canonical parent
+		{"replaced block", []*BlockAggregate{stored(1), reorged(2), stored(3)}, 3, 0, []uint64{2}, []uint64{3}},
+		{"out of order", []*BlockAggregate{stored(3), reorged(2), stored(1)}, 3, 0, []uint64{2}, []uint64{3}},
+		{"not adjacent blocks are not linked", []*BlockAggregate{reorged(1), stored(3)}, 2, 0, []uint64{1}, nil},
+		{"without hash", []*BlockAggregate{stored(1), unhashed(2), reorged(3), stored(4)}, 3, 1, []uint64{3}, []uint64{4}},
+		{"nothing stored", nil, 0, 0, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report, err := ReconcileBlocks(context.Background(), chain, test.aggregates)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Checked != test.wantChecked || report.Unhashed != test.wantUnhashed ||
+				!equalBlocks(report.Reorged, test.wantReorged) || !equalBlocks(report.Unlinked, test.wantUnlinked) {
+				t.Fatalf("got %+v, want %d checked, %d without hash, reorged %v and unlinked %v",
+					report, test.wantChecked, test.wantUnhashed, test.wantReorged, test.wantUnlinked)
+			}
+		})
+	}
+}
+
+func equalBlocks(a []uint64, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,288 @@
+package datacollector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// ErrorClass tells the retry logic what kind of failure an error is.
+type ErrorClass int
+
+const (
+	ErrorClassUnknown ErrorClass = iota
+	ErrorClassRateLimit
+	ErrorClassAuth
+	ErrorClassNotFound
+	ErrorClassTransient
+	ErrorClassCancelled
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassRateLimit:
+		return "rate limit"
+	case ErrorClassAuth:
+		return "auth failure"
+	case ErrorClassNotFound:
+		return "not found"
+	case ErrorClassTransient:
+		return "transient"
+	case ErrorClassCancelled:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
+
+// Retryable reports whether an error of this class may succeed when tried again.
+func (c ErrorClass) Retryable() bool {
+	switch c {
+	case ErrorClassAuth, ErrorClassNotFound, ErrorClassCancelled:
+		return false
+	default:
+		return true
+	}
+}
+
+// HTTPStatusError is returned for non 2xx responses of plain HTTP APIs such as Etherscan.
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return "unexpected HTTP status " + e.Status
+}
+
+// ClassifyError sorts an error from a JSON-RPC node or an HTTP API into an ErrorClass.
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorClassUnknown
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrorClassCancelled
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassTransient
+	}
+	if errors.Is(err, ethereum.NotFound) {
+		return ErrorClassNotFound
+	}
+
+	var rpcHttpError rpc.HTTPError
+	if errors.As(err, &rpcHttpError) {
+		return classifyStatusCode(rpcHttpError.StatusCode)
+	}
+	var httpStatusError *HTTPStatusError
+	if errors.As(err, &httpStatusError) {
+		return classifyStatusCode(httpStatusError.StatusCode)
+	}
+
+	//-32005 is the "limit exceeded" code used by Infura and other providers
+	var rpcError rpc.Error
+	if errors.As(err, &rpcError) && rpcError.ErrorCode() == -32005 {
+		return ErrorClassRateLimit
+	}
+
+	message := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(message, "rate limit"), strings.Contains(message, "too many requests"),
+		strings.Contains(message, "limit exceeded"), strings.Contains(message, "daily request count exceeded"):
+		return ErrorClassRateLimit
+	case strings.Contains(message, "invalid api key"), strings.Contains(message, "invalid project id"),
+		strings.Contains(message, "unauthorized"), strings.Contains(message, "forbidden"):
+		return ErrorClassAuth
+	}
+
+	var netError net.Error
+	if errors.As(err, &netError) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrorClassTransient
+	}
+	if strings.Contains(message, "connection reset") || strings.Contains(message, "connection refused") ||
+		strings.Contains(message, "no such host") || strings.Contains(message, "timeout") {
+		return ErrorClassTransient
+	}
+	return ErrorClassUnknown
+}
+
+func classifyStatusCode(statusCode int) ErrorClass {
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return ErrorClassRateLimit
+	case statusCode == http.StatusUnauthorized, statusCode == http.StatusForbidden:
+		return ErrorClassAuth
+	case statusCode == http.StatusNotFound:
+		return ErrorClassNotFound
+	case statusCode >= 500, statusCode == http.StatusRequestTimeout:
+		return ErrorClassTransient
+	default:
+		return ErrorClassUnknown
+	}
+}
+
+// RetryError is the terminal error returned once an operation cannot be retried any more.
+type RetryError struct {
+	Operation string
+	Class     ErrorClass
+	Attempts  int
+	Err       error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%s failed after %d attempt(s) (%s): %v", e.Operation, e.Attempts, e.Class, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// RetryPolicy retries failed calls with exponential backoff and jitter.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 8,
+	BaseDelay:   time.Second,
+	MaxDelay:    2 * time.Minute,
+}
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Do runs call until it succeeds, fails with an error that is not retryable, the
+// attempts run out or ctx is cancelled. Failures end in a *RetryError.
+func (p RetryPolicy) Do(ctx context.Context, operation string, call func() error) error {
+	if p.MaxAttempts < 1 {
+		p = DefaultRetryPolicy
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil {
+			return nil
+		}
+
+		class := ClassifyError(err)
+		if ctx.Err() != nil {
+			class = ErrorClassCancelled
+		}
+		if !class.Retryable() || attempt >= p.MaxAttempts {
+			return &RetryError{Operation: operation, Class: class, Attempts: attempt, Err: err}
+		}
+
+		delay := p.backoff(attempt, class)
+		fmt.Println("Error when calling ", operation, " (", class, ") : ", err)
+		fmt.Println("Retrying in ", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return &RetryError{Operation: operation, Class: ErrorClassCancelled, Attempts: attempt, Err: ctx.Err()}
+		}
+	}
+}
+
+// backoff returns the wait before the next attempt: the exponential delay for the attempt,
+// capped at MaxDelay, of which the upper half is randomised. Rate limits wait twice as long.
+func (p RetryPolicy) backoff(attempt int, class ErrorClass) time.Duration {
+	delay := p.BaseDelay
+	if class == ErrorClassRateLimit {
+		delay *= 2
+	}
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+	jitterMu.Lock()
+	jitter := time.Duration(jitterRand.Int63n(int64(half) + 1))
+	jitterMu.Unlock()
+	return half + jitter
+}
+
+// RetryingBlockSource applies a RetryPolicy to every call of the wrapped source.
+type RetryingBlockSource struct {
+	source BlockSource
+	policy RetryPolicy
+}
+
+func NewRetryingBlockSource(source BlockSource, policy RetryPolicy) *RetryingBlockSource {
+	return &RetryingBlockSource{source: source, policy: policy}
+}
+
+func (s *RetryingBlockSource) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	var block *types.Block
+	err := s.policy.Do(ctx, "eth_getBlockByNumber", func() error {
+		var err error
+		block, err = s.source.BlockByNumber(ctx, number)
+		return err
+	})
+	return block, err
+}
+
+func (s *RetryingBlockSource) BlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error) {
+	var block *types.Block
+	err := s.policy.Do(ctx, "eth_getBlockByHash", func() error {
+		var err error
+		block, err = s.source.BlockByHash(ctx, hash)
+		return err
+	})
+	return block, err
+}
+
+func (s *RetryingBlockSource) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	var header *types.Header
+	err := s.policy.Do(ctx, "eth_getBlockByNumber", func() error {
+		var err error
+		header, err = s.source.HeaderByNumber(ctx, number)
+		return err
+	})
+	return header, err
+}
+
+func (s *RetryingBlockSource) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	var receipt *types.Receipt
+	err := s.policy.Do(ctx, "eth_getTransactionReceipt", func() error {
+		var err error
+		receipt, err = s.source.TransactionReceipt(ctx, txHash)
+		return err
+	})
+	return receipt, err
+}
+
+func (s *RetryingBlockSource) BlockNumber(ctx context.Context) (uint64, error) {
+	var number uint64
+	err := s.policy.Do(ctx, "eth_blockNumber", func() error {
+		var err error
+		number, err = s.source.BlockNumber(ctx)
+		return err
+	})
+	return number, err
+}
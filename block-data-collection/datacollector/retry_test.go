@@ -0,0 +1,170 @@
+package datacollector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// testRPCError is a JSON-RPC error response with its code.
+type testRPCError struct {
+	code    int
+	message string
+}
+
+func (e testRPCError) Error() string  { return e.message }
+func (e testRPCError) ErrorCode() int { return e.code }
+
+// testTimeoutError is a network error that timed out.
+type testTimeoutError struct{}
+
+func (testTimeoutError) Error() string   { return "i/o timeout" }
+func (testTimeoutError) Timeout() bool   { return true }
+func (testTimeoutError) Temporary() bool { return true }
+
+var _ rpc.Error = testRPCError{}
+var _ net.Error = testTimeoutError{}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"no error", nil, ErrorClassUnknown},
+		{"cancelled", fmt.Errorf("block 1: %w", context.Canceled), ErrorClassCancelled},
+		{"deadline", context.DeadlineExceeded, ErrorClassTransient},
+		{"not found", ethereum.NotFound, ErrorClassNotFound},
+		{"rpc 429", rpc.HTTPError{StatusCode: http.StatusTooManyRequests, Status: "429 Too Many Requests"}, ErrorClassRateLimit},
+		{"rpc 401", rpc.HTTPError{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized"}, ErrorClassAuth},
+		{"rpc 503", rpc.HTTPError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}, ErrorClassTransient},
+		{"http 403", &HTTPStatusError{StatusCode: http.StatusForbidden, Status: "403 Forbidden"}, ErrorClassAuth},
+		{"http 404", &HTTPStatusError{StatusCode: http.StatusNotFound, Status: "404 Not Found"}, ErrorClassNotFound},
+		{"http 408", &HTTPStatusError{StatusCode: http.StatusRequestTimeout, Status: "408 Request Timeout"}, ErrorClassTransient},
+		{"http 400", &HTTPStatusError{StatusCode: http.StatusBadRequest, Status: "400 Bad Request"}, ErrorClassUnknown},
+		{"wrapped http 500", fmt.Errorf("etherscan: %w", &HTTPStatusError{StatusCode: 500, Status: "500"}), ErrorClassTransient},
+		{"rpc limit exceeded code", testRPCError{-32005, "request failed"}, ErrorClassRateLimit},
+		{"rpc invalid project id", testRPCError{-32002, "invalid project id"}, ErrorClassAuth},
+		{"rpc other code", testRPCError{-32000, "execution reverted"}, ErrorClassUnknown},
+		{"daily limit message", errors.New("daily request count exceeded, request rate limited"), ErrorClassRateLimit},
+		{"invalid api key message", errors.New("NOTOK: Invalid API Key"), ErrorClassAuth},
+		{"network timeout", &net.OpError{Op: "read", Err: testTimeoutError{}}, ErrorClassTransient},
+		{"eof", fmt.Errorf("reading the response: %w", io.ErrUnexpectedEOF), ErrorClassTransient},
+		{"connection reset message", errors.New("read tcp: connection reset by peer"), ErrorClassTransient},
+		{"unknown", errors.New("something else"), ErrorClassUnknown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ClassifyError(test.err); got != test.want {
+				t.Fatalf("ClassifyError(%v) = %s, want %s", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 8, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		class   ErrorClass
+		//the delay before jitter, the backoff is in its upper half
+		want time.Duration
+	}{
+		{"first attempt", policy, 1, ErrorClassTransient, time.Second},
+		{"doubles", policy, 3, ErrorClassTransient, 4 * time.Second},
+		{"capped", policy, 6, ErrorClassTransient, 10 * time.Second},
+		{"rate limit waits longer", policy, 1, ErrorClassRateLimit, 2 * time.Second},
+		{"rate limit capped", policy, 5, ErrorClassRateLimit, 10 * time.Second},
+		{"no delay", RetryPolicy{MaxAttempts: 3}, 2, ErrorClassTransient, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 50; i++ {
+				delay := test.policy.backoff(test.attempt, test.class)
+				if delay < test.want/2 || delay > test.want {
+					t.Fatalf("backoff(%d, %s) = %s, want between %s and %s", test.attempt, test.class, delay, test.want/2, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	transient := &HTTPStatusError{StatusCode: http.StatusBadGateway, Status: "502 Bad Gateway"}
+	rejected := &HTTPStatusError{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized"}
+
+	tests := []struct {
+		name string
+		//errors of the successive calls, the calls after them succeed
+		errs         []error
+		wantAttempts int
+		//class of the RetryError, ErrorClassUnknown when the call succeeds
+		wantClass ErrorClass
+	}{
+		{"first call succeeds", nil, 1, ErrorClassUnknown},
+		{"succeeds after retries", []error{transient, transient}, 3, ErrorClassUnknown},
+		{"attempts exhausted", []error{transient, transient, transient, transient}, 3, ErrorClassTransient},
+		{"not retryable", []error{rejected, transient}, 1, ErrorClassAuth},
+		{"not found", []error{ethereum.NotFound}, 1, ErrorClassNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+			attempts := 0
+			err := policy.Do(context.Background(), "eth_blockNumber", func() error {
+				attempts++
+				if attempts <= len(test.errs) {
+					return test.errs[attempts-1]
+				}
+				return nil
+			})
+
+			if attempts != test.wantAttempts {
+				t.Fatalf("called %d times, want %d", attempts, test.wantAttempts)
+			}
+			if test.wantClass == ErrorClassUnknown {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var retryError *RetryError
+			if !errors.As(err, &retryError) {
+				t.Fatalf("got %v, want a RetryError", err)
+			}
+			if retryError.Class != test.wantClass || retryError.Attempts != test.wantAttempts || !errors.Is(err, test.errs[attempts-1]) {
+				t.Fatalf("got %v, want a %s failure after %d attempts", err, test.wantClass, test.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDoCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	attempts := 0
+	err := policy.Do(ctx, "eth_blockNumber", func() error {
+		attempts++
+		//cancelled while waiting for the next attempt
+		time.AfterFunc(10*time.Millisecond, cancel)
+		return &HTTPStatusError{StatusCode: http.StatusBadGateway, Status: "502 Bad Gateway"}
+	})
+
+	var retryError *RetryError
+	if !errors.As(err, &retryError) || retryError.Class != ErrorClassCancelled || !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want a cancelled RetryError", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("called %d times, want 1", attempts)
+	}
+}
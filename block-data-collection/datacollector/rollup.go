@@ -0,0 +1,310 @@
+package datacollector
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// AggregateReader reads back the per-block aggregates a GasStore keeps.
+type AggregateReader interface {
+	//ReadAggregates returns the aggregates of the blocks with a timestamp in [from, to)
+	ReadAggregates(from time.Time, to time.Time) ([]*BlockAggregate, error)
+}
+
+// Rollup summarises the blocks of one time bucket. The price statistics are computed from
+// the block aggregates: open, high, low and close follow the median price of each block,
+// and each band is the median over the blocks of that block percentile.
+type Rollup struct {
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Blocks       int       `json:"blocks"`
+	Transactions int       `json:"transactions"`
+	GasUsed      uint64    `json:"gasUsed"`
+
+	EffectiveGasPrice RollupStats `json:"effectiveGasPrice"`
+	EffectiveTip      RollupStats `json:"effectiveTip"`
+}
+
+// RollupStats are the statistics of an amount over a bucket, in wei, all nil when no block
+// of the bucket had priced transactions.
+type RollupStats struct {
+	Open   *big.Int `json:"open"`
+	High   *big.Int `json:"high"`
+	Low    *big.Int `json:"low"`
+	Close  *big.Int `json:"close"`
+	P10    *big.Int `json:"p10"`
+	P25    *big.Int `json:"p25"`
+	Median *big.Int `json:"median"`
+	P75    *big.Int `json:"p75"`
+	P90    *big.Int `json:"p90"`
+}
+
+// ParseRollupInterval reads a bucket size: minute, hour, day or a Go duration such as 15m.
+// Buckets start at UTC midnight, so the interval must divide a day.
+func ParseRollupInterval(text string) (time.Duration, error) {
+	var interval time.Duration
+	switch text {
+	case "minute":
+		interval = time.Minute
+	case "hour":
+		interval = time.Hour
+	case "day":
+		interval = 24 * time.Hour
+	default:
+		var err error
+		interval, err = time.ParseDuration(text)
+		if err != nil {
+			return 0, fmt.Errorf("invalid interval %q, expected minute, hour, day or a duration like 15m", text)
+		}
+	}
+	if interval < time.Second || (24*time.Hour)%interval != 0 {
+		return 0, fmt.Errorf("interval %q must be at least a second and divide a day", text)
+	}
+	return interval, nil
+}
+
+// RollupAggregates groups the aggregates into buckets of interval and summarises each.
+// Buckets without blocks are left out; a block seen twice is counted once.
+func RollupAggregates(aggregates []*BlockAggregate, interval time.Duration) []*Rollup {
+	byNumber := make(map[uint64]*BlockAggregate)
+	for _, aggregate := range aggregates {
+		byNumber[aggregate.Number] = aggregate
+	}
+	sorted := make([]*BlockAggregate, 0, len(byNumber))
+	for _, aggregate := range byNumber {
+		sorted = append(sorted, aggregate)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Number < sorted[j].Number })
+
+	var rollups []*Rollup
+	var bucket []*BlockAggregate
+	for i, aggregate := range sorted {
+		bucket = append(bucket, aggregate)
+		last := i == len(sorted)-1
+		if last || !sorted[i+1].Timestamp.Truncate(interval).Equal(aggregate.Timestamp.Truncate(interval)) {
+			rollups = append(rollups, rollupBucket(bucket, interval))
+			bucket = nil
+		}
+	}
+	return rollups
+}
+
+func rollupBucket(bucket []*BlockAggregate, interval time.Duration) *Rollup {
+	start := bucket[0].Timestamp.UTC().Truncate(interval)
+	rollup := &Rollup{Start: start, End: start.Add(interval), Blocks: len(bucket)}
+
+	var prices, tips []PriceStats
+	for _, aggregate := range bucket {
+		rollup.Transactions += aggregate.Transactions
+		rollup.GasUsed += aggregate.GasUsed
+		if aggregate.EffectiveGasPrice.Median != nil {
+			prices = append(prices, aggregate.EffectiveGasPrice)
+		}
+		if aggregate.EffectiveTip.Median != nil {
+			tips = append(tips, aggregate.EffectiveTip)
+		}
+	}
+	rollup.EffectiveGasPrice = rollupStats(prices)
+	rollup.EffectiveTip = rollupStats(tips)
+	return rollup
+}
+
+// rollupStats summarises the statistics of the blocks of a bucket, in block order.
+func rollupStats(blocks []PriceStats) RollupStats {
+	if len(blocks) == 0 {
+		return RollupStats{}
+	}
+
+	values := func(field func(s PriceStats) *big.Int) []*big.Int {
+		var values []*big.Int
+		for _, stats := range blocks {
+			if value := field(stats); value != nil {
+				values = append(values, value)
+			}
+		}
+		return values
+	}
+	band := func(field func(s PriceStats) *big.Int) *big.Int {
+		return priceStats(values(field)).Median
+	}
+	medians := priceStats(values(func(s PriceStats) *big.Int { return s.Median }))
+
+	return RollupStats{
+		Open:   blocks[0].Median,
+		High:   medians.Max,
+		Low:    medians.Min,
+		Close:  blocks[len(blocks)-1].Median,
+		P10:    band(func(s PriceStats) *big.Int { return s.P10 }),
+		P25:    band(func(s PriceStats) *big.Int { return s.P25 }),
+		Median: medians.Median,
+		P75:    band(func(s PriceStats) *big.Int { return s.P75 }),
+		P90:    band(func(s PriceStats) *big.Int { return s.P90 }),
+	}
+}
+
+// rollupStatsValues returns the statistics in column order.
+func rollupStatsValues(stats RollupStats) []*big.Int {
+	return []*big.Int{stats.Open, stats.High, stats.Low, stats.Close, stats.P10, stats.P25, stats.Median, stats.P75, stats.P90}
+}
+
+// rollupStatNames name the statistics in column order.
+var rollupStatNames = []string{"Open", "High", "Low", "Close", "P10", "P25", "Median", "P75", "P90"}
+
+// ReadAggregateFiles reads the aggregates of the blocks with a timestamp in [from, to) from
+// the aggregate files in dir, including the partial files of a run in progress.
+func ReadAggregateFiles(dir string, from time.Time, to time.Time) ([]*BlockAggregate, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var aggregates []*BlockAggregate
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, "aggregates_") || !IsOutputFile(strings.TrimSuffix(name, partialSuffix)) {
+			continue
+		}
+		read, err := readAggregateFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+		for _, aggregate := range read {
+			if !aggregate.Timestamp.Before(from) && aggregate.Timestamp.Before(to) {
+				aggregates = append(aggregates, aggregate)
+			}
+		}
+	}
+	return aggregates, nil
+}
+
+// parquetRollup is the Parquet schema of Rollup, amounts in wei as DECIMAL(38,0).
+type parquetRollup struct {
+	Start                   int64   `parquet:"name=start, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	End                     int64   `parquet:"name=end, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Blocks                  int32   `parquet:"name=blocks, type=INT32"`
+	Transactions            int64   `parquet:"name=transactions, type=INT64"`
+	GasUsed                 int64   `parquet:"name=gas_used, type=INT64"`
+	OpenEffectiveGasPrice   *string `parquet:"name=open_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	HighEffectiveGasPrice   *string `parquet:"name=high_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	LowEffectiveGasPrice    *string `parquet:"name=low_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	CloseEffectiveGasPrice  *string `parquet:"name=close_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P10EffectiveGasPrice    *string `parquet:"name=p10_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P25EffectiveGasPrice    *string `parquet:"name=p25_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MedianEffectiveGasPrice *string `parquet:"name=median_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P75EffectiveGasPrice    *string `parquet:"name=p75_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P90EffectiveGasPrice    *string `parquet:"name=p90_effective_gas_price, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	OpenEffectiveTip        *string `parquet:"name=open_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	HighEffectiveTip        *string `parquet:"name=high_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	LowEffectiveTip         *string `parquet:"name=low_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	CloseEffectiveTip       *string `parquet:"name=close_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P10EffectiveTip         *string `parquet:"name=p10_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P25EffectiveTip         *string `parquet:"name=p25_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	MedianEffectiveTip      *string `parquet:"name=median_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P75EffectiveTip         *string `parquet:"name=p75_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+	P90EffectiveTip         *string `parquet:"name=p90_effective_tip, type=BYTE_ARRAY, convertedtype=DECIMAL, scale=0, precision=38, repetitiontype=OPTIONAL"`
+}
+
+func toParquetRollup(r *Rollup) *parquetRollup {
+	rollup := &parquetRollup{
+		Start:        r.Start.UnixMilli(),
+		End:          r.End.UnixMilli(),
+		Blocks:       int32(r.Blocks),
+		Transactions: int64(r.Transactions),
+		GasUsed:      int64(r.GasUsed),
+	}
+	columns := [][]**string{
+		{&rollup.OpenEffectiveGasPrice, &rollup.HighEffectiveGasPrice, &rollup.LowEffectiveGasPrice, &rollup.CloseEffectiveGasPrice,
+			&rollup.P10EffectiveGasPrice, &rollup.P25EffectiveGasPrice, &rollup.MedianEffectiveGasPrice, &rollup.P75EffectiveGasPrice, &rollup.P90EffectiveGasPrice},
+		{&rollup.OpenEffectiveTip, &rollup.HighEffectiveTip, &rollup.LowEffectiveTip, &rollup.CloseEffectiveTip,
+			&rollup.P10EffectiveTip, &rollup.P25EffectiveTip, &rollup.MedianEffectiveTip, &rollup.P75EffectiveTip, &rollup.P90EffectiveTip},
+	}
+	for i, stats := range []RollupStats{r.EffectiveGasPrice, r.EffectiveTip} {
+		for j, value := range rollupStatsValues(stats) {
+			*columns[i][j] = toParquetDecimal(value)
+		}
+	}
+	return rollup
+}
+
+// writeRollups writes rollups to w in format; csv amounts are in Gwei.
+func writeRollups(w io.Writer, format OutputFormat, rollups []*Rollup) error {
+	switch format {
+	case FormatCSV, "":
+		header := []string{"Start", "End", "Blocks", "Transactions", "Gas Used"}
+		for _, amount := range []string{"Effective Gas Price", "Effective Tip"} {
+			for _, stat := range rollupStatNames {
+				header = append(header, stat+" "+amount+"(Gwei)")
+			}
+		}
+
+		csvWriter := csv.NewWriter(w)
+		errWhenWriting := csvWriter.Write(header)
+		for _, rollup := range rollups {
+			if errWhenWriting != nil {
+				return errWhenWriting
+			}
+			row := []string{rollup.Start.Format(time.RFC3339), rollup.End.Format(time.RFC3339), strconv.Itoa(rollup.Blocks),
+				strconv.Itoa(rollup.Transactions), strconv.FormatUint(rollup.GasUsed, 10)}
+			for _, stats := range []RollupStats{rollup.EffectiveGasPrice, rollup.EffectiveTip} {
+				for _, value := range rollupStatsValues(stats) {
+					row = append(row, bigToGwei(value))
+				}
+			}
+			errWhenWriting = csvWriter.Write(row)
+		}
+		csvWriter.Flush()
+		if errWhenWriting != nil {
+			return errWhenWriting
+		}
+		return csvWriter.Error()
+	case FormatJSONL:
+		buffered := bufio.NewWriter(w)
+		encoder := json.NewEncoder(buffered)
+		for _, rollup := range rollups {
+			errWhenWriting := encoder.Encode(rollup)
+			if errWhenWriting != nil {
+				return errWhenWriting
+			}
+		}
+		return buffered.Flush()
+	case FormatParquet:
+		parquetWriter, err := writer.NewParquetWriterFromWriter(w, new(parquetRollup), 1)
+		if err != nil {
+			return err
+		}
+		for _, rollup := range rollups {
+			err = parquetWriter.Write(toParquetRollup(rollup))
+			if err != nil {
+				return err
+			}
+		}
+		return parquetWriter.WriteStop()
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// WriteRollupFile writes rollups to path in the format of its extension, under a temporary
+// name until it is complete.
+func WriteRollupFile(path string, rollups []*Rollup) error {
+	format := formatOf(path)
+	if format == "" {
+		return fmt.Errorf("unknown output format of %s", filepath.Base(path))
+	}
+
+	return writeFileAtomically(path, func(w io.Writer) error {
+		return writeRollups(w, format, rollups)
+	})
+}
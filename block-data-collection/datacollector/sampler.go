@@ -0,0 +1,293 @@
+package datacollector
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// SamplingStrategy names a Sampler.
+type SamplingStrategy string
+
+const (
+	//size transactions drawn uniformly, none twice
+	SampleUniform SamplingStrategy = "uniform"
+	//size transactions kept by a single pass reservoir, uniform like SampleUniform
+	SampleReservoir SamplingStrategy = "reservoir"
+	//the sample split over the transaction types in proportion to their counts
+	SampleStratifiedType SamplingStrategy = "stratified-type"
+	//the sample split over gas price quantiles of the block
+	SampleStratifiedPrice SamplingStrategy = "stratified-price"
+	//every transaction, the sample size is ignored
+	SampleAll SamplingStrategy = "all"
+)
+
+// defaultSampleSize is the number of transactions sampled per block when none is set.
+const defaultSampleSize = 15
+
+// defaultPriceStrata is the number of gas price quantiles of SampleStratifiedPrice, quartiles.
+const defaultPriceStrata = 4
+
+// Sampler picks the transactions of a block that are sampled. txs never holds contract
+// creations; the result is in block order and holds no transaction twice. All randomness
+// comes from rng, so the same rng seed gives the same sample.
+type Sampler interface {
+	Name() SamplingStrategy
+	Sample(rng *rand.Rand, baseFee *big.Int, txs []*types.Transaction, size int) []*types.Transaction
+}
+
+// NewSampler returns the Sampler of a strategy, SampleUniform when empty.
+func NewSampler(strategy SamplingStrategy) (Sampler, error) {
+	switch strategy {
+	case SampleUniform, "":
+		return UniformSampler{}, nil
+	case SampleReservoir:
+		return ReservoirSampler{}, nil
+	case SampleStratifiedType:
+		return TypeStratifiedSampler{}, nil
+	case SampleStratifiedPrice:
+		return PriceStratifiedSampler{}, nil
+	case SampleAll:
+		return AllSampler{}, nil
+	}
+	return nil, fmt.Errorf("unknown sampling strategy %q", strategy)
+}
+
+// newSamplerWithStrata returns the Sampler of a strategy, a SampleStratifiedPrice sampler
+// splitting the blocks into strata quantiles (defaultPriceStrata when zero).
+func newSamplerWithStrata(strategy SamplingStrategy, strata int) (Sampler, error) {
+	if strategy == SampleStratifiedPrice {
+		return PriceStratifiedSampler{Strata: strata}, nil
+	}
+	return NewSampler(strategy)
+}
+
+// priceStrata returns the number of gas price quantiles a sampler splits a block into, zero
+// for the samplers that do not stratify by price.
+func priceStrata(sampler Sampler) int {
+	stratified, ok := sampler.(PriceStratifiedSampler)
+	if !ok {
+		return 0
+	}
+	if stratified.Strata < 1 {
+		return defaultPriceStrata
+	}
+	return stratified.Strata
+}
+
+// ValidSamplingStrategy tells whether NewSampler accepts strategy.
+func ValidSamplingStrategy(strategy SamplingStrategy) bool {
+	_, err := NewSampler(strategy)
+	return err == nil
+}
+
+// UniformSampler draws the sample without replacement with a partial Fisher-Yates shuffle.
+type UniformSampler struct{}
+
+func (UniformSampler) Name() SamplingStrategy { return SampleUniform }
+
+func (UniformSampler) Sample(rng *rand.Rand, baseFee *big.Int, txs []*types.Transaction, size int) []*types.Transaction {
+	return pickTransactions(txs, uniformIndices(rng, len(txs), size))
+}
+
+// ReservoirSampler keeps a reservoir of size transactions while passing over the block once
+// (algorithm R).
+type ReservoirSampler struct{}
+
+func (ReservoirSampler) Name() SamplingStrategy { return SampleReservoir }
+
+func (ReservoirSampler) Sample(rng *rand.Rand, baseFee *big.Int, txs []*types.Transaction, size int) []*types.Transaction {
+	if size < 1 {
+		return nil
+	}
+	reservoir := make([]int, 0, size)
+	for i := range txs {
+		if i < size {
+			reservoir = append(reservoir, i)
+			continue
+		}
+		if j := rng.Intn(i + 1); j < size {
+			reservoir[j] = i
+		}
+	}
+	return pickTransactions(txs, reservoir)
+}
+
+// TypeStratifiedSampler groups the transactions by type (legacy, access list, dynamic fee,
+// ...) and draws from every group uniformly, in proportion to its size.
+type TypeStratifiedSampler struct{}
+
+func (TypeStratifiedSampler) Name() SamplingStrategy { return SampleStratifiedType }
+
+func (TypeStratifiedSampler) Sample(rng *rand.Rand, baseFee *big.Int, txs []*types.Transaction, size int) []*types.Transaction {
+	groups := make(map[uint8][]int)
+	var kinds []uint8
+	for i, tx := range txs {
+		if _, ok := groups[tx.Type()]; !ok {
+			kinds = append(kinds, tx.Type())
+		}
+		groups[tx.Type()] = append(groups[tx.Type()], i)
+	}
+	//a fixed stratum order, the draws would otherwise depend on map order
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i] < kinds[j] })
+
+	strata := make([][]int, len(kinds))
+	for i, kind := range kinds {
+		strata[i] = groups[kind]
+	}
+	return pickTransactions(txs, stratifiedIndices(rng, strata, size))
+}
+
+// PriceStratifiedSampler sorts the transactions by the gas price they pay in the block,
+// splits them into Strata quantiles of equal count and draws from every quantile uniformly,
+// so cheap and expensive transactions are both represented.
+type PriceStratifiedSampler struct {
+	//number of quantiles, defaultPriceStrata when zero
+	Strata int
+}
+
+func (PriceStratifiedSampler) Name() SamplingStrategy { return SampleStratifiedPrice }
+
+func (s PriceStratifiedSampler) Sample(rng *rand.Rand, baseFee *big.Int, txs []*types.Transaction, size int) []*types.Transaction {
+	count := s.Strata
+	if count < 1 {
+		count = defaultPriceStrata
+	}
+	if count > len(txs) {
+		count = len(txs)
+	}
+
+	prices := make([]*big.Int, len(txs))
+	byPrice := make([]int, len(txs))
+	for i, tx := range txs {
+		prices[i] = paidGasPrice(tx, baseFee)
+		byPrice[i] = i
+	}
+	//stable, equal prices keep their block order
+	sort.SliceStable(byPrice, func(i, j int) bool { return prices[byPrice[i]].Cmp(prices[byPrice[j]]) < 0 })
+
+	strata := make([][]int, count)
+	for i := range strata {
+		strata[i] = byPrice[i*len(txs)/count : (i+1)*len(txs)/count]
+	}
+	return pickTransactions(txs, stratifiedIndices(rng, strata, size))
+}
+
+// AllSampler takes every transaction.
+type AllSampler struct{}
+
+func (AllSampler) Name() SamplingStrategy { return SampleAll }
+
+func (AllSampler) Sample(rng *rand.Rand, baseFee *big.Int, txs []*types.Transaction, size int) []*types.Transaction {
+	return append([]*types.Transaction{}, txs...)
+}
+
+// samplingCandidates returns the transactions of block that can be sampled, contract
+// creations left out.
+func samplingCandidates(block *types.Block) []*types.Transaction {
+	var candidates []*types.Transaction
+	for _, tx := range block.Transactions() {
+		if tx.To() != nil {
+			candidates = append(candidates, tx)
+		}
+	}
+	return candidates
+}
+
+// uniformIndices returns size distinct indices below n, all of them when n is not larger.
+func uniformIndices(rng *rand.Rand, n, size int) []int {
+	indices := make([]int, n)
+	for i := range indices {
+		indices[i] = i
+	}
+	if size >= n {
+		return indices
+	}
+	if size < 0 {
+		size = 0
+	}
+	for i := 0; i < size; i++ {
+		j := i + rng.Intn(n-i)
+		indices[i], indices[j] = indices[j], indices[i]
+	}
+	return indices[:size]
+}
+
+// stratifiedIndices allocates size over the strata in proportion to their sizes, largest
+// remainders first, and draws the share of every stratum uniformly from it.
+func stratifiedIndices(rng *rand.Rand, strata [][]int, size int) []int {
+	total := 0
+	for _, stratum := range strata {
+		total += len(stratum)
+	}
+	if size > total {
+		size = total
+	}
+	if size < 1 {
+		return nil
+	}
+
+	shares := make([]int, len(strata))
+	remainders := make([]int, len(strata))
+	allocated := 0
+	for i, stratum := range strata {
+		shares[i] = len(stratum) * size / total
+		remainders[i] = len(stratum) * size % total
+		allocated += shares[i]
+	}
+	order := make([]int, len(strata))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return remainders[order[i]] > remainders[order[j]] })
+	//every remainder is below total, so one extra per stratum covers what is left
+	for _, i := range order[:size-allocated] {
+		shares[i]++
+	}
+
+	var indices []int
+	for i, stratum := range strata {
+		for _, picked := range uniformIndices(rng, len(stratum), shares[i]) {
+			indices = append(indices, stratum[picked])
+		}
+	}
+	return indices
+}
+
+// pickTransactions returns the transactions at indices in block order.
+func pickTransactions(txs []*types.Transaction, indices []int) []*types.Transaction {
+	sorted := append([]int{}, indices...)
+	sort.Ints(sorted)
+	picked := make([]*types.Transaction, len(sorted))
+	for i, index := range sorted {
+		picked[i] = txs[index]
+	}
+	return picked
+}
+
+// BlockSampleSeed is the seed of the random numbers a block is sampled with: the first 63
+// bits of the SHA-256 of the job seed and the block number, both big endian. Sampling a
+// block again with the same seed, sampler and size gives the same transactions, whichever
+// run or worker does it.
+func BlockSampleSeed(jobSeed int64, number uint64) int64 {
+	var input [16]byte
+	binary.BigEndian.PutUint64(input[:8], uint64(jobSeed))
+	binary.BigEndian.PutUint64(input[8:], number)
+	sum := sha256.Sum256(input[:])
+	return int64(binary.BigEndian.Uint64(sum[:8]) >> 1)
+}
+
+// newJobSeed returns a random job seed, never zero as zero means "choose one".
+func newJobSeed() int64 {
+	seed := rand.New(rand.NewSource(time.Now().UnixNano())).Int63()
+	if seed == 0 {
+		seed = 1
+	}
+	return seed
+}
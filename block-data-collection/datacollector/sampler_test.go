@@ -0,0 +1,292 @@
+package datacollector
+
+import (
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// testTransactions returns legacy transactions paying the given gas prices, in block order,
+// followed by dynamic fee transactions paying the base fee plus the given tips.
+func testTransactions(legacyPrices []int64, dynamicTips []int64) []*types.Transaction {
+	to := common.HexToAddress("0x1")
+	var txs []*types.Transaction
+	for _, price := range legacyPrices {
+		txs = append(txs, types.NewTx(&types.LegacyTx{Nonce: uint64(len(txs)), To: &to, GasPrice: big.NewInt(price)}))
+	}
+	for _, tip := range dynamicTips {
+		txs = append(txs, types.NewTx(&types.DynamicFeeTx{Nonce: uint64(len(txs)), To: &to, GasTipCap: big.NewInt(tip), GasFeeCap: big.NewInt(1000)}))
+	}
+	return txs
+}
+
+// checkIndices fails unless indices holds size distinct indices below n.
+func checkIndices(t *testing.T, indices []int, n int, size int) {
+	t.Helper()
+	if len(indices) != size {
+		t.Fatalf("got %d indices, want %d", len(indices), size)
+	}
+	seen := make(map[int]bool)
+	for _, index := range indices {
+		if index < 0 || index >= n {
+			t.Fatalf("index %d out of range [0, %d)", index, n)
+		}
+		if seen[index] {
+			t.Fatalf("index %d picked twice", index)
+		}
+		seen[index] = true
+	}
+}
+
+func TestUniformIndices(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		size int
+		want int
+	}{
+		{"sample", 10, 3, 3},
+		{"size of block", 5, 5, 5},
+		{"larger than block", 5, 9, 5},
+		{"empty sample", 5, 0, 0},
+		{"negative size", 5, -1, 0},
+		{"empty block", 0, 3, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			indices := uniformIndices(rand.New(rand.NewSource(1)), test.n, test.size)
+			checkIndices(t, indices, test.n, test.want)
+		})
+	}
+}
+
+func TestUniformIndicesCoverEveryIndex(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	counts := make([]int, 10)
+	for i := 0; i < 2000; i++ {
+		for _, index := range uniformIndices(rng, len(counts), 3) {
+			counts[index]++
+		}
+	}
+	//every index is expected 600 times
+	for index, count := range counts {
+		if count < 450 || count > 750 {
+			t.Errorf("index %d picked %d times out of 2000 draws of 3", index, count)
+		}
+	}
+}
+
+func TestStratifiedIndices(t *testing.T) {
+	tests := []struct {
+		name   string
+		strata []int
+		size   int
+		want   []int
+	}{
+		{"proportional", []int{6, 3, 1}, 5, []int{3, 2, 0}},
+		{"largest remainder first", []int{2, 2}, 3, []int{2, 1}},
+		{"even split", []int{4, 4, 4, 4}, 8, []int{2, 2, 2, 2}},
+		{"larger than block", []int{6, 3, 1}, 20, []int{6, 3, 1}},
+		{"empty stratum", []int{5, 0, 5}, 4, []int{2, 0, 2}},
+		{"empty sample", []int{6, 3, 1}, 0, []int{0, 0, 0}},
+		{"no strata", nil, 3, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			//stratum i holds the indices i*100 and up
+			strata := make([][]int, len(test.strata))
+			for i, size := range test.strata {
+				for j := 0; j < size; j++ {
+					strata[i] = append(strata[i], i*100+j)
+				}
+			}
+
+			indices := stratifiedIndices(rand.New(rand.NewSource(1)), strata, test.size)
+			got := make([]int, len(test.strata))
+			seen := make(map[int]bool)
+			for _, index := range indices {
+				if seen[index] {
+					t.Fatalf("index %d picked twice", index)
+				}
+				seen[index] = true
+				got[index/100]++
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("picked %v from the strata, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSamplers(t *testing.T) {
+	baseFee := big.NewInt(100)
+	txs := testTransactions([]int64{50, 10, 80, 20, 70, 30, 60, 40}, []int64{1, 2, 3, 4})
+
+	tests := []struct {
+		strategy SamplingStrategy
+		size     int
+		want     int
+	}{
+		{SampleUniform, 5, 5},
+		{SampleUniform, 20, 12},
+		{SampleReservoir, 5, 5},
+		{SampleReservoir, 20, 12},
+		{SampleReservoir, 0, 0},
+		{SampleStratifiedType, 6, 6},
+		{SampleStratifiedPrice, 4, 4},
+		{SampleStratifiedPrice, 20, 12},
+		{SampleAll, 3, 12},
+	}
+	for _, test := range tests {
+		t.Run(string(test.strategy), func(t *testing.T) {
+			sampler, err := NewSampler(test.strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sample := sampler.Sample(rand.New(rand.NewSource(7)), baseFee, txs, test.size)
+			if len(sample) != test.want {
+				t.Fatalf("sampled %d transactions, want %d", len(sample), test.want)
+			}
+			//block order, so no transaction twice either
+			for i := 1; i < len(sample); i++ {
+				if sample[i].Nonce() <= sample[i-1].Nonce() {
+					t.Fatalf("sample is not in block order: nonce %d after %d", sample[i].Nonce(), sample[i-1].Nonce())
+				}
+			}
+
+			again := sampler.Sample(rand.New(rand.NewSource(7)), baseFee, txs, test.size)
+			for i := range sample {
+				if sample[i].Hash() != again[i].Hash() {
+					t.Fatalf("the same seed sampled different transactions")
+				}
+			}
+		})
+	}
+}
+
+func TestTypeStratifiedSampler(t *testing.T) {
+	//9 legacy and 3 dynamic fee transactions, a quarter of the sample is dynamic fee
+	txs := testTransactions([]int64{1, 2, 3, 4, 5, 6, 7, 8, 9}, []int64{1, 2, 3})
+	for seed := int64(0); seed < 20; seed++ {
+		sample := TypeStratifiedSampler{}.Sample(rand.New(rand.NewSource(seed)), big.NewInt(100), txs, 8)
+		counts := make(map[uint8]int)
+		for _, tx := range sample {
+			counts[tx.Type()]++
+		}
+		if counts[types.LegacyTxType] != 6 || counts[types.DynamicFeeTxType] != 2 {
+			t.Fatalf("seed %d: sampled %d legacy and %d dynamic fee transactions, want 6 and 2", seed, counts[types.LegacyTxType], counts[types.DynamicFeeTxType])
+		}
+	}
+}
+
+func TestPriceStratifiedSampler(t *testing.T) {
+	prices := []int64{50, 10, 80, 20, 70, 30, 60, 40}
+	txs := testTransactions(prices, nil)
+
+	tests := []struct {
+		strata int
+		size   int
+		//number of transactions sampled from every len(want)-th of the prices 10 to 80
+		want []int
+	}{
+		{0, 4, []int{1, 1, 1, 1}},
+		{4, 8, []int{2, 2, 2, 2}},
+		{2, 4, []int{2, 2}},
+		{8, 4, nil},
+	}
+	for _, test := range tests {
+		for seed := int64(0); seed < 20; seed++ {
+			sample := PriceStratifiedSampler{Strata: test.strata}.Sample(rand.New(rand.NewSource(seed)), nil, txs, test.size)
+			if len(sample) != test.size {
+				t.Fatalf("%d strata: sampled %d transactions, want %d", test.strata, len(sample), test.size)
+			}
+			if test.want == nil {
+				continue
+			}
+
+			got := make([]int, len(test.want))
+			for _, tx := range sample {
+				got[(tx.GasPrice().Int64()-1)*int64(len(got))/80]++
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("%d strata, seed %d: sampled %v from the price ranges, want %v", test.strata, seed, got, test.want)
+				}
+			}
+		}
+	}
+}
+
+func TestPriceStrata(t *testing.T) {
+	tests := []struct {
+		sampler Sampler
+		want    int
+	}{
+		{UniformSampler{}, 0},
+		{TypeStratifiedSampler{}, 0},
+		{PriceStratifiedSampler{}, defaultPriceStrata},
+		{PriceStratifiedSampler{Strata: 10}, 10},
+	}
+	for _, test := range tests {
+		if got := priceStrata(test.sampler); got != test.want {
+			t.Errorf("priceStrata(%s) = %d, want %d", test.sampler.Name(), got, test.want)
+		}
+	}
+}
+
+func TestBlockSampleSeed(t *testing.T) {
+	//the seeds are recorded with the samples, a change would make them unreproducible
+	tests := []struct {
+		jobSeed int64
+		number  uint64
+		want    int64
+	}{
+		{1, 0, 4331357562117541681},
+		{1, 1, 2996852393724431962},
+		{42, 17000000, 3323031810144798260},
+		{-5, 3, 2741043206519200877},
+	}
+	for _, test := range tests {
+		if got := BlockSampleSeed(test.jobSeed, test.number); got != test.want {
+			t.Errorf("BlockSampleSeed(%d, %d) = %d, want %d", test.jobSeed, test.number, got, test.want)
+		}
+	}
+}
+
+func TestBlockSampleSeedSamplesAgain(t *testing.T) {
+	txs := testTransactions([]int64{50, 10, 80, 20, 70, 30, 60, 40, 90, 15}, nil)
+	sample := func(jobSeed int64, number uint64) []*types.Transaction {
+		rng := rand.New(rand.NewSource(BlockSampleSeed(jobSeed, number)))
+		return UniformSampler{}.Sample(rng, nil, txs, 4)
+	}
+	same := func(a []*types.Transaction, b []*types.Transaction) bool {
+		for i := range a {
+			if a[i].Hash() != b[i].Hash() {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !same(sample(7, 100), sample(7, 100)) {
+		t.Error("the same job seed and block sampled different transactions")
+	}
+	//the neighbouring blocks and jobs draw independently, 4 of 10 agree by chance once in 210
+	differs := 0
+	for i := uint64(0); i < 10; i++ {
+		if !same(sample(7, 100+i), sample(7, 101+i)) {
+			differs++
+		}
+		if !same(sample(7, 100+i), sample(8, 100+i)) {
+			differs++
+		}
+	}
+	if differs < 18 {
+		t.Errorf("only %d of 20 neighbouring blocks and jobs sampled different transactions", differs)
+	}
+}
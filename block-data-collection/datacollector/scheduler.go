@@ -0,0 +1,201 @@
+package datacollector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultFailureRetryDelay is how long the scheduler waits before trying a failed day again.
+const DefaultFailureRetryDelay = time.Hour
+
+// DefaultNotEndedRetryDelay is how long the scheduler waits before trying again a day whose
+// last block does not have its confirmations yet.
+const DefaultNotEndedRetryDelay = 5 * time.Minute
+
+// DailyJob collects one UTC day, startTime and endTime are RFC3339 midnights.
+type DailyJob func(ctx context.Context, startTime string, endTime string) error
+
+// DailyScheduler runs a DailyJob for every finished UTC day once the configured time of day
+// has passed. Completed days are taken from the job checkpoints, so the days missed while
+// the collector was down are caught up oldest first, and a day is never collected twice.
+// Days are collected one at a time, jobs never overlap, and with a LockPath neither do the
+// rounds of two collectors sharing the checkpoints on one machine.
+type DailyScheduler struct {
+	//offset from UTC midnight at which the previous day is collected
+	At time.Duration
+	//number of finished days, counting back from yesterday, that are kept complete
+	CatchUpDays int
+	Checkpoints CheckpointStore
+	Job         DailyJob
+	//called after a round of jobs that collected at least one day, optional
+	AfterRun func()
+	//wait before retrying a failed day, DefaultFailureRetryDelay when zero
+	FailureRetryDelay time.Duration
+	//wait before retrying a day the chain has not passed yet, DefaultNotEndedRetryDelay when zero
+	NotEndedRetryDelay time.Duration
+	//lock file held during every round of jobs, optional
+	LockPath string
+}
+
+// Run collects the pending days and then sleeps until the next day is due, until ctx is
+// cancelled.
+func (s *DailyScheduler) Run(ctx context.Context) error {
+	for {
+		retryDelay, err := s.runRound(ctx)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		wake := s.NextRun(now)
+		if retryDelay > 0 {
+			if retry := now.Add(retryDelay); retry.Before(wake) {
+				wake = retry
+			}
+		}
+
+		fmt.Println("Next daily run at ", wake.Format(time.RFC3339))
+		timer := time.NewTimer(wake.Sub(now))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// runRound runs the pending days while holding the lock file, and AfterRun when a day was
+// collected, not after the retries of a day the chain has not passed yet. A round is
+// skipped, and tried again after the failure retry delay, while another process holds it.
+func (s *DailyScheduler) runRound(ctx context.Context) (time.Duration, error) {
+	if s.LockPath != "" {
+		lock, err := LockFile(s.LockPath)
+		if errors.Is(err, ErrLocked) {
+			fmt.Println("Skipping the daily run : ", err)
+			return shorterDelay(0, s.FailureRetryDelay, DefaultFailureRetryDelay), nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		defer lock.Unlock()
+	}
+
+	collected, retryDelay, err := s.RunPending(ctx)
+	if err != nil {
+		return retryDelay, err
+	}
+	if collected > 0 && s.AfterRun != nil {
+		s.AfterRun()
+	}
+	return retryDelay, nil
+}
+
+// RunPending collects every pending day, oldest first. A failed day is reported and the
+// next one is still tried, it stays pending like a day whose end the chain has not passed
+// yet (ErrRangeNotEnded). It returns the number of days collected and how long to wait
+// before trying the others again, zero when no day is left pending. The error is only set
+// when ctx was cancelled or the checkpoints cannot be read.
+func (s *DailyScheduler) RunPending(ctx context.Context) (int, time.Duration, error) {
+	days, err := s.PendingDays(time.Now())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	collected := 0
+	var retryDelay time.Duration
+	for _, day := range days {
+		if ctx.Err() != nil {
+			return collected, retryDelay, ctx.Err()
+		}
+
+		startTime, endTime := DayRange(day)
+		fmt.Println("Collecting ", day.Format("2006-01-02"))
+		errWhenCollecting := s.Job(ctx, startTime, endTime)
+		if ctx.Err() != nil {
+			return collected, retryDelay, ctx.Err()
+		}
+		if errWhenCollecting == nil {
+			collected++
+		} else if errors.Is(errWhenCollecting, ErrRangeNotEnded) {
+			fmt.Println("Collection of ", day.Format("2006-01-02"), " postponed : ", errWhenCollecting)
+			retryDelay = shorterDelay(retryDelay, s.NotEndedRetryDelay, DefaultNotEndedRetryDelay)
+		} else {
+			fmt.Println("Collection of ", day.Format("2006-01-02"), " failed : ", errWhenCollecting)
+			retryDelay = shorterDelay(retryDelay, s.FailureRetryDelay, DefaultFailureRetryDelay)
+		}
+	}
+	return collected, retryDelay, nil
+}
+
+// shorterDelay returns the shorter of current, when set, and delay or else its default.
+func shorterDelay(current time.Duration, delay time.Duration, defaultDelay time.Duration) time.Duration {
+	if delay <= 0 {
+		delay = defaultDelay
+	}
+	if current > 0 && current < delay {
+		return current
+	}
+	return delay
+}
+
+// PendingDays returns the due days within the catch up window that have not been
+// completed yet, oldest first.
+func (s *DailyScheduler) PendingDays(now time.Time) ([]time.Time, error) {
+	catchUpDays := s.CatchUpDays
+	if catchUpDays < 1 {
+		catchUpDays = 1
+	}
+
+	var days []time.Time
+	for _, day := range s.RecentDays(now, catchUpDays) {
+		if s.Checkpoints != nil {
+			startTime, endTime := DayRange(day)
+			checkpoint, err := s.Checkpoints.Load(GasJobName(startTime, endTime))
+			if err != nil {
+				return nil, fmt.Errorf("loading checkpoint: %w", err)
+			}
+			if checkpoint != nil && checkpoint.Completed() {
+				continue
+			}
+		}
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+// NextRun returns the first time after now at which a new day becomes due.
+func (s *DailyScheduler) NextRun(now time.Time) time.Time {
+	now = now.UTC()
+	next := now.Truncate(24 * time.Hour).Add(s.At)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// RecentDays returns the last count due days, oldest first.
+func (s *DailyScheduler) RecentDays(now time.Time, count int) []time.Time {
+	lastDue := s.lastDueDay(now)
+	days := make([]time.Time, 0, count)
+	for i := count - 1; i >= 0; i-- {
+		days = append(days, lastDue.AddDate(0, 0, -i))
+	}
+	return days
+}
+
+// lastDueDay returns the most recent day whose collection time has passed.
+func (s *DailyScheduler) lastDueDay(now time.Time) time.Time {
+	today := now.UTC().Truncate(24 * time.Hour)
+	if now.UTC().Before(today.Add(s.At)) {
+		return today.AddDate(0, 0, -2)
+	}
+	return today.AddDate(0, 0, -1)
+}
+
+// DayRange returns the job range of a UTC day, midnight to midnight.
+func DayRange(day time.Time) (string, string) {
+	return day.Format("2006-01-02T15:04:05Z"), day.AddDate(0, 0, 1).Format("2006-01-02T15:04:05Z")
+}
@@ -0,0 +1,54 @@
+package datacollector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDailySchedulerRound(t *testing.T) {
+	tests := []struct {
+		name string
+		//results of the jobs of the round, oldest day first
+		results   []error
+		wantDelay time.Duration
+		afterRun  bool
+	}{
+		{"collected", []error{nil, nil}, 0, true},
+		{"day not ended", []error{nil, fmt.Errorf("day: %w", ErrRangeNotEnded)}, time.Minute, true},
+		{"only the day not ended", []error{fmt.Errorf("day: %w", ErrRangeNotEnded)}, time.Minute, false},
+		{"failed", []error{errors.New("rpc down")}, time.Hour, false},
+		{"failed and not ended", []error{errors.New("rpc down"), ErrRangeNotEnded}, time.Minute, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			jobs, afterRuns := 0, 0
+			scheduler := &DailyScheduler{
+				CatchUpDays: len(test.results),
+				Job: func(ctx context.Context, startTime string, endTime string) error {
+					jobs++
+					return test.results[jobs-1]
+				},
+				AfterRun:           func() { afterRuns++ },
+				FailureRetryDelay:  time.Hour,
+				NotEndedRetryDelay: time.Minute,
+			}
+
+			delay, err := scheduler.runRound(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if jobs != len(test.results) {
+				t.Fatalf("ran %d jobs, want %d", jobs, len(test.results))
+			}
+			if delay != test.wantDelay {
+				t.Fatalf("retry in %s, want %s", delay, test.wantDelay)
+			}
+			if (afterRuns == 1) != test.afterRun || afterRuns > 1 {
+				t.Fatalf("AfterRun called %d times, want it called: %v", afterRuns, test.afterRun)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package datacollector
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OutputFormat is the file format the records are written in, or the database they are
+// stored in.
+type OutputFormat string
+
+const (
+	FormatCSV OutputFormat = "csv"
+	//newline delimited JSON, one TransactionRecord per line
+	FormatJSONL OutputFormat = "jsonl"
+	//Apache Parquet, amounts as DECIMAL(38,0) wei
+	FormatParquet OutputFormat = "parquet"
+	//no files, the samples are stored in a SQLite database
+	FormatSQLite OutputFormat = "sqlite"
+	//no files, the samples and block aggregates are stored in PostgreSQL or TimescaleDB
+	FormatPostgres OutputFormat = "postgres"
+)
+
+// OutputFormats lists the file formats.
+var OutputFormats = []OutputFormat{FormatCSV, FormatJSONL, FormatParquet}
+
+// IsDatabase reports whether the format stores the samples in a database instead of files.
+func (f OutputFormat) IsDatabase() bool {
+	return f == FormatSQLite || f == FormatPostgres
+}
+
+// Extension returns the file extension of the format, with its dot.
+func (f OutputFormat) Extension() string {
+	if f == "" {
+		return ".csv"
+	}
+	return "." + string(f)
+}
+
+// IsOutputFile reports whether path has the extension of one of the output formats.
+func IsOutputFile(path string) bool {
+	return formatOf(path) != ""
+}
+
+// formatOf returns the format of a file by its extension, empty for other files.
+func formatOf(path string) OutputFormat {
+	extension := filepath.Ext(path)
+	for _, format := range OutputFormats {
+		if extension == format.Extension() {
+			return format
+		}
+	}
+	return ""
+}
+
+// Sink writes TransactionRecords in one format. The caller owns the file: Open starts
+// writing to it and Close finishes the format (the Parquet footer, for example) without
+// closing the writer.
+type Sink interface {
+	Open(w io.Writer) error
+	Write(record *TransactionRecord) error
+	//Flush pushes the buffered records to the writer
+	Flush() error
+	Close() error
+}
+
+// newSink creates a sink of format; columns are the csv columns and are ignored by the
+// other formats, which always write the whole record.
+func newSink(format OutputFormat, columns []recordColumn) (Sink, error) {
+	switch format {
+	case FormatCSV, "":
+		return &csvSink{columns: columns}, nil
+	case FormatJSONL:
+		return &jsonlSink{}, nil
+	case FormatParquet:
+		return &parquetSink{}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// writeRecordFile writes records to path in format with writeFileAtomically.
+func writeRecordFile(path string, format OutputFormat, columns []recordColumn, records []*TransactionRecord) error {
+	return writeFileAtomically(path, func(w io.Writer) error {
+		return writeRecords(w, format, columns, records)
+	})
+}
+
+// writeRecords writes records to w in format.
+func writeRecords(w io.Writer, format OutputFormat, columns []recordColumn, records []*TransactionRecord) error {
+	sink, err := newSink(format, columns)
+	if err != nil {
+		return err
+	}
+
+	err = sink.Open(w)
+	for _, record := range records {
+		if err != nil {
+			return err
+		}
+		err = sink.Write(record)
+	}
+	if err != nil {
+		return err
+	}
+	return sink.Close()
+}
+
+// csvSink writes a header and one row per record.
+type csvSink struct {
+	columns []recordColumn
+	writer  *csv.Writer
+}
+
+func (s *csvSink) Open(w io.Writer) error {
+	s.writer = csv.NewWriter(w)
+	return s.writer.Write(columnNames(s.columns))
+}
+
+func (s *csvSink) Write(record *TransactionRecord) error {
+	row := make([]string, len(s.columns))
+	for i, column := range s.columns {
+		row[i] = column.format(record)
+	}
+	return s.writer.Write(row)
+}
+
+func (s *csvSink) Flush() error {
+	s.writer.Flush()
+	return s.writer.Error()
+}
+
+func (s *csvSink) Close() error {
+	return s.Flush()
+}
+
+// jsonlSink writes one JSON object per line.
+type jsonlSink struct {
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func (s *jsonlSink) Open(w io.Writer) error {
+	s.writer = bufio.NewWriter(w)
+	s.encoder = json.NewEncoder(s.writer)
+	return nil
+}
+
+func (s *jsonlSink) Write(record *TransactionRecord) error {
+	return s.encoder.Encode(record)
+}
+
+func (s *jsonlSink) Flush() error {
+	return s.writer.Flush()
+}
+
+func (s *jsonlSink) Close() error {
+	return s.Flush()
+}
+
+// readGasRecords reads a gas sample file of any format. Csv files are read with the columns
+// matching their header, so the block number is only set for day and block range files.
+func readGasRecords(path string) ([]*TransactionRecord, error) {
+	if strings.HasSuffix(path, partialSuffix) {
+		return readJSONLines[TransactionRecord](path)
+	}
+
+	switch formatOf(path) {
+	case FormatJSONL:
+		return readJSONLines[TransactionRecord](path)
+	case FormatParquet:
+		return readParquetRecords(path)
+	case FormatCSV:
+		rows, err := readCsvRecords(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			return nil, fmt.Errorf("empty file")
+		}
+		columns := gasSampleColumns
+		if len(rows[0]) > 0 && rows[0][0] == blockColumn.name {
+			columns = consolidatedColumns
+		}
+		if strings.Join(rows[0], ",") != strings.Join(columnNames(columns), ",") {
+			return nil, fmt.Errorf("unexpected header %v", rows[0])
+		}
+
+		records := make([]*TransactionRecord, 0, len(rows)-1)
+		for i, row := range rows[1:] {
+			record, err := parseRecord(columns, row)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+2, err)
+			}
+			records = append(records, record)
+		}
+		return records, nil
+	default:
+		return nil, fmt.Errorf("unknown output format of %s", filepath.Base(path))
+	}
+}
+
+func readCsvRecords(path string) ([][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	return reader.ReadAll()
+}
@@ -0,0 +1,523 @@
+package datacollector
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSchema creates the tables on first use. Times are unix seconds, gas amounts and the
+// value are decimal text in wei as they do not always fit an integer.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS blocks (
+	number               INTEGER PRIMARY KEY,
+	timestamp            INTEGER NOT NULL,
+	hash                 TEXT,
+	parent_hash          TEXT,
+	transactions_sampled INTEGER NOT NULL,
+	transactions_skipped INTEGER NOT NULL,
+	sampler              TEXT,
+	sample_seed          INTEGER,
+	sample_size          INTEGER,
+	price_strata         INTEGER,
+	collected_at         INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS blocks_timestamp ON blocks (timestamp);
+
+CREATE TABLE IF NOT EXISTS block_aggregates (
+	number                     INTEGER PRIMARY KEY REFERENCES blocks (number) ON DELETE CASCADE,
+	transactions_aggregated    INTEGER NOT NULL,
+	base_fee                   TEXT,
+	gas_used                   INTEGER NOT NULL,
+	gas_limit                  INTEGER NOT NULL,
+	min_effective_gas_price    TEXT,
+	p10_effective_gas_price    TEXT,
+	p25_effective_gas_price    TEXT,
+	median_effective_gas_price TEXT,
+	mean_effective_gas_price   TEXT,
+	p75_effective_gas_price    TEXT,
+	p90_effective_gas_price    TEXT,
+	p99_effective_gas_price    TEXT,
+	max_effective_gas_price    TEXT,
+	min_effective_tip          TEXT,
+	p10_effective_tip          TEXT,
+	p25_effective_tip          TEXT,
+	median_effective_tip       TEXT,
+	mean_effective_tip         TEXT,
+	p75_effective_tip          TEXT,
+	p90_effective_tip          TEXT,
+	p99_effective_tip          TEXT,
+	max_effective_tip          TEXT
+);
+
+CREATE TABLE IF NOT EXISTS sampled_transactions (
+	hash                     TEXT PRIMARY KEY,
+	block                    INTEGER NOT NULL REFERENCES blocks (number) ON DELETE CASCADE,
+	timestamp                INTEGER NOT NULL,
+	from_address             TEXT NOT NULL,
+	to_address               TEXT,
+	type                     INTEGER NOT NULL,
+	value                    TEXT,
+	gas_price                TEXT,
+	base_fee                 TEXT,
+	max_fee_per_gas          TEXT,
+	max_priority_fee_per_gas TEXT,
+	effective_gas_price      TEXT,
+	effective_tip            TEXT,
+	gas_used                 INTEGER NOT NULL,
+	input_length             INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sampled_transactions_block ON sampled_transactions (block);
+CREATE INDEX IF NOT EXISTS sampled_transactions_timestamp ON sampled_transactions (timestamp);
+
+CREATE TABLE IF NOT EXISTS job_runs (
+	id                   INTEGER PRIMARY KEY AUTOINCREMENT,
+	job                  TEXT NOT NULL,
+	status               TEXT NOT NULL,
+	start_block          INTEGER,
+	end_block            INTEGER,
+	resumed              INTEGER NOT NULL DEFAULT 0,
+	blocks_processed     INTEGER NOT NULL DEFAULT 0,
+	transactions_sampled INTEGER NOT NULL DEFAULT 0,
+	transactions_skipped INTEGER NOT NULL DEFAULT 0,
+	errors               INTEGER NOT NULL DEFAULT 0,
+	error                TEXT,
+	sampler              TEXT,
+	sample_seed          INTEGER,
+	started_at           INTEGER NOT NULL,
+	finished_at          INTEGER
+);
+CREATE INDEX IF NOT EXISTS job_runs_job ON job_runs (job);
+
+CREATE TABLE IF NOT EXISTS checkpoints (
+	job          TEXT PRIMARY KEY,
+	start_block  INTEGER NOT NULL,
+	end_block    INTEGER NOT NULL,
+	next_block   INTEGER NOT NULL,
+	sampler      TEXT,
+	sample_seed  INTEGER,
+	sample_size  INTEGER,
+	price_strata INTEGER,
+	updated_at   INTEGER NOT NULL
+);
+`
+
+// sqliteAddedColumns are the columns added to the tables after they were first created,
+// added to older databases on open. CREATE TABLE above already has them.
+var sqliteAddedColumns = []struct{ table, column, definition string }{
+	{"blocks", "sampler", "TEXT"},
+	{"blocks", "hash", "TEXT"},
+	{"blocks", "parent_hash", "TEXT"},
+	{"blocks", "sample_seed", "INTEGER"},
+	{"job_runs", "sampler", "TEXT"},
+	{"job_runs", "sample_seed", "INTEGER"},
+	{"checkpoints", "sampler", "TEXT"},
+	{"checkpoints", "sample_seed", "INTEGER"},
+	{"blocks", "sample_size", "INTEGER"},
+	{"blocks", "price_strata", "INTEGER"},
+	{"checkpoints", "sample_size", "INTEGER"},
+	{"checkpoints", "price_strata", "INTEGER"},
+}
+
+// SQLiteStore keeps the gas samples, the per-block aggregates, the job runs and the
+// checkpoints in one SQLite database. It is a GasStore, a JobRunRecorder and a
+// CheckpointStore.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLiteStore opens the database at path, creating it and its tables when needed.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+	//SQLite has a single writer, one connection avoids "database is locked" between workers
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating the tables of %s: %w", path, err)
+	}
+	err = addSQLiteColumns(db)
+	if err == nil {
+		err = textSQLiteAmounts(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("updating the tables of %s: %w", path, err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// addSQLiteColumns adds the sqliteAddedColumns a table does not have yet.
+func addSQLiteColumns(db *sql.DB) error {
+	existing := make(map[string]bool)
+	for _, added := range sqliteAddedColumns {
+		if _, ok := existing[added.table]; ok {
+			continue
+		}
+		existing[added.table] = true
+		rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, added.table)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var name string
+			err = rows.Scan(&name)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			existing[added.table+"."+name] = true
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	for _, added := range sqliteAddedColumns {
+		if existing[added.table+"."+added.column] {
+			continue
+		}
+		_, err := db.Exec(`ALTER TABLE ` + added.table + ` ADD COLUMN ` + added.column + ` ` + added.definition)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteAmountTables are the tables holding gas amounts, which older databases created
+// with integer columns
+var sqliteAmountTables = []string{"block_aggregates", "sampled_transactions"}
+
+// textSQLiteAmounts recreates the amount tables of an older database with text columns and
+// copies their rows over, so amounts above the int64 range are not turned into reals.
+func textSQLiteAmounts(db *sql.DB) error {
+	var columnType string
+	err := db.QueryRow(`SELECT type FROM pragma_table_info('block_aggregates') WHERE name = 'base_fee'`).Scan(&columnType)
+	if err != nil || strings.EqualFold(columnType, "TEXT") {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	//the indexes move with a renamed table, the schema creates them again on the new one
+	_, err = tx.Exec(`DROP INDEX IF EXISTS sampled_transactions_block; DROP INDEX IF EXISTS sampled_transactions_timestamp`)
+	if err != nil {
+		return err
+	}
+	for _, table := range sqliteAmountTables {
+		_, err = tx.Exec(`ALTER TABLE ` + table + ` RENAME TO ` + table + `_integer`)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(sqliteSchema)
+	if err != nil {
+		return err
+	}
+	for _, table := range sqliteAmountTables {
+		//integers stored in a text column are converted to their decimal text
+		_, err = tx.Exec(`INSERT INTO ` + table + ` SELECT * FROM ` + table + `_integer; DROP TABLE ` + table + `_integer`)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// Flush does nothing, every block is written when it arrives.
+func (s *SQLiteStore) Flush() error {
+	return nil
+}
+
+func (s *SQLiteStore) WriteBlock(block *BlockSamples) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	//a transaction sampled twice is stored once
+	hashes := make(map[common.Hash]bool)
+	for _, record := range block.Records {
+		hashes[record.Hash] = true
+	}
+
+	_, err = tx.Exec(`INSERT INTO blocks (number, timestamp, hash, parent_hash, transactions_sampled, transactions_skipped, sampler,
+			sample_seed, sample_size, price_strata, collected_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (number) DO UPDATE SET timestamp = excluded.timestamp, hash = excluded.hash, parent_hash = excluded.parent_hash,
+			transactions_sampled = excluded.transactions_sampled,
+			transactions_skipped = excluded.transactions_skipped, sampler = excluded.sampler, sample_seed = excluded.sample_seed,
+			sample_size = excluded.sample_size, price_strata = excluded.price_strata, collected_at = excluded.collected_at`,
+		int64(block.Number), block.Timestamp.Unix(), sqlHash(block.Hash), sqlHash(block.ParentHash), len(hashes), int64(block.Skipped), string(block.Sampler), block.SampleSeed,
+		block.SampleSize, block.PriceStrata, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	if block.Aggregate != nil {
+		values := sqlAggregateValues(block.Aggregate)
+		_, err = tx.Exec(`INSERT OR REPLACE INTO block_aggregates VALUES (`+strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")+`)`, values...)
+		if err != nil {
+			return err
+		}
+	}
+
+	//a block collected again gets a new sample, the previous one is replaced
+	_, err = tx.Exec(`DELETE FROM sampled_transactions WHERE block = ?`, int64(block.Number))
+	if err != nil {
+		return err
+	}
+
+	insert, err := tx.Prepare(`INSERT INTO sampled_transactions (hash, block, timestamp, from_address, to_address, type, value,
+			gas_price, base_fee, max_fee_per_gas, max_priority_fee_per_gas, effective_gas_price, effective_tip, gas_used, input_length)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (hash) DO UPDATE SET block = excluded.block, timestamp = excluded.timestamp, from_address = excluded.from_address,
+			to_address = excluded.to_address, type = excluded.type, value = excluded.value, gas_price = excluded.gas_price,
+			base_fee = excluded.base_fee, max_fee_per_gas = excluded.max_fee_per_gas,
+			max_priority_fee_per_gas = excluded.max_priority_fee_per_gas, effective_gas_price = excluded.effective_gas_price,
+			effective_tip = excluded.effective_tip, gas_used = excluded.gas_used, input_length = excluded.input_length`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for _, record := range block.Records {
+		_, err = insert.Exec(sqlTransactionValues(block.Number, record)...)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// sqlHash is the hex of a hash, NULL for the zero hash.
+func sqlHash(hash common.Hash) interface{} {
+	if hash == (common.Hash{}) {
+		return nil
+	}
+	return hash.Hex()
+}
+
+// sqlWei is a gas amount as decimal text, nil stays NULL.
+func sqlWei(wei *big.Int) interface{} {
+	if wei == nil {
+		return nil
+	}
+	return wei.String()
+}
+
+// sqlTransactionValues returns the columns of a sampled transaction row, in table order.
+func sqlTransactionValues(block uint64, record *TransactionRecord) []interface{} {
+	values := []interface{}{record.Hash.Hex(), int64(block), record.Timestamp.Unix(), record.From.Hex(), nil, int64(record.Type)}
+	if record.To != nil {
+		values[4] = record.To.Hex()
+	}
+	for _, wei := range []*big.Int{record.Value, record.GasPrice, record.BaseFee, record.MaxFeePerGas, record.MaxPriorityFeePerGas,
+		record.EffectiveGasPrice, record.EffectiveTip} {
+		values = append(values, sqlWei(wei))
+	}
+	return append(values, int64(record.GasUsed), int64(record.InputLength))
+}
+
+// sqlAggregateValues returns the columns of a block aggregate row, in table order.
+func sqlAggregateValues(aggregate *BlockAggregate) []interface{} {
+	values := []interface{}{int64(aggregate.Number), aggregate.Transactions, sqlWei(aggregate.BaseFee), int64(aggregate.GasUsed), int64(aggregate.GasLimit)}
+	for _, stats := range []PriceStats{aggregate.EffectiveGasPrice, aggregate.EffectiveTip} {
+		for _, wei := range priceStatsValues(stats) {
+			values = append(values, sqlWei(wei))
+		}
+	}
+	return values
+}
+
+func (s *SQLiteStore) ScanGaps(blockRange BlockRange) (*GapReport, error) {
+	rows, err := s.db.Query(`SELECT number, transactions_sampled FROM blocks WHERE number >= ? AND number < ?`,
+		int64(blockRange.From), int64(blockRange.To))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sampled := make(map[uint64]int64)
+	for rows.Next() {
+		var number uint64
+		var count int64
+		err = rows.Scan(&number, &count)
+		if err != nil {
+			return nil, err
+		}
+		sampled[number] = count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	report := &GapReport{Range: blockRange}
+	for number := blockRange.From; number < blockRange.To; number++ {
+		count, ok := sampled[number]
+		if !ok {
+			report.Missing = append(report.Missing, number)
+		} else if count == 0 {
+			report.Empty = append(report.Empty, number)
+		}
+	}
+	return report, nil
+}
+
+func (s *SQLiteStore) ReadAggregates(from time.Time, to time.Time) ([]*BlockAggregate, error) {
+	rows, err := s.db.Query(`SELECT b.number, b.timestamp, b.hash, b.parent_hash, b.transactions_sampled, b.transactions_skipped, b.sampler, b.sample_seed,
+			a.transactions_aggregated,
+			a.base_fee, a.gas_used, a.gas_limit,
+			a.min_effective_gas_price, a.p10_effective_gas_price, a.p25_effective_gas_price, a.median_effective_gas_price,
+			a.mean_effective_gas_price, a.p75_effective_gas_price, a.p90_effective_gas_price, a.p99_effective_gas_price,
+			a.max_effective_gas_price,
+			a.min_effective_tip, a.p10_effective_tip, a.p25_effective_tip, a.median_effective_tip, a.mean_effective_tip,
+			a.p75_effective_tip, a.p90_effective_tip, a.p99_effective_tip, a.max_effective_tip
+		FROM blocks b JOIN block_aggregates a ON a.number = b.number
+		WHERE b.timestamp >= ? AND b.timestamp < ? ORDER BY b.number`, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var aggregates []*BlockAggregate
+	for rows.Next() {
+		aggregate := &BlockAggregate{}
+		var timestamp int64
+		var hash, parentHash, sampler sql.NullString
+		var seed sql.NullInt64
+		var amounts [19]sql.NullString
+		destinations := []interface{}{&aggregate.Number, &timestamp, &hash, &parentHash, &aggregate.TransactionsSampled, &aggregate.TransactionsSkipped,
+			&sampler, &seed, &aggregate.Transactions, &amounts[0], &aggregate.GasUsed, &aggregate.GasLimit}
+		for i := 1; i < len(amounts); i++ {
+			destinations = append(destinations, &amounts[i])
+		}
+		err = rows.Scan(destinations...)
+		if err != nil {
+			return nil, err
+		}
+
+		aggregate.Hash, aggregate.ParentHash = common.HexToHash(hash.String), common.HexToHash(parentHash.String)
+		aggregate.Sampler, aggregate.SampleSeed = SamplingStrategy(sampler.String), seed.Int64
+
+		wei := make([]*big.Int, len(amounts))
+		for i, amount := range amounts {
+			if !amount.Valid {
+				continue
+			}
+			var ok bool
+			wei[i], ok = new(big.Int).SetString(amount.String, 10)
+			if !ok {
+				return nil, fmt.Errorf("block %d has the amount %q, which is not an integer", aggregate.Number, amount.String)
+			}
+		}
+		aggregate.Timestamp = time.Unix(timestamp, 0).UTC()
+		aggregate.BaseFee = wei[0]
+		aggregate.EffectiveGasPrice = priceStatsFromValues(wei[1:10])
+		aggregate.EffectiveTip = priceStatsFromValues(wei[10:19])
+		aggregates = append(aggregates, aggregate)
+	}
+	return aggregates, rows.Err()
+}
+
+func (s *SQLiteStore) StartRun(job string, startedAt time.Time) (int64, error) {
+	result, err := s.db.Exec(`INSERT INTO job_runs (job, status, started_at) VALUES (?, ?, ?)`, job, RunRunning, startedAt.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (s *SQLiteStore) FinishRun(id int64, result *GasCollectionResult, err error) error {
+	var message interface{}
+	if err != nil {
+		message = err.Error()
+	}
+	_, errWhenUpdating := s.db.Exec(`UPDATE job_runs SET status = ?, start_block = ?, end_block = ?, resumed = ?, blocks_processed = ?,
+			transactions_sampled = ?, transactions_skipped = ?, errors = ?, error = ?, sampler = ?, sample_seed = ?, finished_at = ?
+		WHERE id = ?`,
+		runStatus(err), int64(result.StartBlock), int64(result.EndBlock), result.Resumed, int64(result.BlocksProcessed),
+		int64(result.TransactionsSampled), int64(result.TransactionsSkipped), int64(result.Errors), message,
+		string(result.Sampler), result.SampleSeed, time.Now().Unix(), id)
+	return errWhenUpdating
+}
+
+func (s *SQLiteStore) Load(job string) (*Checkpoint, error) {
+	checkpoint := &Checkpoint{Job: job}
+	var updatedAt int64
+	var sampler sql.NullString
+	var seed, size, strata sql.NullInt64
+	err := s.db.QueryRow(`SELECT start_block, end_block, next_block, sampler, sample_seed, sample_size, price_strata, updated_at
+		FROM checkpoints WHERE job = ?`, job).
+		Scan(&checkpoint.StartBlock, &checkpoint.EndBlock, &checkpoint.NextBlock, &sampler, &seed, &size, &strata, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	checkpoint.Sampler = SamplingStrategy(sampler.String)
+	checkpoint.SampleSeed = seed.Int64
+	checkpoint.SampleSize, checkpoint.PriceStrata = int(size.Int64), int(strata.Int64)
+	checkpoint.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+	return checkpoint, nil
+}
+
+func (s *SQLiteStore) List() ([]Checkpoint, error) {
+	rows, err := s.db.Query(`SELECT job, start_block, end_block, next_block, sampler, sample_seed, sample_size, price_strata, updated_at
+		FROM checkpoints ORDER BY job`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var checkpoints []Checkpoint
+	for rows.Next() {
+		var checkpoint Checkpoint
+		var updatedAt int64
+		var sampler sql.NullString
+		var seed, size, strata sql.NullInt64
+		err = rows.Scan(&checkpoint.Job, &checkpoint.StartBlock, &checkpoint.EndBlock, &checkpoint.NextBlock, &sampler, &seed, &size, &strata, &updatedAt)
+		if err != nil {
+			return nil, err
+		}
+		checkpoint.Sampler = SamplingStrategy(sampler.String)
+		checkpoint.SampleSeed = seed.Int64
+		checkpoint.SampleSize, checkpoint.PriceStrata = int(size.Int64), int(strata.Int64)
+		checkpoint.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	return checkpoints, rows.Err()
+}
+
+func (s *SQLiteStore) Save(checkpoint Checkpoint) error {
+	_, err := s.db.Exec(`INSERT INTO checkpoints (job, start_block, end_block, next_block, sampler, sample_seed, sample_size,
+			price_strata, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (job) DO UPDATE SET start_block = excluded.start_block, end_block = excluded.end_block,
+			next_block = excluded.next_block, sampler = excluded.sampler, sample_seed = excluded.sample_seed,
+			sample_size = excluded.sample_size, price_strata = excluded.price_strata, updated_at = excluded.updated_at`,
+		checkpoint.Job, int64(checkpoint.StartBlock), int64(checkpoint.EndBlock), int64(checkpoint.NextBlock),
+		string(checkpoint.Sampler), checkpoint.SampleSeed, checkpoint.SampleSize, checkpoint.PriceStrata, time.Now().Unix())
+	return err
+}
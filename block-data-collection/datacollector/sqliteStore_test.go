@@ -0,0 +1,241 @@
+package datacollector
+
+import (
+	"database/sql"
+	"math/big"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func openTestSQLiteStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	store, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "gas.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// testBlockSamples returns block number with one record per hash, hashes given as integers.
+func testBlockSamples(number uint64, hashes ...int64) *BlockSamples {
+	timestamp := time.Unix(1700000000+int64(number)*12, 0).UTC()
+	block := &BlockSamples{Number: number, Timestamp: timestamp, Sampler: SampleUniform, SampleSeed: 7, SampleSize: len(hashes)}
+	for _, hash := range hashes {
+		to := common.HexToAddress("0x2")
+		block.Records = append(block.Records, &TransactionRecord{Block: number, Timestamp: timestamp, Hash: common.BigToHash(big.NewInt(hash)),
+			From: common.HexToAddress("0x1"), To: &to, Type: 2, Value: big.NewInt(0), GasPrice: big.NewInt(hash * 1000), GasUsed: 21000})
+	}
+	return block
+}
+
+// sampledHashes returns the hashes stored per block, as integers.
+func sampledHashes(t *testing.T, store *SQLiteStore) map[uint64][]int64 {
+	t.Helper()
+	rows, err := store.db.Query(`SELECT block, hash FROM sampled_transactions ORDER BY block, hash`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	hashes := make(map[uint64][]int64)
+	for rows.Next() {
+		var block uint64
+		var hash string
+		if err := rows.Scan(&block, &hash); err != nil {
+			t.Fatal(err)
+		}
+		hashes[block] = append(hashes[block], common.HexToHash(hash).Big().Int64())
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return hashes
+}
+
+func TestSQLiteStoreWriteBlock(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []*BlockSamples
+		want   map[uint64][]int64
+		//transactions_sampled of the blocks
+		sampled map[uint64]int
+	}{
+		{
+			name:    "rerun writes the same rows once",
+			writes:  []*BlockSamples{testBlockSamples(10, 1, 2, 3), testBlockSamples(10, 1, 2, 3)},
+			want:    map[uint64][]int64{10: {1, 2, 3}},
+			sampled: map[uint64]int{10: 3},
+		},
+		{
+			name:    "transaction sampled twice is stored once",
+			writes:  []*BlockSamples{testBlockSamples(10, 1, 2, 2, 3)},
+			want:    map[uint64][]int64{10: {1, 2, 3}},
+			sampled: map[uint64]int{10: 3},
+		},
+		{
+			name:    "re-collect replaces the sample",
+			writes:  []*BlockSamples{testBlockSamples(10, 1, 2, 3), testBlockSamples(11, 4, 5), testBlockSamples(10, 3, 6)},
+			want:    map[uint64][]int64{10: {3, 6}, 11: {4, 5}},
+			sampled: map[uint64]int{10: 2, 11: 2},
+		},
+		{
+			name:    "re-collect without samples empties the block",
+			writes:  []*BlockSamples{testBlockSamples(10, 1, 2), testBlockSamples(10)},
+			want:    map[uint64][]int64{},
+			sampled: map[uint64]int{10: 0},
+		},
+		{
+			name:    "transaction moved to another block by a reorg",
+			writes:  []*BlockSamples{testBlockSamples(10, 1, 2), testBlockSamples(11, 2, 3)},
+			want:    map[uint64][]int64{10: {1}, 11: {2, 3}},
+			sampled: map[uint64]int{10: 2, 11: 2},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := openTestSQLiteStore(t)
+			for _, block := range test.writes {
+				if err := store.WriteBlock(block); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := sampledHashes(t, store)
+			if len(got) != len(test.want) {
+				t.Fatalf("stored %v, want %v", got, test.want)
+			}
+			for block, hashes := range test.want {
+				if len(got[block]) != len(hashes) {
+					t.Fatalf("stored %v, want %v", got, test.want)
+				}
+				for i := range hashes {
+					if got[block][i] != hashes[i] {
+						t.Fatalf("stored %v, want %v", got, test.want)
+					}
+				}
+			}
+
+			for block, want := range test.sampled {
+				var sampled int
+				err := store.db.QueryRow(`SELECT transactions_sampled FROM blocks WHERE number = ?`, int64(block)).Scan(&sampled)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if sampled != want {
+					t.Errorf("block %d has transactions_sampled %d, want %d", block, sampled, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSQLiteStoreReopen(t *testing.T) {
+	//the samples survive closing the database, and a re-collect after reopening still replaces them
+	path := filepath.Join(t.TempDir(), "gas.db")
+	store, err := OpenSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteBlock(testBlockSamples(10, 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = OpenSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.WriteBlock(testBlockSamples(10, 2, 3)); err != nil {
+		t.Fatal(err)
+	}
+	got := sampledHashes(t, store)
+	if len(got) != 1 || len(got[10]) != 2 || got[10][0] != 2 || got[10][1] != 3 {
+		t.Fatalf("stored %v, want block 10 with 2 and 3", got)
+	}
+}
+
+func TestSQLiteStoreLargeAmounts(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	//above the int64 and the uint64 range
+	large, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	block := testBlockSamples(10, 1)
+	block.Records[0].GasPrice = large
+	block.Records[0].Value = large
+	block.Aggregate = &BlockAggregate{Number: 10, Timestamp: block.Timestamp, TransactionsSampled: 1, Transactions: 1, BaseFee: large,
+		EffectiveGasPrice: PriceStats{Min: big.NewInt(1), Max: large}}
+	if err := store.WriteBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	var gasPrice string
+	if err := store.db.QueryRow(`SELECT gas_price FROM sampled_transactions`).Scan(&gasPrice); err != nil {
+		t.Fatal(err)
+	}
+	if gasPrice != large.String() {
+		t.Fatalf("stored gas price %s, want %s", gasPrice, large)
+	}
+	aggregates, err := store.ReadAggregates(block.Timestamp, block.Timestamp.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aggregates) != 1 {
+		t.Fatalf("read %d aggregates, want 1", len(aggregates))
+	}
+	got := aggregates[0]
+	if got.BaseFee.Cmp(large) != 0 || got.EffectiveGasPrice.Max.Cmp(large) != 0 || got.EffectiveGasPrice.Min.Int64() != 1 || got.EffectiveTip.Max != nil {
+		t.Fatalf("read base fee %s, gas prices %s to %s and max tip %s", got.BaseFee, got.EffectiveGasPrice.Min, got.EffectiveGasPrice.Max, got.EffectiveTip.Max)
+	}
+}
+
+func TestSQLiteStoreIntegerAmounts(t *testing.T) {
+	//a database created when the amounts were integer columns
+	path := filepath.Join(t.TempDir(), "gas.db")
+	db, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(regexp.MustCompile(`(fee|price|tip|_per_gas)(\s+)TEXT`).ReplaceAllString(sqliteSchema, "${1}${2}INTEGER"))
+	if err == nil {
+		_, err = db.Exec(`INSERT INTO blocks (number, timestamp, transactions_sampled, transactions_skipped, collected_at) VALUES (10, 1700000120, 1, 0, 0);
+			INSERT INTO block_aggregates (number, transactions_aggregated, base_fee, gas_used, gas_limit, max_effective_gas_price) VALUES (10, 1, 7, 21000, 30000000, 1000);
+			INSERT INTO sampled_transactions (hash, block, timestamp, from_address, type, gas_price, gas_used, input_length) VALUES ('0x1', 10, 1700000120, '0x2', 0, 1000, 21000, 0)`)
+	}
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var gasPrice, kind string
+	if err := store.db.QueryRow(`SELECT gas_price, typeof(gas_price) FROM sampled_transactions`).Scan(&gasPrice, &kind); err != nil {
+		t.Fatal(err)
+	}
+	if gasPrice != "1000" || kind != "text" {
+		t.Fatalf("gas price is the %s %s, want the text 1000", kind, gasPrice)
+	}
+	var indexes int
+	if err := store.db.QueryRow(`SELECT count(*) FROM pragma_index_list('sampled_transactions') WHERE origin = 'c'`).Scan(&indexes); err != nil {
+		t.Fatal(err)
+	}
+	if indexes != 2 {
+		t.Fatalf("sampled_transactions has %d indexes, want 2", indexes)
+	}
+	aggregates, err := store.ReadAggregates(time.Unix(1700000120, 0), time.Unix(1700000121, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aggregates) != 1 || aggregates[0].BaseFee.Int64() != 7 || aggregates[0].EffectiveGasPrice.Max.Int64() != 1000 {
+		t.Fatalf("read %d aggregates, want block 10 with base fee 7 and max gas price 1000", len(aggregates))
+	}
+}
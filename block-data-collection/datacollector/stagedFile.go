@@ -0,0 +1,153 @@
+package datacollector
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// writeFileAtomically writes a file with encode under a temporary name next to path and only
+// renames it into place once it is complete and synced to disk, so neither an interrupted run
+// nor a crash leaves a half written file behind.
+func writeFileAtomically(path string, encode func(w io.Writer) error) error {
+	tmpPath := path + ".tmp"
+	file, errWhenCreating := os.Create(tmpPath)
+	if errWhenCreating != nil {
+		return errWhenCreating
+	}
+	defer os.Remove(tmpPath)
+	defer file.Close()
+
+	errWhenWriting := encode(file)
+	if errWhenWriting != nil {
+		return errWhenWriting
+	}
+	if errWhenSyncing := file.Sync(); errWhenSyncing != nil {
+		return errWhenSyncing
+	}
+	if errWhenClosing := file.Close(); errWhenClosing != nil {
+		return errWhenClosing
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// writeFileAtomic writes content to path with writeFileAtomically.
+func writeFileAtomic(path string, content []byte) error {
+	return writeFileAtomically(path, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+}
+
+// readJSONLines reads a file of one JSON object per line.
+func readJSONLines[T any](path string) ([]*T, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var items []*T
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for {
+		item := new(T)
+		err = decoder.Decode(item)
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+}
+
+// stagedFile is a day or block range file written one item at a time. Until it is finished
+// its items are appended to <path>.partial as JSON lines, whatever the format, and synced, so a
+// stopped run loses nothing and the next run continues the file. Finishing writes the file in
+// its format with writeFileAtomically and removes the partial file, so readers only ever see
+// complete files.
+type stagedFile[T any] struct {
+	path   string
+	items  []*T
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// openStagedFile continues the partial file of path, or else the finished file read by
+// readFinished (nil when finished files are not continued), or starts an empty one. Only the
+// existing items kept by keep (all when nil) are carried over.
+func openStagedFile[T any](path string, readFinished func(path string) ([]*T, error), keep func(item *T) bool) (*stagedFile[T], error) {
+	source := path + partialSuffix
+	existing, err := readJSONLines[T](source)
+	if os.IsNotExist(err) && readFinished != nil {
+		source = path
+		existing, err = readFinished(source)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading %s: %w", source, err)
+	}
+	var kept []*T
+	for _, item := range existing {
+		if keep == nil || keep(item) {
+			kept = append(kept, item)
+		}
+	}
+
+	//the kept items replace the partial file only once they are on disk, a crash while
+	//rewriting it leaves the previous one
+	err = writeFileAtomically(path+partialSuffix, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		for _, item := range kept {
+			if errWhenEncoding := encoder.Encode(item); errWhenEncoding != nil {
+				return errWhenEncoding
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path+partialSuffix, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &stagedFile[T]{path: path, items: kept, file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// Append stages items and syncs them to disk.
+func (f *stagedFile[T]) Append(items ...*T) error {
+	encoder := json.NewEncoder(f.writer)
+	for _, item := range items {
+		errWhenEncoding := encoder.Encode(item)
+		if errWhenEncoding != nil {
+			return errWhenEncoding
+		}
+	}
+	f.items = append(f.items, items...)
+	if errWhenFlushing := f.writer.Flush(); errWhenFlushing != nil {
+		return errWhenFlushing
+	}
+	return f.file.Sync()
+}
+
+// Finish writes the file with encode and removes the partial file.
+func (f *stagedFile[T]) Finish(encode func(w io.Writer, items []*T) error) error {
+	if errWhenClosing := f.file.Close(); errWhenClosing != nil {
+		return errWhenClosing
+	}
+	errWhenWriting := writeFileAtomically(f.path, func(w io.Writer) error {
+		return encode(w, f.items)
+	})
+	if errWhenWriting != nil {
+		return errWhenWriting
+	}
+	return os.Remove(f.path + partialSuffix)
+}
+
+// Close closes the partial file without finishing it, the next run continues it.
+func (f *stagedFile[T]) Close() error {
+	return f.file.Close()
+}
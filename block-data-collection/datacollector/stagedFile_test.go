@@ -0,0 +1,112 @@
+package datacollector
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type stagedItem struct {
+	N int `json:"n"`
+}
+
+func stagedNumbers(items []*stagedItem) []int {
+	var numbers []int
+	for _, item := range items {
+		numbers = append(numbers, item.N)
+	}
+	return numbers
+}
+
+func equalNumbers(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStagedFileContinues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gas_2023-04-01.jsonl")
+	staged, err := openStagedFile[stagedItem](path, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = staged.Append(&stagedItem{1}, &stagedItem{2}, &stagedItem{3}); err != nil {
+		t.Fatal(err)
+	}
+	staged.Close()
+
+	//the next run drops the items it writes again and appends after the kept ones
+	staged, err = openStagedFile[stagedItem](path, nil, func(item *stagedItem) bool { return item.N != 2 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stagedNumbers(staged.items); !equalNumbers(got, []int{1, 3}) {
+		t.Fatalf("kept %v, want [1 3]", got)
+	}
+	if err = staged.Append(&stagedItem{4}); err != nil {
+		t.Fatal(err)
+	}
+	partial, err := readJSONLines[stagedItem](path + partialSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stagedNumbers(partial); !equalNumbers(got, []int{1, 3, 4}) {
+		t.Fatalf("partial file holds %v, want [1 3 4]", got)
+	}
+	if _, err = os.Stat(path + partialSuffix + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("the rewrite left its temporary file: %v", err)
+	}
+
+	err = staged.Finish(func(w io.Writer, items []*stagedItem) error {
+		return json.NewEncoder(w).Encode(stagedNumbers(items))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "[1,3,4]\n" {
+		t.Fatalf("finished file holds %q", content)
+	}
+	if _, err = os.Stat(path + partialSuffix); !os.IsNotExist(err) {
+		t.Fatalf("the partial file was not removed: %v", err)
+	}
+}
+
+func TestStagedFileKeepsPartialOnFailedRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gas_2023-04-01.jsonl")
+	staged, err := openStagedFile[stagedItem](path, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = staged.Append(&stagedItem{1}, &stagedItem{2}); err != nil {
+		t.Fatal(err)
+	}
+	staged.Close()
+
+	//a directory in the way of the temporary file makes the rewrite fail
+	if err = os.Mkdir(path+partialSuffix+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = openStagedFile[stagedItem](path, nil, func(item *stagedItem) bool { return item.N == 1 }); err == nil {
+		t.Fatal("the rewrite did not fail")
+	}
+	partial, err := readJSONLines[stagedItem](path + partialSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stagedNumbers(partial); !equalNumbers(got, []int{1, 2}) {
+		t.Fatalf("partial file holds %v after a failed rewrite, want [1 2]", got)
+	}
+}
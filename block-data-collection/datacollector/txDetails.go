@@ -0,0 +1,293 @@
+package datacollector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+type TransactionResponse struct {
+	Jsonrpc string `json:"jsonrpc"`
+	ID      int    `json:"id"`
+	Result  struct {
+		BlockHash            string      `json:"blockHash"`
+		BlockNumber          string      `json:"blockNumber"`
+		From                 string      `json:"from"`
+		Gas                  string      `json:"gas"`
+		GasPrice             string      `json:"gasPrice"`
+		MaxFeePerGas         string      `json:"maxFeePerGas"`
+		MaxPriorityFeePerGas string      `json:"maxPriorityFeePerGas"`
+		Hash                 string      `json:"hash"`
+		Input                string      `json:"input"`
+		Nonce                string      `json:"nonce"`
+		To                   string      `json:"to"`
+		TransactionIndex     string      `json:"transactionIndex"`
+		Value                string      `json:"value"`
+		Type                 string      `json:"type"`
+		AccessList           interface{} `json:"accessList"`
+		ChainId              string      `json:"chainId"`
+		V                    string      `json:"v"`
+		R                    string      `json:"r"`
+		S                    string      `json:"s"`
+	} `json:"result"`
+}
+
+// TransactionDetails is the per-transaction data written by the collectors.
+// GasPrice is the price actually paid: for EIP-1559 transactions in a block with
+// a base fee it is min(MaxFeePerGas, BaseFee+MaxPriorityFeePerGas).
+// BaseFee is nil for blocks before London.
+type TransactionDetails struct {
+	Hash                 common.Hash
+	BlockNumber          uint64
+	From                 common.Address
+	To                   *common.Address
+	Value                *big.Int
+	Type                 uint8
+	Nonce                uint64
+	Gas                  uint64
+	GasPrice             *big.Int
+	MaxFeePerGas         *big.Int
+	MaxPriorityFeePerGas *big.Int
+	BaseFee              *big.Int
+	EffectiveGasPrice    *big.Int
+	EffectiveTip         *big.Int
+	InputLength          int
+}
+
+// TransactionExtractor builds TransactionDetails from the transactions of an already
+// loaded block. Etherscan is only called when the block data is not enough (for example
+// when the sender cannot be recovered), and only if an Etherscan key pool was given.
+// It is safe for concurrent use; at most maxConcurrentRequests Etherscan calls run at once.
+type TransactionExtractor struct {
+	etherscanKeys   *KeyPool
+	etherscanApiUrl string
+	slots           chan struct{}
+	retry           RetryPolicy
+}
+
+// NewTransactionExtractor creates an extractor calling the Etherscan API at etherscanApiUrl,
+// DefaultEtherscanApiUrl when empty.
+func NewTransactionExtractor(etherscanKeys *KeyPool, etherscanApiUrl string, maxConcurrentRequests int, retry RetryPolicy) *TransactionExtractor {
+	if maxConcurrentRequests < 1 {
+		maxConcurrentRequests = 1
+	}
+	if etherscanApiUrl == "" {
+		etherscanApiUrl = DefaultEtherscanApiUrl
+	}
+	return &TransactionExtractor{etherscanKeys: etherscanKeys, etherscanApiUrl: etherscanApiUrl, slots: make(chan struct{}, maxConcurrentRequests), retry: retry}
+}
+
+// Extract returns the details of a transaction mined in block, with the fee fields
+// completed from the transaction's receipt.
+func (e *TransactionExtractor) Extract(ctx context.Context, tx *types.Transaction, block *types.Block, receipt *types.Receipt) (*TransactionDetails, error) {
+	details, errWhenExtracting := TransactionDetailsFromBlock(tx, block)
+	if errWhenExtracting != nil {
+		if e.etherscanKeys == nil || e.etherscanKeys.Len() == 0 {
+			return nil, errWhenExtracting
+		}
+
+		fmt.Println("Falling back to etherscan for transaction ", tx.Hash().String(), " : ", errWhenExtracting)
+		details, errWhenExtracting = e.fromEtherscan(ctx, tx)
+		if errWhenExtracting != nil {
+			return nil, errWhenExtracting
+		}
+	}
+
+	details.setFees(block.BaseFee(), receipt)
+	return details, nil
+}
+
+// setFees records the block base fee, the effective gas price from the receipt and
+// the tip the block producer actually received per unit of gas.
+func (d *TransactionDetails) setFees(baseFee *big.Int, receipt *types.Receipt) {
+	d.BaseFee = baseFee
+
+	//older nodes do not return effectiveGasPrice in receipts
+	d.EffectiveGasPrice = d.GasPrice
+	if receipt != nil && receipt.EffectiveGasPrice != nil {
+		d.EffectiveGasPrice = receipt.EffectiveGasPrice
+	}
+
+	d.EffectiveTip = d.EffectiveGasPrice
+	if baseFee != nil && d.EffectiveGasPrice != nil {
+		d.EffectiveTip = new(big.Int).Sub(d.EffectiveGasPrice, baseFee)
+	}
+}
+
+// TransactionDetailsFromBlock reads the transaction fields straight from the in-block
+// transaction and recovers the sender with the signer matching the transaction's chain id.
+func TransactionDetailsFromBlock(tx *types.Transaction, block *types.Block) (*TransactionDetails, error) {
+	signer := types.LatestSignerForChainID(tx.ChainId())
+	from, err := types.Sender(signer, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TransactionDetails{
+		Hash:                 tx.Hash(),
+		BlockNumber:          block.NumberU64(),
+		From:                 from,
+		To:                   tx.To(),
+		Value:                tx.Value(),
+		Type:                 tx.Type(),
+		Nonce:                tx.Nonce(),
+		Gas:                  tx.Gas(),
+		GasPrice:             paidGasPrice(tx, block.BaseFee()),
+		MaxFeePerGas:         tx.GasFeeCap(),
+		MaxPriorityFeePerGas: tx.GasTipCap(),
+		InputLength:          len(tx.Data()),
+	}, nil
+}
+
+// paidGasPrice returns the gas price the transaction paid in a block with the given base fee.
+func paidGasPrice(tx *types.Transaction, baseFee *big.Int) *big.Int {
+	if baseFee == nil || tx.Type() != types.DynamicFeeTxType {
+		return tx.GasPrice()
+	}
+	tip, err := tx.EffectiveGasTip(baseFee)
+	if err != nil {
+		//fee cap below base fee, cannot be included in this block
+		return tx.GasFeeCap()
+	}
+	return new(big.Int).Add(baseFee, tip)
+}
+
+func (e *TransactionExtractor) fromEtherscan(ctx context.Context, tx *types.Transaction) (*TransactionDetails, error) {
+	select {
+	case e.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-e.slots }()
+
+	var details *TransactionDetails
+	err := e.retry.Do(ctx, "etherscan eth_getTransactionByHash", func() error {
+		//rate limited or rejected keys are benched by the pool and the next key is tried
+		return e.etherscanKeys.Do(ctx, func(key string) error {
+			var err error
+			details, err = fetchEtherscanTransaction(ctx, CreateTransactionUrl(e.etherscanApiUrl, key, tx.Hash().String()))
+			return err
+		})
+	})
+	return details, err
+}
+
+// etherscanErrorResponse is what Etherscan returns instead of a JSON-RPC result when a
+// call is rejected, e.g. {"status":"0","message":"NOTOK","result":"Max rate limit reached"}.
+type etherscanErrorResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Result  string `json:"result"`
+}
+
+func fetchEtherscanTransaction(ctx context.Context, transactionUrl string) (*TransactionDetails, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, transactionUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	transactionRes, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer transactionRes.Body.Close()
+
+	if transactionRes.StatusCode != http.StatusOK {
+		return nil, &HTTPStatusError{StatusCode: transactionRes.StatusCode, Status: transactionRes.Status}
+	}
+
+	txnBody, err := ioutil.ReadAll(transactionRes.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var errorResponse etherscanErrorResponse
+	if json.Unmarshal(txnBody, &errorResponse) == nil && errorResponse.Result != "" {
+		return nil, fmt.Errorf("etherscan: %s", errorResponse.Result)
+	}
+
+	var transactionResponse TransactionResponse
+	err = json.Unmarshal(txnBody, &transactionResponse)
+	if err != nil {
+		return nil, err
+	}
+	if transactionResponse.Result.Hash == "" {
+		return nil, ethereum.NotFound
+	}
+
+	return transactionResponse.details()
+}
+
+func (r *TransactionResponse) details() (*TransactionDetails, error) {
+	result := r.Result
+
+	blockNumber, err := hexutil.DecodeUint64(result.BlockNumber)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block number %q: %w", result.BlockNumber, err)
+	}
+	value, err := hexutil.DecodeBig(result.Value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q: %w", result.Value, err)
+	}
+	gasPrice, err := hexutil.DecodeBig(result.GasPrice)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gas price %q: %w", result.GasPrice, err)
+	}
+	txType, err := hexutil.DecodeUint64(result.Type)
+	if err != nil {
+		return nil, fmt.Errorf("invalid type %q: %w", result.Type, err)
+	}
+	nonce, err := hexutil.DecodeUint64(result.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce %q: %w", result.Nonce, err)
+	}
+	gas, err := hexutil.DecodeUint64(result.Gas)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gas %q: %w", result.Gas, err)
+	}
+	input, err := hexutil.Decode(result.Input)
+	if err != nil {
+		return nil, fmt.Errorf("invalid input: %w", err)
+	}
+
+	details := &TransactionDetails{
+		Hash:                 common.HexToHash(result.Hash),
+		BlockNumber:          blockNumber,
+		From:                 common.HexToAddress(result.From),
+		Value:                value,
+		Type:                 uint8(txType),
+		Nonce:                nonce,
+		Gas:                  gas,
+		GasPrice:             gasPrice,
+		MaxFeePerGas:         gasPrice,
+		MaxPriorityFeePerGas: gasPrice,
+		InputLength:          len(input),
+	}
+	if result.To != "" {
+		to := common.HexToAddress(result.To)
+		details.To = &to
+	}
+	//only EIP-1559 transactions carry the fee caps
+	if result.MaxFeePerGas != "" {
+		if details.MaxFeePerGas, err = hexutil.DecodeBig(result.MaxFeePerGas); err != nil {
+			return nil, fmt.Errorf("invalid max fee per gas %q: %w", result.MaxFeePerGas, err)
+		}
+	}
+	if result.MaxPriorityFeePerGas != "" {
+		if details.MaxPriorityFeePerGas, err = hexutil.DecodeBig(result.MaxPriorityFeePerGas); err != nil {
+			return nil, fmt.Errorf("invalid max priority fee per gas %q: %w", result.MaxPriorityFeePerGas, err)
+		}
+	}
+	return details, nil
+}
+
+func CreateTransactionUrl(apiUrl string, apiKey string, txn string) string {
+	return apiUrl + `?module=proxy&action=eth_getTransactionByHash&txhash=` + txn + `&apikey=` + apiKey
+}
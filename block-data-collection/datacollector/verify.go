@@ -0,0 +1,157 @@
+package datacollector
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// OutputReport is the result of checking the block files of an output folder.
+type OutputReport struct {
+	Files int
+	Rows  int
+	//block files without any sampled transaction
+	EmptyFiles int
+	Problems   []string
+}
+
+func (r *OutputReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *OutputReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// VerifyGasOutput checks every block, day and block range file in dir. Csv files are
+// checked for the header, the number of columns and that the block and price columns are
+// numbers; JSON lines and Parquet files for records that can be read and have a gas price.
+// Temporary files left by an interrupted write are reported too. The error is only set
+// when dir cannot be read.
+func VerifyGasOutput(dir string) (*OutputReport, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &OutputReport{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, ".tmp") && IsOutputFile(strings.TrimSuffix(name, ".tmp")) || strings.HasSuffix(name, partialSuffix) && isConsolidatedFile(name) {
+			report.problem("%s: unfinished write", name)
+			continue
+		}
+		format := formatOf(name)
+		if format == "" {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if isConsolidatedFile(name) {
+			report.Files++
+			if format == FormatCSV {
+				verifyGasFile(path, columnNames(consolidatedColumns), report)
+			} else {
+				verifyRecordFile(path, nil, report)
+			}
+			continue
+		}
+		//only block files are checked, other files may share the folder
+		number, errWhenParsing := strconv.ParseUint(strings.TrimSuffix(name, format.Extension()), 10, 64)
+		if errWhenParsing != nil {
+			continue
+		}
+
+		report.Files++
+		if format == FormatCSV {
+			verifyGasFile(path, columnNames(gasSampleColumns), report)
+		} else {
+			verifyRecordFile(path, &number, report)
+		}
+	}
+	return report, nil
+}
+
+// verifyRecordFile checks a JSON lines or Parquet file; block, when set, is the block all
+// records must belong to.
+func verifyRecordFile(path string, block *uint64, report *OutputReport) {
+	name := filepath.Base(path)
+
+	records, err := readGasRecords(path)
+	if err != nil {
+		report.problem("%s: %v", name, err)
+		return
+	}
+	if len(records) == 0 {
+		report.EmptyFiles++
+	}
+	for i, record := range records {
+		if record.GasPrice == nil {
+			report.problem("%s: record %d has no gas price", name, i+1)
+		}
+		if block != nil && record.Block != *block {
+			report.problem("%s: record %d belongs to block %d", name, i+1, record.Block)
+		}
+	}
+	report.Rows += len(records)
+}
+
+func verifyGasFile(path string, headers []string, report *OutputReport) {
+	name := filepath.Base(path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		report.problem("%s: %v", name, err)
+		return
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	//column counts are checked below so they can be reported per row
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		report.problem("%s: %v", name, err)
+		return
+	}
+	if len(records) == 0 {
+		report.problem("%s: empty file", name)
+		return
+	}
+	if strings.Join(records[0], ",") != strings.Join(headers, ",") {
+		report.problem("%s: unexpected header %v", name, records[0])
+		return
+	}
+
+	rows := records[1:]
+	if len(rows) == 0 {
+		report.EmptyFiles++
+	}
+	for i, row := range rows {
+		line := i + 2
+		if len(row) != len(headers) {
+			report.problem("%s:%d: %d columns, expected %d", name, line, len(row), len(headers))
+			continue
+		}
+		for column := range row {
+			if headers[column] == "Timestamp" {
+				continue
+			}
+			//the base fee is empty for blocks before London
+			if row[column] == "" && headers[column] == "Base Fee(Gwei)" {
+				continue
+			}
+			if _, ok := new(big.Float).SetString(row[column]); !ok {
+				report.problem("%s:%d: %s %q is not a number", name, line, headers[column], row[column])
+			}
+		}
+	}
+	report.Rows += len(rows)
+}
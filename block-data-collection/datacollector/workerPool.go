@@ -0,0 +1,99 @@
+package datacollector
+
+import (
+	"context"
+	"sync"
+)
+
+// fetchInOrder calls fetch for every block in [from, to) on up to workers goroutines and
+// passes the results to write one at a time, strictly in block order. At most
+// 2*workers blocks are fetched ahead of the writer, which bounds memory use.
+// The first error returned by write stops the run and is returned; cancelling ctx stops
+// handing out new blocks.
+func fetchInOrder[T any](ctx context.Context, from uint64, to uint64, workers int, fetch func(number uint64) T, write func(number uint64, result T) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	if from >= to {
+		return nil
+	}
+
+	type fetched struct {
+		number uint64
+		result T
+	}
+
+	window := make(chan struct{}, 2*workers)
+	jobs := make(chan uint64)
+	results := make(chan fetched)
+	stop := make(chan struct{})
+
+	//producer, blocks when the writer falls a full window behind
+	go func() {
+		defer close(jobs)
+		for number := from; number < to; number++ {
+			select {
+			case window <- struct{}{}:
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- number:
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for number := range jobs {
+				results <- fetched{number: number, result: fetch(number)}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	//reorder the results so they are written in block order
+	pending := make(map[uint64]T)
+	next := from
+	var errWhenWriting error
+	for res := range results {
+		//after a failure the remaining results are only drained
+		if errWhenWriting != nil {
+			continue
+		}
+
+		pending[res.number] = res.result
+		for {
+			result, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			errWhenWriting = write(next, result)
+			if errWhenWriting != nil {
+				close(stop)
+				break
+			}
+			next++
+			<-window
+		}
+	}
+	if errWhenWriting == nil && next < to {
+		//the producer stopped early because ctx was cancelled
+		return ctx.Err()
+	}
+	return errWhenWriting
+}
@@ -0,0 +1,141 @@
+package datacollector
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// shuffledFetch returns a fetch that finishes the blocks out of order, and checks that no
+// block is fetched more than 2*workers blocks ahead of the writer.
+func shuffledFetch(t *testing.T, from uint64, workers int, written *int64) func(number uint64) uint64 {
+	return func(number uint64) uint64 {
+		if ahead := int64(number-from) - atomic.LoadInt64(written); ahead >= int64(2*workers) {
+			t.Errorf("block %d fetched %d blocks ahead of the writer", number, ahead)
+		}
+		time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+		return number * 10
+	}
+}
+
+func TestFetchInOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    uint64
+		to      uint64
+		workers int
+	}{
+		{"many workers", 0, 200, 8},
+		{"one worker", 100, 150, 1},
+		{"no workers runs one", 100, 110, 0},
+		{"more workers than blocks", 7, 9, 16},
+		{"single block", 10, 11, 4},
+		{"empty range", 5, 5, 4},
+		{"reversed range", 9, 5, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			workers := test.workers
+			if workers < 1 {
+				workers = 1
+			}
+			var written int64
+			next := test.from
+			err := fetchInOrder(context.Background(), test.from, test.to, test.workers, shuffledFetch(t, test.from, workers, &written),
+				func(number uint64, result uint64) error {
+					if number != next || result != number*10 {
+						t.Fatalf("wrote block %d with %d, want block %d with %d", number, result, next, next*10)
+					}
+					next++
+					atomic.AddInt64(&written, 1)
+					return nil
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := test.to
+			if test.from > test.to {
+				want = test.from
+			}
+			if next != want {
+				t.Fatalf("wrote up to block %d, want %d", next, want)
+			}
+		})
+	}
+}
+
+func TestFetchInOrderStopsAtWriteError(t *testing.T) {
+	errWrite := errors.New("disk full")
+	tests := []struct {
+		name    string
+		failAt  uint64
+		workers int
+	}{
+		{"first block", 0, 4},
+		{"middle block", 37, 4},
+		{"middle block, one worker", 37, 1},
+		{"last block", 99, 8},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var written, fetched int64
+			fetch := shuffledFetch(t, 0, test.workers, &written)
+			var writes []uint64
+			done := make(chan error)
+			go func() {
+				done <- fetchInOrder(context.Background(), 0, 100, test.workers,
+					func(number uint64) uint64 {
+						atomic.AddInt64(&fetched, 1)
+						return fetch(number)
+					},
+					func(number uint64, result uint64) error {
+						writes = append(writes, number)
+						if number == test.failAt {
+							return errWrite
+						}
+						atomic.AddInt64(&written, 1)
+						return nil
+					})
+			}()
+
+			select {
+			case err := <-done:
+				if !errors.Is(err, errWrite) {
+					t.Fatalf("returned %v, want the write error", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("fetchInOrder did not return after the write error")
+			}
+			if uint64(len(writes)) != test.failAt+1 || writes[len(writes)-1] != test.failAt {
+				t.Fatalf("wrote %v, want the blocks up to %d and nothing after it", writes, test.failAt)
+			}
+			//the blocks in flight are finished, nothing is fetched past the window
+			if limit := int64(test.failAt) + 1 + int64(2*test.workers); atomic.LoadInt64(&fetched) > limit {
+				t.Fatalf("fetched %d blocks, at most %d expected", fetched, limit)
+			}
+		})
+	}
+}
+
+func TestFetchInOrderCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var written int64
+	err := fetchInOrder(ctx, 0, 1000, 4, shuffledFetch(t, 0, 4, &written), func(number uint64, result uint64) error {
+		if number == 10 {
+			cancel()
+		}
+		atomic.AddInt64(&written, 1)
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("returned %v, want context.Canceled", err)
+	}
+	if written >= 1000 {
+		t.Fatal("every block was written after the cancellation")
+	}
+}
@@ -1,63 +1,432 @@
-package main
-
-import (
-	"fmt"
-	"os"
-	"path/filepath"
-	"time"
-
-	"github.com/IshiniKiridena/block_data/datacollector"
-)
-
-func main() {
-	//pass the ISO date and time as a string in the format of -> 2022-01-01T00:00:00Z
-	//01st April 2023 to 02nd of April 2023
-
-	//datacollector.CollectData("2023-04-01T00:00:00Z", "2023-04-02T00:00:00Z")
-	//datacollector.GasDataCollector("2023-06-29T06:00:00Z", "2023-06-29T06:05:00Z")
-
-	for {
-		// To collect data every day
-		now := time.Now().UTC()
-		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
-		yesterday := today.Add(-24 * time.Hour)
-
-		todayString := today.Format("2006-01-02T15:04:05Z")
-		yesterdayString := yesterday.Format("2006-01-02T15:04:05Z")
-
-		done := make(chan bool)
-		datacollector.GasDataCollector(yesterdayString, todayString, done)
-
-		// Wait for data collection to be finished
-		<-done
-
-		// Remove csv files older than 2 months
-		dataFolder := "tracified-scripts/block-data-collection"
-		MonthsAgo := time.Now().AddDate(0, -2, 0)
-
-		err := filepath.Walk(dataFolder, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-
-			// Check if the filepath is csv and older than a month.
-			if !info.IsDir() && filepath.Ext(path) == ".csv" && info.ModTime().Before(MonthsAgo) {
-				// Remove file
-				err := os.Remove(path)
-				if err != nil {
-					return err
-				}
-				fmt.Println("Removed File: ", path)
-			}
-
-			return nil
-		})
-
-		if err != nil {
-			fmt.Println("Error: ", err)
-		} else {
-			fmt.Println("File removal completed successfully.")
-		}
-	}
-
-}
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/IshiniKiridena/block_data/datacollector"
+)
+
+// exit codes shared by all commands
+const (
+	exitOK = 0
+	//the run failed or verification found problems
+	exitFailure = 1
+	//bad arguments or configuration
+	exitUsage = 2
+	//stopped by SIGINT/SIGTERM, the checkpoint allows resuming
+	exitInterrupted = 130
+)
+
+const usage = `Usage: block_data <command> [flags] [arguments]
+
+Commands:
+  daily                        collect every finished UTC day on schedule (default)
+  backfill --from T --to T     collect the gas samples of a time range
+  resume <job>                 continue an interrupted job from its checkpoint
+  verify <dir>                 check the block files in a folder
+  gaps --from T --to T         find missing or empty block files and queue them
+                               for recollection (--recollect collects them now)
+  full-tx --from T --to T      write every transaction of one block per minute
+  rollup --from T --to T       summarise the block aggregates per minute, hour
+                               and day (--interval chooses the bucket sizes)
+  reconcile --from T --to T    find blocks replaced by a reorg since they were
+                               collected (--recollect collects them again)
+  live                         follow the chain head and collect every block
+                               once it is confirmed, until stopped
+  mempool                      record the max fees and tips offered by pending
+                               transactions every minute, until stopped
+
+Times are UTC dates (2023-04-01) or RFC3339 times (2023-04-01T06:00:00Z).
+Run "block_data <command> -h" for the flags of a command.
+`
+
+type command func(ctx context.Context, args []string) int
+
+var commands = map[string]command{
+	"daily":     runDaily,
+	"backfill":  runBackfill,
+	"resume":    runResume,
+	"verify":    runVerify,
+	"gaps":      runGaps,
+	"full-tx":   runFullTx,
+	"rollup":    runRollup,
+	"reconcile": runReconcile,
+	"live":      runLive,
+	"mempool":   runMempool,
+}
+
+func main() {
+	datacollector.LoadEnv()
+
+	//without a command the daily collection is started, as before there were commands
+	name := "daily"
+	args := os.Args[1:]
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		fmt.Print(usage)
+		os.Exit(exitOK)
+	}
+
+	run, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", name, usage)
+		os.Exit(exitUsage)
+	}
+
+	//Ctrl+C or SIGTERM stops the collector after the block it is writing, the checkpoint
+	//lets the next run continue from there
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := run(ctx, args)
+	stop()
+	os.Exit(code)
+}
+
+// configFlags are the flags every collecting command accepts.
+type configFlags struct {
+	set           *flag.FlagSet
+	configFile    *string
+	rpcUrl        *string
+	outputDir     *string
+	outputLayout  *string
+	outputFormat  *string
+	aggregates    *bool
+	sampleSize    *int
+	sampler       *string
+	confirmations *int
+	workers       *int
+	retentionDays *int
+	dailyAt       *string
+}
+
+func newConfigFlags(name string) *configFlags {
+	set := flag.NewFlagSet(name, flag.ContinueOnError)
+	//errors and the usage are printed by usageError
+	set.SetOutput(io.Discard)
+	return &configFlags{
+		set:           set,
+		configFile:    set.String("config", "config.yaml", "YAML config file, optional unless given explicitly"),
+		rpcUrl:        set.String("rpc-url", "", "JSON-RPC endpoint used instead of Infura"),
+		outputDir:     set.String("output-dir", "", "folder the block files are written to"),
+		outputLayout:  set.String("output-layout", "", "one file per block, day or blocks"),
+		outputFormat:  set.String("output-format", "", "csv, jsonl, parquet, sqlite or postgres"),
+		aggregates:    set.Bool("aggregates", false, "also write per-block gas price aggregates"),
+		sampleSize:    set.Int("sample-size", 0, "transactions sampled per block"),
+		sampler:       set.String("sampler", "", "uniform, reservoir, stratified-type, stratified-price or all"),
+		confirmations: set.Int("confirmations", 0, "confirmations a block needs before it is collected"),
+		workers:       set.Int("workers", 0, "blocks fetched in parallel"),
+		retentionDays: set.Int("retention-days", 0, "remove output files older than this many days, 0 keeps everything"),
+		dailyAt:       set.String("daily-at", "", "UTC time of day the daily job starts, HH:MM"),
+	}
+}
+
+// parse parses the flags and returns the positional arguments. Flags may also follow the
+// first positional argument, as in "resume <job> -workers 8".
+func (f *configFlags) parse(args []string) ([]string, error) {
+	errWhenParsing := f.set.Parse(args)
+	if errWhenParsing != nil {
+		return nil, errWhenParsing
+	}
+	if f.set.NArg() == 0 {
+		return nil, nil
+	}
+
+	first := f.set.Arg(0)
+	errWhenParsing = f.set.Parse(f.set.Args()[1:])
+	if errWhenParsing != nil {
+		return nil, errWhenParsing
+	}
+	return append([]string{first}, f.set.Args()...), nil
+}
+
+// load builds the configuration from the config file, the environment and the command
+// line flags, in increasing order of precedence.
+func (f *configFlags) load() (datacollector.Config, error) {
+	configFileGiven := false
+	f.set.Visit(func(set *flag.Flag) {
+		if set.Name == "config" {
+			configFileGiven = true
+		}
+	})
+
+	config, errWhenLoadingConfig := datacollector.LoadConfig(*f.configFile, configFileGiven)
+	if errWhenLoadingConfig != nil {
+		return config, errWhenLoadingConfig
+	}
+
+	//only the flags that were passed override the file and the environment
+	f.set.Visit(func(set *flag.Flag) {
+		switch set.Name {
+		case "rpc-url":
+			config.Endpoints.RpcUrl = *f.rpcUrl
+		case "output-dir":
+			config.Output.Dir = *f.outputDir
+		case "output-layout":
+			config.Output.Layout = datacollector.OutputLayout(*f.outputLayout)
+		case "output-format":
+			config.Output.Format = datacollector.OutputFormat(*f.outputFormat)
+		case "aggregates":
+			config.Aggregates.Enabled = *f.aggregates
+		case "sample-size":
+			config.Sampling.SampleSize = *f.sampleSize
+		case "sampler":
+			config.Sampling.Strategy = datacollector.SamplingStrategy(*f.sampler)
+		case "confirmations":
+			config.Reorg.Confirmations = *f.confirmations
+		case "workers":
+			config.Concurrency.Workers = *f.workers
+		case "retention-days":
+			config.Retention.Days = *f.retentionDays
+		case "daily-at":
+			config.Schedule.DailyAt = *f.dailyAt
+		}
+	})
+
+	return config, config.Validate()
+}
+
+// collector holds what every collecting command needs: the configuration, the key pools,
+// the block source and, for the database formats, the store the samples go to.
+type collector struct {
+	config        datacollector.Config
+	infuraKeys    *datacollector.KeyPool
+	etherscanKeys *datacollector.KeyPool
+	source        datacollector.BlockSource
+	sampler       datacollector.Sampler
+
+	checkpoints datacollector.CheckpointStore
+	//nil for the file formats
+	store datacollector.GasStore
+	runs  datacollector.JobRunRecorder
+}
+
+// setup loads the configuration and connects to the block source. It prints the error and
+// returns the exit code when something is wrong.
+func (f *configFlags) setup() (*collector, int) {
+	config, errWhenLoadingConfig := f.load()
+	if errWhenLoadingConfig != nil {
+		fmt.Println("Error when loading the configuration : ", errWhenLoadingConfig)
+		return nil, exitUsage
+	}
+
+	sampler, errWhenCreatingSampler := config.Sampler()
+	if errWhenCreatingSampler != nil {
+		fmt.Println("Error when loading the configuration : ", errWhenCreatingSampler)
+		return nil, exitUsage
+	}
+
+	c := &collector{config: config, sampler: sampler}
+	c.infuraKeys = datacollector.NewKeyPool(config.Keys.Infura, config.Concurrency.InfuraRequestsPerSecond, datacollector.DefaultKeyCooldown)
+	c.infuraKeys.SetDailyQuota(config.Concurrency.InfuraDailyQuota)
+	c.etherscanKeys = datacollector.NewKeyPool(config.Keys.Etherscan, config.Concurrency.EtherscanRequestsPerSecond, datacollector.DefaultKeyCooldown)
+
+	var errWhenCreatingSource error
+	c.source, errWhenCreatingSource = c.createBlockSource()
+	if errWhenCreatingSource != nil {
+		fmt.Println("Error when connecting to the block source : ", errWhenCreatingSource)
+		return nil, exitFailure
+	}
+
+	errWhenOpeningStore := c.openStore()
+	if errWhenOpeningStore != nil {
+		fmt.Println("Error when opening the database : ", errWhenOpeningStore)
+		return nil, exitFailure
+	}
+	return c, exitOK
+}
+
+// openStore opens the database of the configured format. The database also keeps the
+// checkpoints, and SQLite the job runs; the file formats use the checkpoint file.
+func (c *collector) openStore() error {
+	switch c.config.Output.Format {
+	case datacollector.FormatSQLite:
+		store, err := datacollector.OpenSQLiteStore(c.config.Output.Database)
+		if err != nil {
+			return err
+		}
+		c.store, c.checkpoints, c.runs = store, store, store
+	case datacollector.FormatPostgres:
+		store, err := datacollector.OpenPostgresStore(datacollector.PostgresOptions{
+			Url:              c.config.Postgres.Url,
+			SamplesTable:     c.config.Postgres.SamplesTable,
+			BlocksTable:      c.config.Postgres.BlocksTable,
+			CheckpointsTable: c.config.Postgres.CheckpointsTable,
+			BatchBlocks:      c.config.Postgres.BatchBlocks,
+			Timescale:        c.config.Postgres.Timescale,
+		})
+		if err != nil {
+			return err
+		}
+		c.store, c.checkpoints = store, store
+	default:
+		c.checkpoints = datacollector.NewFileCheckpointStore(c.config.Output.CheckpointFile)
+	}
+	return nil
+}
+
+// checkpointLocation names where the checkpoints are kept, for messages.
+func (c *collector) checkpointLocation() string {
+	switch c.config.Output.Format {
+	case datacollector.FormatSQLite:
+		return c.config.Output.Database
+	case datacollector.FormatPostgres:
+		return "table " + c.config.Postgres.CheckpointsTable
+	default:
+		return c.config.Output.CheckpointFile
+	}
+}
+
+// lockPath is the lock file of the commands writing checkpoints, next to the database or
+// checkpoint file. It only keeps apart the collectors of one machine, also for PostgreSQL.
+func (c *collector) lockPath() string {
+	if c.config.Output.Format == datacollector.FormatSQLite {
+		return c.config.Output.Database + ".lock"
+	}
+	return c.config.Output.CheckpointFile + ".lock"
+}
+
+// lock takes the lock file for the whole command. It prints the error and returns the exit
+// code when another collection holds it.
+func (c *collector) lock() (*datacollector.FileLock, int) {
+	lock, errWhenLocking := datacollector.LockFile(c.lockPath())
+	if errors.Is(errWhenLocking, datacollector.ErrLocked) {
+		fmt.Println("Another collection is writing the checkpoints, try again when it is done : ", errWhenLocking)
+		return nil, exitFailure
+	}
+	if errWhenLocking != nil {
+		fmt.Println("Error when taking the lock : ", errWhenLocking)
+		return nil, exitFailure
+	}
+	return lock, exitOK
+}
+
+// close closes the database, if any.
+func (c *collector) close() {
+	if c.store == nil {
+		return
+	}
+	errWhenClosing := c.store.Close()
+	if errWhenClosing != nil {
+		fmt.Println("Error when closing the database : ", errWhenClosing)
+	}
+}
+
+// createBlockSource connects to the configured RPC URL when there is one (own node, other
+// provider), otherwise it spreads the calls over the Infura endpoints of the Infura keys.
+func (c *collector) createBlockSource() (datacollector.BlockSource, error) {
+	if c.config.Endpoints.RpcUrl != "" {
+		source, err := datacollector.NewRPCBlockSource(c.config.Endpoints.RpcUrl)
+		if err != nil {
+			return nil, err
+		}
+		return datacollector.NewLimitedBlockSource(source, c.config.Concurrency.MaxRpcRequests), nil
+	}
+
+	source, err := datacollector.NewPooledBlockSource(c.infuraKeys, c.config.InfuraUrlForKey)
+	if err != nil {
+		return nil, err
+	}
+	return datacollector.NewLimitedBlockSource(source, c.config.Concurrency.MaxRpcRequests), nil
+}
+
+// gasOptions returns the gas collector options of the configuration. Jobs always resume
+// from their checkpoint if a previous run was interrupted.
+func (c *collector) gasOptions() datacollector.GasCollectorOptions {
+	return datacollector.GasCollectorOptions{
+		Source:      c.source,
+		Checkpoints: c.checkpoints,
+		Resume:      true,
+
+		Workers:              c.config.Concurrency.Workers,
+		EtherscanKeys:        c.etherscanKeys,
+		MaxEtherscanRequests: c.config.Concurrency.MaxEtherscanRequests,
+		EtherscanApiUrl:      c.config.Endpoints.EtherscanApiUrl,
+		Retry:                c.config.RetryPolicy(),
+		Confirmations:        uint64(c.config.Reorg.Confirmations),
+
+		SampleSize:    c.config.Sampling.SampleSize,
+		Sampler:       c.sampler,
+		SampleSeed:    c.config.Sampling.Seed,
+		OutputDir:     c.config.Output.Dir,
+		OutputLayout:  c.config.Output.Layout,
+		BlocksPerFile: c.config.Output.BlocksPerFile,
+		OutputFormat:  c.config.Output.Format,
+		Store:         c.store,
+		Runs:          c.runs,
+
+		AggregateScope: c.config.Aggregates.Scope,
+		Aggregates:     c.config.Aggregates.Enabled,
+		AggregatesDir:  c.config.Aggregates.Dir,
+	}
+}
+
+// collectGas runs one gas collection job, prints its summary and returns the exit code.
+func (c *collector) collectGas(ctx context.Context, startTime string, endTime string) int {
+	errWhenCollecting := c.runGasJob(ctx, startTime, endTime)
+	return exitCode(ctx, "Gas data collection for "+datacollector.GasJobName(startTime, endTime), errWhenCollecting)
+}
+
+// runGasJob runs one gas collection job and prints its summary and the key usage.
+func (c *collector) runGasJob(ctx context.Context, startTime string, endTime string) error {
+	result, errWhenCollecting := datacollector.GasDataCollector(ctx, c.gasOptions(), startTime, endTime)
+	printResult(result)
+	printKeyUsage("Infura", c.infuraKeys)
+	printKeyUsage("Etherscan", c.etherscanKeys)
+	return errWhenCollecting
+}
+
+// exitCode prints err and maps it to the exit code of the command.
+func exitCode(ctx context.Context, operation string, err error) int {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		fmt.Println(operation, " was interrupted, run it again to resume")
+		return exitInterrupted
+	}
+	if err != nil {
+		fmt.Println(operation, " failed : ", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// parseTime accepts a UTC date or an RFC3339 time and returns it in the RFC3339 form used
+// in job names, so the same range always resumes the same job.
+func parseTime(value string) (string, error) {
+	parsed, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		parsed, err = time.Parse(time.RFC3339, value)
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid time %q, expected 2006-01-02 or 2006-01-02T15:04:05Z", value)
+	}
+	return parsed.UTC().Format("2006-01-02T15:04:05Z"), nil
+}
+
+// printResult prints the summary of a gas collection run.
+func printResult(result *datacollector.GasCollectionResult) {
+	fmt.Printf("Job %s : blocks %d to %d, %d blocks processed, %d transactions sampled, %d skipped, %d errors in %s\n",
+		result.Job, result.StartBlock, result.EndBlock, result.BlocksProcessed, result.TransactionsSampled,
+		result.TransactionsSkipped, result.Errors, result.Duration.Round(time.Second))
+	if result.Sampler != "" {
+		fmt.Printf("Sampled with %s, seed %d\n", result.Sampler, result.SampleSeed)
+	}
+	if result.LastError != nil {
+		fmt.Println("Last error : ", result.LastError)
+	}
+}
+
+// printKeyUsage prints the per-key request counts of a key pool.
+func printKeyUsage(provider string, pool *datacollector.KeyPool) {
+	for _, stats := range pool.Stats() {
+		fmt.Printf("%s key %s : %d requests (%d today), %d failures, %d rate limited, %d rejected\n",
+			provider, stats.Key, stats.Requests, stats.RequestsToday, stats.Failures, stats.RateLimited, stats.AuthFailures)
+	}
+}